@@ -1,6 +1,7 @@
 package stash
 
 import (
+	"context"
 	"strconv"
 	"testing"
 	"time"
@@ -18,24 +19,19 @@ func BenchmarkClientSetGet(b *testing.B) {
 		b.Fatal(err)
 	}
 
-	handler := func(cmd []byte, arg []byte) ([]byte, error) {
+	handler := func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
 		c, err := db.ParseCommand(cmd)
 		if err != nil {
-			return nil, err
+			return db.Reply{}, err
 		}
-		return d.Exec(c, arg)
+		return d.ExecReply(ctx, c, arg)
 	}
 
-	stop := make(chan struct{})
-	cfg := server.Config{
-		Stop: stop,
+	s, err := server.NewServer("", handler, nil)
+	if err != nil {
+		b.Fatal(err)
 	}
-
-	stopped := make(chan struct{})
-	go func() {
-		server.ListenAndServe("", handler, &cfg)
-		stopped <- struct{}{}
-	}()
+	go s.ListenAndServe()
 
 	setCommands := make([]string, 0, b.N)
 	getCommands := make([]string, 0, b.N)
@@ -50,7 +46,7 @@ func BenchmarkClientSetGet(b *testing.B) {
 	conn, err := client.Dial("127.0.0.1:7777")
 	if err != nil {
 		b.Error(err)
-		stop <- struct{}{}
+		s.Close()
 		return
 	}
 
@@ -67,5 +63,5 @@ func BenchmarkClientSetGet(b *testing.B) {
 	}
 	b.StopTimer()
 
-	stop <- struct{}{}
+	s.Shutdown(context.Background())
 }
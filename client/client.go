@@ -1,15 +1,49 @@
 package client
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/maximp/stash/cluster"
+	"github.com/maximp/stash/db"
+)
+
+// Reply codes of stash server
+const (
+	okCode       = 200
+	redirectCode = 301
 )
 
-// A Client represents client connection to stash network server
+// maxRedirects limits number of redirects followed by single command
+const maxRedirects = 5
+
+// A Client represents client connection to stash network server. If server
+// runs in cluster mode, Client follows redirects to other cluster nodes and
+// caches slot map to send next commands directly to owners of their keys.
+// Client selects typed protocol on servers supporting it, so replies are
+// decoded by Reply without loss.
 type Client struct {
-	conn *textproto.Conn
+	addr  string // address client is connected to
+	nodes *nodes
+}
+
+// ErrClosed is returned by commands of closed Client
+var ErrClosed = errors.New("client is closed")
+
+// A nodes holds connections to cluster nodes and cached slot map
+type nodes struct {
+	slots    *cluster.SlotMap // nil until first redirect
+	mu       sync.Mutex       // guards conns and closed, conn is closed by done context
+	closed   bool
+	conns    map[string]*textproto.Conn
+	typed    map[*textproto.Conn]bool // connections using typed protocol
+	password string                   // sent to cluster nodes on connect
+	db       int                      // selected on cluster nodes on connect
 }
 
 // Dial connects to the given address and returns a new Client for the connection
@@ -18,52 +52,339 @@ func Dial(addr string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{conn}, nil
+
+	typed, err := hello(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Client{addr, &nodes{
+		conns: map[string]*textproto.Conn{addr: conn},
+		typed: map[*textproto.Conn]bool{conn: typed},
+	}}, nil
+}
+
+// hello selects typed protocol on connection, it reports false if server
+// does not support it
+func hello(conn *textproto.Conn) (bool, error) {
+	code, _, err := call(conn, "hello 2")
+	if err != nil {
+		return false, err
+	}
+	return code == okCode, nil
 }
 
 // Close implements io.Closer interface, closes client connection
 func (c Client) Close() error {
-	return c.conn.Close()
+	c.nodes.mu.Lock()
+	defer c.nodes.mu.Unlock()
+
+	if c.nodes.closed {
+		return ErrClosed
+	}
+	c.nodes.closed = true
+
+	var err error
+	for addr, conn := range c.nodes.conns {
+		if e := conn.Close(); addr == c.addr {
+			err = e
+		}
+	}
+	return err
+}
+
+// Auth authenticates client connection with password, the password is also
+// sent to cluster nodes client connects to later
+func (c Client) Auth(password string) error {
+	conn, err := c.dial(c.addr)
+	if err != nil {
+		return err
+	}
+	code, line, err := call(conn, db.EncodeLine("auth "+password))
+	if err != nil {
+		return err
+	}
+	if code != okCode {
+		return errors.New(line)
+	}
+	c.nodes.password = password
+	return nil
+}
+
+// Select selects logical database n for following commands. Database is
+// selected on all open connections of client and on connections client
+// opens later. If any connection fails to select it, previous database is
+// selected back and connections in unknown state are closed.
+func (c Client) Select(n int) error {
+	if _, err := c.dial(c.addr); err != nil {
+		return err
+	}
+
+	c.nodes.mu.Lock()
+	prev := c.nodes.db
+	c.nodes.db = n
+	conns := make([]*textproto.Conn, 0, len(c.nodes.conns))
+	for _, conn := range c.nodes.conns {
+		conns = append(conns, conn)
+	}
+	c.nodes.mu.Unlock()
+
+	for i, conn := range conns {
+		err := selectDB(conn, n)
+		if err == nil {
+			continue
+		}
+
+		c.nodes.mu.Lock()
+		c.nodes.db = prev
+		c.nodes.mu.Unlock()
+
+		if _, ok := err.(*ServerError); !ok {
+			c.drop(conn)
+		}
+		for _, conn := range conns[:i] {
+			if selectDB(conn, prev) != nil {
+				c.drop(conn)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// selectDB selects logical database n on connection, failure reported by
+// server is returned as *ServerError
+func selectDB(conn *textproto.Conn, n int) error {
+	code, line, err := call(conn, "select "+strconv.Itoa(n))
+	if err != nil {
+		return err
+	}
+	if code != okCode {
+		return &ServerError{code, line}
+	}
+	return nil
 }
 
 // Cmd sends given command to server and waits for reply. Received reply is parsed
 // and returned as result code/text.
 func (c Client) Cmd(str string) (code int, line string, err error) {
+	return c.CmdContext(context.Background(), str)
+}
 
-	// convert to single line
-	str = encode(str)
+// CmdContext is like Cmd but gives up when ctx is done and returns ctx error.
+// Connection the command is sent to is closed in that case, otherwise late
+// reply would be read as reply to the next command, next command reconnects.
+func (c Client) CmdContext(ctx context.Context, str string) (code int, line string, err error) {
+	code, line, typed, err := c.exec(ctx, str)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// typed reply is converted to text one
+	if typed && code == okCode {
+		r, err := db.ParseReply([]byte(line))
+		if err != nil {
+			return 0, "", err
+		}
+		return code, string(r.Text()), nil
+	}
+
+	// convert message from single line to multiline
+	return code, db.DecodeLine(line), nil
+}
+
+// exec sends command to server following redirects and returns reply line as
+// received, typed reports whether line is in typed protocol
+func (c Client) exec(ctx context.Context, str string) (code int, line string, typed bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	conn, err := c.route(str)
+	if err != nil {
+		return
+	}
+
+	// send command to remote, follow redirects
+	str = db.EncodeLine(str)
+	for redirects := 0; ; redirects++ {
+		code, line, err = c.callContext(ctx, conn, str)
+		if err != nil || code != redirectCode || redirects == maxRedirects {
+			break
+		}
+		if conn, err = c.redirect(line); err != nil {
+			return
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	c.nodes.mu.Lock()
+	typed = c.nodes.typed[conn]
+	c.nodes.mu.Unlock()
+
+	return
+}
+
+// callContext is like call but closes and forgets conn if ctx is done
+// before reply is read, other connections are kept
+func (c Client) callContext(ctx context.Context, conn *textproto.Conn, str string) (code int, line string, err error) {
+	stop := context.AfterFunc(ctx, func() { c.drop(conn) })
+	code, line, err = call(conn, str)
+	if !stop() && ctx.Err() != nil {
+		return 0, "", ctx.Err()
+	}
+	return
+}
+
+// drop closes connection and removes it from connections of client
+func (c Client) drop(conn *textproto.Conn) {
+	c.nodes.mu.Lock()
+	defer c.nodes.mu.Unlock()
+
+	for addr, cn := range c.nodes.conns {
+		if cn == conn {
+			delete(c.nodes.conns, addr)
+		}
+	}
+	delete(c.nodes.typed, conn)
+	conn.Close()
+}
+
+// call sends single line command to connection and reads reply
+func call(conn *textproto.Conn, str string) (code int, line string, err error) {
 
 	// send command to remote
-	if _, err = c.conn.Cmd("%s", str); err != nil {
+	if _, err = conn.Cmd("%s", str); err != nil {
 		return
 	}
 
 	// read reply
-	code, line, err = c.conn.ReadCodeLine(0)
+	code, line, err = conn.ReadCodeLine(0)
 	if err == io.EOF {
 		err = errors.New("connection closed")
-		return
-	} else if err != nil {
-		return
 	}
 
-	// convert message from single line to multiline
-	line = decode(line)
-
 	return
 }
 
-var (
-	crlfEncoder = strings.NewReplacer("\n", "\\n", "\r", "\\r")
-	crlfDecoder = strings.NewReplacer("\\n", "\n", "\\r", "\r")
-)
+// route returns connection to node owning key of command according to cached
+// slot map
+func (c Client) route(str string) (*textproto.Conn, error) {
+	if c.nodes.slots == nil {
+		return c.dial(c.addr)
+	}
+
+	_, key := routeKey(str)
+	if key == "" {
+		return c.dial(c.addr)
+	}
+
+	addr := c.nodes.slots[cluster.Slot([]byte(key))]
+	if addr == "" {
+		return c.dial(c.addr)
+	}
+
+	conn, err := c.dial(addr)
+	if err != nil {
+		return c.dial(c.addr)
+	}
+	return conn, nil
+}
 
-// encode converts CR to \r, LF to \n
-func encode(s string) string {
-	return crlfEncoder.Replace(s)
+// redirect parses "moved slot addr" reply, updates slot map and returns
+// connection to the new slot owner
+func (c Client) redirect(line string) (*textproto.Conn, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "moved" {
+		return nil, errors.New("invalid redirect: " + line)
+	}
+
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= cluster.SlotCount {
+		return nil, errors.New("invalid redirect: " + line)
+	}
+	addr := fields[2]
+
+	conn, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// load whole slot map on first redirect
+	if c.nodes.slots == nil {
+		c.nodes.slots = new(cluster.SlotMap)
+		if code, line, err := call(conn, "cluster slots"); err == nil && code == okCode {
+			if slots, err := cluster.ParseSlotMap(line); err == nil {
+				c.nodes.slots = slots
+			}
+		}
+	}
+	c.nodes.slots[slot] = addr
+
+	return conn, nil
 }
 
-// decode converts \n to LF, \r to CR
-func decode(s string) string {
-	return crlfDecoder.Replace(s)
+// dial returns connection to cluster node, connection is created on first
+// use and after it is dropped
+func (c Client) dial(addr string) (*textproto.Conn, error) {
+	c.nodes.mu.Lock()
+	conn, ok := c.nodes.conns[addr]
+	closed := c.nodes.closed
+	c.nodes.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if ok {
+		return conn, nil
+	}
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	typed, err := hello(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if c.nodes.password != "" {
+		code, line, err := call(conn, db.EncodeLine("auth "+c.nodes.password))
+		if err == nil && code != okCode {
+			err = errors.New(line)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	c.nodes.mu.Lock()
+	n := c.nodes.db
+	c.nodes.mu.Unlock()
+	if n != 0 {
+		if err := selectDB(conn, n); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	c.nodes.mu.Lock()
+	defer c.nodes.mu.Unlock()
+	if c.nodes.closed {
+		conn.Close()
+		return nil, ErrClosed
+	}
+	if cn, ok := c.nodes.conns[addr]; ok {
+		conn.Close() // connected concurrently
+		return cn, nil
+	}
+	c.nodes.conns[addr] = conn
+	c.nodes.typed[conn] = typed
+
+	return conn, nil
 }
@@ -1,49 +1,103 @@
 package client
 
-import "testing"
+import (
+	"strconv"
+	"testing"
+	"time"
+)
 
-func TestEncoding(t *testing.T) {
-	var encodingTests = []struct {
+func TestRouteKey(t *testing.T) {
+	var routeTests = []struct {
 		input string
-		wants string
+		name  string
+		key   string
 	}{
-		{"", ""},
-		{"\\", "\\"},
-		{"\\'", "\\'"},
-		{"\n", "\\n"},
-		{"\\n", "\\n"},
-		{"\r", "\\r"},
-		{"\\r", "\\r"},
-	}
-
-	for i, test := range encodingTests {
-		if result := encode(test.input); result != test.wants {
-			t.Errorf("[%d] '%s' = encode('%s') != '%s'", i, result, test.input, test.wants)
-		} else if decoded := decode(result); decoded != decode(test.input) {
-			t.Errorf("[%d] '%s' = decode(encode('%s')) != '%s'", i, decoded, test.input, test.input)
+		{"", "", ""},
+		{"keys", "keys", ""},
+		{" get name ", "get", "name"},
+		{"set name, value", "set", "name"},
+		{"set name,key,value", "set", "name"},
+		{"set a\\,b, value", "set", "a,b"},
+		{"dbsize", "dbsize", ""},
+		{"eval (get $1), name", "eval", "name"},
+		{"client setname a,b", "client", "setname a"},
+	}
+
+	for i, test := range routeTests {
+		if name, key := routeKey(test.input); name != test.name || key != test.key {
+			t.Errorf("[%d] routeKey('%s') = ('%s', '%s'), expected ('%s', '%s')",
+				i, test.input, name, key, test.name, test.key)
 		}
 	}
 }
 
-func TestDecoding(t *testing.T) {
-	var decodingTests = []struct {
-		input string
-		wants string
-	}{
-		{"", ""},
-		{"\\", "\\"},
-		{"\\r", "\r"},
-		{"\\n", "\n"},
-		{"\\\\n", "\\\n"},
-		{"\\'", "\\'"},
-		{"\\\\\\r", "\\\\\r"},
-		{"nr", "nr"},
-		{"\\\\n\\\\r", "\\\n\\\r"},
-	}
-
-	for i, test := range decodingTests {
-		if result := decode(test.input); result != test.wants {
-			t.Errorf("[%d] test: '%s' = decode('%s') != %s", i, result, test.input, test.wants)
+func TestHashRing(t *testing.T) {
+	h := hashRing{
+		vnodes: DefaultVirtualNodes,
+		owners: make(map[uint32]string),
+	}
+
+	for _, addr := range []string{"node1:7777", "node2:7777", "node3:7777"} {
+		h.add(addr)
+	}
+
+	const keys = 10000
+
+	owners := make(map[string]string, keys)
+	counts := make(map[string]int)
+	for i := 0; i < keys; i++ {
+		name := "name" + strconv.Itoa(i)
+		owners[name] = h.get(name)
+		counts[owners[name]]++
+	}
+
+	for addr, n := range counts {
+		if n < keys/5 {
+			t.Errorf("node %s owns %d keys of %d", addr, n, keys)
 		}
 	}
+
+	// adding node moves keys only to the new node
+	h.add("node4:7777")
+	moved := 0
+	for name, owner := range owners {
+		if addr := h.get(name); addr != owner {
+			moved++
+			if addr != "node4:7777" {
+				t.Fatalf("key %s moved from %s to %s", name, owner, addr)
+			}
+		}
+	}
+	if moved < keys/8 || moved > keys*3/8 {
+		t.Errorf("%d keys of %d moved after node adding", moved, keys)
+	}
+
+	// removing node returns keys to their previous owners
+	h.remove("node4:7777")
+	for name, owner := range owners {
+		if addr := h.get(name); addr != owner {
+			t.Fatalf("key %s owner is %s after node removing, expected %s", name, addr, owner)
+		}
+	}
+}
+
+func TestParseInfo(t *testing.T) {
+	info := parseInfo("# server\nversion:0.2.0\nuptime_in_seconds:5\n\n# clients\nconnected_clients:2\n\n" +
+		"# stats\ntotal_commands_processed:10\n\n# keyspace\nstr_keys:1\ndict_keys:2\nlist_keys:3\n" +
+		"expiring_keys:4\n\n# memory\nused_memory:1024\nmaxmemory_policy:noeviction")
+
+	if info.Version != "0.2.0" || info.Uptime != 5*time.Second || info.ConnectedClients != 2 ||
+		info.TotalCommands != 10 {
+		t.Errorf("invalid server info %+v", info)
+	}
+	if info.StrKeys != 1 || info.DictKeys != 2 || info.ListKeys != 3 || info.ExpiringKeys != 4 ||
+		info.UsedMemory != 1024 {
+		t.Errorf("invalid keyspace info %+v", info)
+	}
+	if v := info.Sections["memory"]["maxmemory_policy"]; v != "noeviction" {
+		t.Errorf("invalid memory section field '%s'", v)
+	}
+	if len(info.Sections) != 5 {
+		t.Errorf("parsed %d sections, expected 5", len(info.Sections))
+	}
 }
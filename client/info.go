@@ -0,0 +1,86 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An Info represents reply of info command
+type Info struct {
+	Version          string
+	Uptime           time.Duration
+	ConnectedClients int
+	TotalCommands    uint64
+	StrKeys          int
+	DictKeys         int
+	ListKeys         int
+	ExpiringKeys     int
+	UsedMemory       int
+
+	// Sections contains all reported fields by section name
+	Sections map[string]map[string]string
+}
+
+// Info sends info command and parses its reply, empty section means all sections
+func (c Client) Info(section string) (*Info, error) {
+	code, line, err := c.Cmd(strings.TrimSpace("info " + section))
+	if err != nil {
+		return nil, err
+	}
+	if code != okCode {
+		return nil, errors.New(line)
+	}
+	return parseInfo(line), nil
+}
+
+// parseInfo parses "# section" headers and "field:value" lines of info reply
+func parseInfo(text string) *Info {
+	info := &Info{Sections: make(map[string]map[string]string)}
+
+	var section map[string]string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "#"):
+			name := strings.TrimSpace(line[1:])
+			section = make(map[string]string)
+			info.Sections[name] = section
+			continue
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i < 0 || section == nil {
+			continue
+		}
+		name, value := line[:i], line[i+1:]
+		section[name] = value
+
+		switch name {
+		case "version":
+			info.Version = value
+		case "uptime_in_seconds":
+			n, _ := strconv.ParseInt(value, 10, 64)
+			info.Uptime = time.Duration(n) * time.Second
+		case "connected_clients":
+			info.ConnectedClients, _ = strconv.Atoi(value)
+		case "total_commands_processed":
+			info.TotalCommands, _ = strconv.ParseUint(value, 10, 64)
+		case "str_keys":
+			info.StrKeys, _ = strconv.Atoi(value)
+		case "dict_keys":
+			info.DictKeys, _ = strconv.Atoi(value)
+		case "list_keys":
+			info.ListKeys, _ = strconv.Atoi(value)
+		case "expiring_keys":
+			info.ExpiringKeys, _ = strconv.Atoi(value)
+		case "used_memory":
+			info.UsedMemory, _ = strconv.Atoi(value)
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,114 @@
+package client
+
+import (
+	"strconv"
+
+	"github.com/maximp/stash/db"
+)
+
+// MGet returns values of string keys names, missing keys and keys of other
+// types are returned as nil
+func (c Client) MGet(names ...string) ([][]byte, error) {
+	return c.items("mget " + db.JoinArgs(names...))
+}
+
+// MSet sets values of string keys given as name, value pairs. Either all keys
+// are set or none of them.
+func (c Client) MSet(pairs ...string) error {
+	if len(pairs)%2 != 0 {
+		return db.ErrInvalidFormat
+	}
+	return c.ok("mset " + db.JoinArgs(pairs...))
+}
+
+// MRemove removes keys names and returns number of removed keys
+func (c Client) MRemove(names ...string) (int, error) {
+	r, err := c.Reply("mremove " + db.JoinArgs(names...))
+	if err != nil {
+		return 0, err
+	}
+	return int(r.Int), nil
+}
+
+// MHGet returns values of fields of dict key name, missing fields are
+// returned as nil
+func (c Client) MHGet(name string, fields ...string) ([][]byte, error) {
+	return c.items("mhget " + db.JoinArgs(append([]string{name}, fields...)...))
+}
+
+// MHSet sets fields of dict key name given as field, value pairs, dict is
+// created if key does not exist
+func (c Client) MHSet(name string, pairs ...string) error {
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return db.ErrInvalidFormat
+	}
+	return c.ok("mhset " + db.JoinArgs(append([]string{name}, pairs...)...))
+}
+
+// Rename renames key src to dst with its TTL, existing key dst is replaced
+func (c Client) Rename(src string, dst string) error {
+	return c.ok("rename " + db.JoinArgs(src, dst))
+}
+
+// RenameNX renames key src to dst with its TTL, it fails if key dst exists
+func (c Client) RenameNX(src string, dst string) error {
+	return c.ok("renamenx " + db.JoinArgs(src, dst))
+}
+
+// Copy copies value and TTL of key src to dst, existing key dst is replaced
+func (c Client) Copy(src string, dst string) error {
+	return c.ok("copy " + db.JoinArgs(src, dst))
+}
+
+// Move moves key name with its TTL from selected database to logical
+// database n, it fails if key exists there
+func (c Client) Move(name string, n int) error {
+	return c.ok("move " + db.JoinArgs(name, strconv.Itoa(n)))
+}
+
+// ok sends command and converts reply other than success to error
+func (c Client) ok(str string) error {
+	_, err := c.Reply(str)
+	return err
+}
+
+// items sends command replying with array of strings and nils, nil items
+// are returned as nil
+func (c Client) items(str string) ([][]byte, error) {
+	r, err := c.Reply(str)
+	if err != nil {
+		return nil, err
+	}
+	if r.Type != db.ReplyArray {
+		return nil, db.ErrInvalidFormat
+	}
+
+	values := make([][]byte, len(r.Array))
+	for i, item := range r.Array {
+		if item.Type != db.ReplyNil {
+			values[i] = item.Str
+		}
+	}
+	return values, nil
+}
+
+// HGetAll returns all fields of dict key name
+func (c Client) HGetAll(name string) (map[string][]byte, error) {
+	values, err := c.items("hgetall " + db.EscapeArg(name))
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string][]byte, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		m[string(values[i])] = values[i+1]
+	}
+	return m, nil
+}
+
+// LRange returns elements of list key name from start to stop index
+// inclusive, negative index counts from the end of list, so LRange(name, 0, -1)
+// returns whole list
+func (c Client) LRange(name string, start int, stop int) ([][]byte, error) {
+	return c.items("lrange " + db.JoinArgs(name, strconv.Itoa(start), strconv.Itoa(stop)))
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"context"
+	"strings"
+
+	"github.com/maximp/stash/db"
+)
+
+// A ServerError is returned by Reply for command failed on server
+type ServerError struct {
+	Code    int // reply code
+	Message string
+}
+
+// Error implements error interface, returns error message
+func (e *ServerError) Error() string {
+	return e.Message
+}
+
+// Reply sends given command to server and returns its typed reply. Failed
+// command is returned as *ServerError. Server not supporting typed protocol replies
+// with strings only.
+func (c Client) Reply(str string) (db.Reply, error) {
+	return c.ReplyContext(context.Background(), str)
+}
+
+// ReplyContext is like Reply but gives up when ctx is done, see CmdContext
+func (c Client) ReplyContext(ctx context.Context, str string) (db.Reply, error) {
+	code, line, typed, err := c.exec(ctx, str)
+	if err != nil {
+		return db.Reply{}, err
+	}
+	if code != okCode {
+		return db.Reply{}, &ServerError{code, db.DecodeLine(line)}
+	}
+
+	if !typed {
+		return db.StringReply([]byte(db.DecodeLine(line))), nil
+	}
+
+	return db.ParseReply([]byte(line))
+}
+
+// Do sends given command to server and returns its reply as Go value, see
+// db.Reply.Value
+func (c Client) Do(str string) (interface{}, error) {
+	r, err := c.Reply(str)
+	if err != nil {
+		return nil, err
+	}
+	return r.Value(), nil
+}
+
+// Keys returns names of all keys, or keys of dict name if name is not empty
+func (c Client) Keys(name string) ([]string, error) {
+	r, err := c.Reply("keys " + db.EscapeArg(name))
+	if err != nil {
+		return nil, err
+	}
+
+	// server not supporting typed protocol replies with comma separated names
+	if r.Type == db.ReplyString {
+		if len(r.Str) == 0 {
+			return []string{}, nil
+		}
+		return strings.Split(string(r.Str), ","), nil
+	}
+	if r.Type != db.ReplyArray {
+		return nil, db.ErrInvalidFormat
+	}
+
+	names := make([]string, len(r.Array))
+	for i, item := range r.Array {
+		names[i] = string(item.Str)
+	}
+	return names, nil
+}
+
+// DBSize returns number of keys in selected database
+func (c Client) DBSize() (int, error) {
+	r, err := c.Reply("dbsize")
+	if err != nil {
+		return 0, err
+	}
+	if r.Type != db.ReplyInteger {
+		return 0, db.ErrInvalidFormat
+	}
+	return int(r.Int), nil
+}
+
+// Flush removes all keys of selected database, async flush releases removed
+// keys in background
+func (c Client) Flush(async bool) error {
+	str := "flush"
+	if async {
+		str += " async"
+	}
+	_, err := c.Reply(str)
+	return err
+}
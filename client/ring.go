@@ -0,0 +1,410 @@
+package client
+
+import (
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/maximp/stash/db"
+)
+
+// DefaultVirtualNodes is number of points every node takes on the hash ring
+const DefaultVirtualNodes = 160
+
+// Errors returned by Ring
+var (
+	ErrNoNodes      = errors.New("no nodes in ring")
+	ErrNodeExists   = errors.New("node already in ring")
+	ErrNodeNotFound = errors.New("node not found in ring")
+	ErrCrossNode    = errors.New("keys of command belong to different nodes")
+)
+
+// A ringNode represents connection to single node of Ring
+type ringNode struct {
+	addr string
+	mu   sync.Mutex
+	c    *Client
+}
+
+// cmd sends command to node, commands to single node are serialized
+func (n *ringNode) cmd(str string) (int, string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.c.Cmd(str)
+}
+
+// reply is like cmd but returns typed reply
+func (n *ringNode) reply(str string) (db.Reply, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.c.Reply(str)
+}
+
+// close closes node connection after command in progress is completed
+func (n *ringNode) close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.c.Close()
+}
+
+// A hashRing maps key names to node addresses by consistent hashing
+type hashRing struct {
+	vnodes int
+	points []uint32          // sorted hashes of virtual nodes
+	owners map[uint32]string // virtual node hash to node address
+}
+
+func (h *hashRing) add(addr string) {
+	for i := 0; i < h.vnodes; i++ {
+		p := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i)))
+		if _, ok := h.owners[p]; ok {
+			continue
+		}
+		h.owners[p] = addr
+		h.points = append(h.points, p)
+	}
+	sort.Slice(h.points, func(i, j int) bool { return h.points[i] < h.points[j] })
+}
+
+func (h *hashRing) remove(addr string) {
+	points := h.points[:0]
+	for _, p := range h.points {
+		if h.owners[p] == addr {
+			delete(h.owners, p)
+		} else {
+			points = append(points, p)
+		}
+	}
+	h.points = points
+}
+
+// get returns address of node owning the key name
+func (h *hashRing) get(name string) string {
+	if len(h.points) == 0 {
+		return ""
+	}
+
+	p := crc32.ChecksumIEEE([]byte(name))
+	i := sort.Search(len(h.points), func(i int) bool { return h.points[i] >= p })
+	if i == len(h.points) {
+		i = 0
+	}
+	return h.owners[h.points[i]]
+}
+
+// A Ring represents client connections to several stash nodes. Every command
+// is routed to the node chosen by consistent hashing of key name, so adding or
+// removing node remaps only keys of its neighbour points on the ring.
+// Ring is safe for concurrent use.
+type Ring struct {
+	mu    sync.RWMutex
+	ring  hashRing
+	nodes map[string]*ringNode
+}
+
+// NewRing connects to nodes at given addresses and returns a new Ring.
+// vnodes is number of virtual nodes per node, 0 means DefaultVirtualNodes.
+func NewRing(addrs []string, vnodes int) (*Ring, error) {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	r := &Ring{
+		ring: hashRing{
+			vnodes: vnodes,
+			owners: make(map[uint32]string),
+		},
+		nodes: make(map[string]*ringNode),
+	}
+
+	for _, addr := range addrs {
+		if err := r.Add(addr); err != nil {
+			r.Close()
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+// Add connects to node at addr and puts it on the ring
+func (r *Ring) Add(addr string) error {
+	r.mu.RLock()
+	_, ok := r.nodes[addr]
+	r.mu.RUnlock()
+	if ok {
+		return ErrNodeExists
+	}
+
+	c, err := Dial(addr)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.nodes[addr]; ok {
+		c.Close()
+		return ErrNodeExists
+	}
+
+	r.nodes[addr] = &ringNode{addr: addr, c: c}
+	r.ring.add(addr)
+
+	return nil
+}
+
+// Remove takes node at addr off the ring and closes its connection once
+// command in progress is completed
+func (r *Ring) Remove(addr string) error {
+	r.mu.Lock()
+	n, ok := r.nodes[addr]
+	if ok {
+		delete(r.nodes, addr)
+		r.ring.remove(addr)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return ErrNodeNotFound
+	}
+
+	return n.close()
+}
+
+// Nodes returns addresses of ring nodes
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	addrs := make([]string, 0, len(r.nodes))
+	for addr := range r.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Node returns address of node owning the key name
+func (r *Ring) Node(name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ring.get(name)
+}
+
+// Close implements io.Closer interface, closes connections to all nodes
+func (r *Ring) Close() error {
+	r.mu.Lock()
+	nodes := r.nodes
+	r.nodes = make(map[string]*ringNode)
+	r.ring.points = nil
+	r.ring.owners = make(map[uint32]string)
+	r.mu.Unlock()
+
+	var err error
+	for _, n := range nodes {
+		if e := n.close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Cmd sends command to the node owning its key and waits for reply. Command
+// 'keys' without arguments is sent to all nodes and replies are merged, keys
+// of 'mget' and 'mremove' are split by nodes. Other commands on several keys
+// fail with ErrCrossNode if keys belong to different nodes.
+func (r *Ring) Cmd(str string) (code int, line string, err error) {
+	name, key := routeKey(str)
+
+	switch {
+	case name == "keys" && key == "":
+		return r.fanOut(str)
+	case name == "mget" || name == "mremove":
+		return r.split(str)
+	}
+
+	r.mu.RLock()
+	addr := r.ring.get(key)
+	n, ok := r.nodes[addr]
+	for _, k := range routeKeys(str) {
+		if r.ring.get(k) != addr {
+			err = ErrCrossNode
+		}
+	}
+	r.mu.RUnlock()
+	if !ok {
+		return 0, "", ErrNoNodes
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	return n.cmd(str)
+}
+
+// split sends mget or mremove to nodes owning its keys and merges replies,
+// values are ordered as keys, numbers of removed keys are summed
+func (r *Ring) split(str string) (code int, line string, err error) {
+	name, arg := splitCommand(str)
+	names := db.SplitArg(arg)
+
+	r.mu.RLock()
+	keys := make(map[*ringNode][]int) // indexes of keys by node
+	for i, k := range names {
+		n, ok := r.nodes[r.ring.get(string(k))]
+		if !ok {
+			r.mu.RUnlock()
+			return 0, "", ErrNoNodes
+		}
+		keys[n] = append(keys[n], i)
+	}
+	r.mu.RUnlock()
+
+	type reply struct {
+		keys []int
+		r    db.Reply
+		err  error
+	}
+
+	replies := make(chan reply, len(keys))
+	for n, idx := range keys {
+		args := make([]string, len(idx))
+		for j, i := range idx {
+			args[j] = string(names[i])
+		}
+		go func(n *ringNode, idx []int, str string) {
+			r, err := n.reply(str)
+			replies <- reply{idx, r, err}
+		}(n, idx, name+" "+db.JoinArgs(args...))
+	}
+
+	var (
+		values  = make([]db.Reply, len(names))
+		removed int64
+	)
+	for range keys {
+		rep := <-replies
+		switch {
+		case err != nil:
+		case rep.err != nil:
+			err = rep.err
+		case name == "mremove":
+			removed += rep.r.Int
+		case rep.r.Type != db.ReplyArray || len(rep.r.Array) != len(rep.keys):
+			err = db.ErrInvalidFormat
+		default:
+			for j, i := range rep.keys {
+				values[i] = rep.r.Array[j]
+			}
+		}
+	}
+
+	if e, ok := err.(*ServerError); ok {
+		return e.Code, e.Message, nil
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	if name == "mremove" {
+		return okCode, strconv.FormatInt(removed, 10), nil
+	}
+	return okCode, string(db.ArrayReply(values...).Text()), nil
+}
+
+// fanOut sends command to all nodes and joins replies with comma
+func (r *Ring) fanOut(str string) (code int, line string, err error) {
+	r.mu.RLock()
+	nodes := make([]*ringNode, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		nodes = append(nodes, n)
+	}
+	r.mu.RUnlock()
+
+	if len(nodes) == 0 {
+		return 0, "", ErrNoNodes
+	}
+
+	type reply struct {
+		code int
+		line string
+		err  error
+	}
+
+	replies := make(chan reply, len(nodes))
+	for _, n := range nodes {
+		go func(n *ringNode) {
+			code, line, err := n.cmd(str)
+			replies <- reply{code, line, err}
+		}(n)
+	}
+
+	var lines []string
+	for range nodes {
+		rep := <-replies
+		switch {
+		case rep.err != nil:
+			err = rep.err
+		case rep.code != okCode:
+			code, line = rep.code, rep.line
+		case rep.line != "":
+			lines = append(lines, rep.line)
+		}
+	}
+
+	if err != nil {
+		return 0, "", err
+	}
+
+	if code != 0 {
+		return code, line, nil
+	}
+
+	return okCode, strings.Join(lines, ","), nil
+}
+
+// routeKey returns command name and name of the key command is applied to,
+// the same key cluster node hashes to slot
+func routeKey(str string) (name string, key string) {
+	name, arg := splitCommand(str)
+	if arg == nil {
+		return name, ""
+	}
+
+	if cmd, err := db.ParseCommand([]byte(name)); err == nil {
+		return name, string(db.Key(cmd, arg))
+	}
+	return name, string(db.FirstArg(arg))
+}
+
+// routeKeys returns names of all keys of command
+func routeKeys(str string) []string {
+	name, arg := splitCommand(str)
+	cmd, err := db.ParseCommand([]byte(name))
+	if arg == nil || err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, k := range db.Keys(cmd, arg) {
+		names = append(names, string(k))
+	}
+	return names
+}
+
+// splitCommand splits command line to name and argument, argument is nil
+// for command without it
+func splitCommand(str string) (name string, arg []byte) {
+	str = strings.TrimSpace(str)
+
+	i := strings.IndexByte(str, ' ')
+	if i < 0 {
+		return str, nil
+	}
+	return str[:i], []byte(str[i+1:])
+}
@@ -0,0 +1,32 @@
+package client
+
+import "github.com/maximp/stash/db"
+
+// Eval executes script atomically on server and returns its reply, args are
+// available to script as $1, $2...
+func (c Client) Eval(script string, args ...string) (db.Reply, error) {
+	return c.Reply(scriptCmd("eval "+script, args))
+}
+
+// EvalSHA executes script cached by ScriptLoad, see Eval
+func (c Client) EvalSHA(sha string, args ...string) (db.Reply, error) {
+	return c.Reply(scriptCmd("evalsha "+sha, args))
+}
+
+// ScriptLoad caches script on server and returns its SHA1 to pass to EvalSHA
+func (c Client) ScriptLoad(script string) (string, error) {
+	r, err := c.Reply("script load " + script)
+	if err != nil {
+		return "", err
+	}
+	return string(r.Str), nil
+}
+
+// scriptCmd appends comma separated script arguments to command, commas and
+// backslashes inside arguments are escaped
+func scriptCmd(str string, args []string) string {
+	if len(args) == 0 {
+		return str
+	}
+	return str + ", " + db.JoinArgs(args...)
+}
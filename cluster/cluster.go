@@ -0,0 +1,275 @@
+// Package cluster implements server-side cluster mode of stash database.
+//
+// Key names are hashed into SlotCount slots, every slot is owned by single
+// node. Node replies to commands for keys of slots it does not own with
+// server.Redirect error pointing to the owner. Slot map is configured
+// identically on every node and changed with cluster commands:
+//
+//	cluster slots               - slot map "0-8191 host1:port,8192-16383 host2:port"
+//	cluster keyslot name        - hash slot of key name
+//	cluster setslot slot, addr  - assign slot to node at addr
+//	cluster migrate slot, addr  - move keys of slot with their TTLs to node at addr
+//	                              and assign slot to it
+package cluster
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/server"
+)
+
+// Errors returned by cluster
+var (
+	ErrSlotNotServed = errors.New("slot is not served")
+	ErrTryAgain      = errors.New("slot is migrating, try again")
+	ErrNotOwner      = errors.New("slot is not owned by node")
+	ErrInvalidSlot   = errors.New("invalid slot")
+	ErrCrossSlot     = errors.New("keys of command belong to different slots")
+)
+
+// A Config contains cluster parameters
+type Config struct {
+	Log   *slog.Logger
+	Self  string // address of node as it is known to other nodes and clients
+	Slots string // slot map in ParseSlotMap format
+}
+
+// A Cluster checks slot ownership of commands executed by node
+type Cluster struct {
+	d    *db.Database
+	log  *slog.Logger
+	self string
+
+	// commands hold read lock while executed, so slot state changes wait
+	// for commands in progress
+	mu        sync.RWMutex
+	slots     *SlotMap
+	migrating map[int]bool
+}
+
+// New creates cluster node serving database d
+func New(d *db.Database, cfg Config) (*Cluster, error) {
+	slots, err := ParseSlotMap(cfg.Slots)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cluster{
+		d:         d,
+		log:       cfg.Log,
+		self:      cfg.Self,
+		slots:     slots,
+		migrating: make(map[int]bool),
+	}
+
+	if c.log == nil {
+		c.log = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	}
+
+	return c, nil
+}
+
+// Slots returns copy of current slot map
+func (c *Cluster) Slots() SlotMap {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return *c.slots
+}
+
+// SetSlot assigns slot to node at addr
+func (c *Cluster) SetSlot(slot int, addr string) error {
+	if slot < 0 || slot >= SlotCount {
+		return ErrInvalidSlot
+	}
+
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+
+	c.log.Info("slot assigned", "slot", slot, "node", addr)
+
+	return nil
+}
+
+// Handler wraps database handler: it serves cluster commands and redirects
+// commands for keys of slots owned by other nodes
+func (c *Cluster) Handler(next server.Handler) server.Handler {
+	return func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		if string(cmd) == "cluster" {
+			return c.command(arg)
+		}
+
+		dc, err := db.ParseCommand(cmd)
+		if err != nil {
+			return next(ctx, cmd, arg)
+		}
+
+		names := db.Keys(dc, arg)
+		if len(names) == 0 {
+			return next(ctx, cmd, arg)
+		}
+
+		slot := Slot(names[0])
+		for _, name := range names[1:] {
+			if Slot(name) != slot {
+				return db.Reply{}, ErrCrossSlot
+			}
+		}
+
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+
+		switch owner := c.slots[slot]; {
+		case owner == "":
+			return db.Reply{}, ErrSlotNotServed
+		case owner != c.self:
+			return db.Reply{}, &server.Redirect{Slot: slot, Addr: owner}
+		case c.migrating[slot]:
+			return db.Reply{}, ErrTryAgain
+		}
+
+		return next(ctx, cmd, arg)
+	}
+}
+
+// command executes cluster subcommand
+func (c *Cluster) command(arg []byte) (db.Reply, error) {
+	sub := strings.TrimSpace(string(arg))
+	rest := ""
+	if i := strings.IndexByte(sub, ' '); i >= 0 {
+		sub, rest = sub[:i], strings.TrimSpace(sub[i+1:])
+	}
+
+	switch sub {
+	case "slots":
+		slots := c.Slots()
+		return db.StringReply([]byte(slots.String())), nil
+
+	case "keyslot":
+		if rest == "" {
+			return db.Reply{}, db.ErrInvalidFormat
+		}
+		return db.IntegerReply(int64(Slot([]byte(rest)))), nil
+
+	case "setslot", "migrate":
+		fields := strings.Split(rest, ",")
+		if len(fields) != 2 {
+			return db.Reply{}, db.ErrInvalidFormat
+		}
+
+		slot, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			return db.Reply{}, ErrInvalidSlot
+		}
+
+		addr := strings.TrimSpace(fields[1])
+		if sub == "setslot" {
+			err = c.SetSlot(slot, addr)
+		} else {
+			err = c.Migrate(slot, addr)
+		}
+		if err != nil {
+			return db.Reply{}, err
+		}
+		return db.StringReply([]byte("Ok")), nil
+
+	default:
+		return db.Reply{}, db.ErrInvalidCommand
+	}
+}
+
+// Migrate moves keys of slot with their TTLs to node at addr and assigns slot
+// to that node. Commands for keys of the slot fail with ErrTryAgain during
+// migration. If keys transfer fails, they are restored locally.
+func (c *Cluster) Migrate(slot int, addr string) error {
+	if slot < 0 || slot >= SlotCount {
+		return ErrInvalidSlot
+	}
+
+	c.mu.Lock()
+	if c.slots[slot] != c.self {
+		c.mu.Unlock()
+		return ErrNotOwner
+	}
+	if c.migrating[slot] {
+		c.mu.Unlock()
+		return ErrTryAgain
+	}
+	c.migrating[slot] = true
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.migrating, slot)
+		c.mu.Unlock()
+	}()
+
+	conn, err := textproto.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// target node accepts keys of slot from now
+	if err := call(conn, "cluster setslot "+strconv.Itoa(slot)+", "+addr); err != nil {
+		return err
+	}
+
+	var lines []string
+	err = c.d.Extract(func(name []byte) bool {
+		return Slot(name) == slot
+	}, func(cmd db.Command, arg []byte) {
+		lines = append(lines, cmd.String()+" "+db.EncodeLine(string(arg)))
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, line := range lines {
+		if err := call(conn, line); err != nil {
+			c.log.Error("slot migration failed", "slot", slot, "node", addr, "err", err)
+			c.restore(lines)
+			call(conn, "cluster setslot "+strconv.Itoa(slot)+", "+c.self)
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+
+	c.log.Info("slot migrated", "slot", slot, "node", addr, "commands", len(lines))
+
+	return nil
+}
+
+// restore applies lines of failed migration to local database
+func (c *Cluster) restore(lines []string) {
+	for _, line := range lines {
+		i := strings.IndexByte(line, ' ')
+		cmd, err := db.ParseCommand([]byte(line[:i]))
+		if err == nil {
+			_, err = c.d.Exec(cmd, []byte(db.DecodeLine(line[i+1:])))
+		}
+		if err != nil {
+			c.log.Error("restore failed", "cmd", line, "err", err)
+		}
+	}
+}
+
+// call sends command to node and checks reply code
+func call(conn *textproto.Conn, line string) error {
+	if _, err := conn.Cmd("%s", line); err != nil {
+		return err
+	}
+	_, _, err := conn.ReadCodeLine(server.ServerOperationOk)
+	return err
+}
@@ -0,0 +1,124 @@
+package cluster
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/server"
+)
+
+func TestCrc16(t *testing.T) {
+	if crc := crc16([]byte("123456789")); crc != 0x31C3 {
+		t.Errorf("crc16('123456789') = %x, expected 31c3", crc)
+	}
+}
+
+func TestSlot(t *testing.T) {
+	var tests = []struct {
+		a, b string
+		same bool
+	}{
+		{"{user1}.name", "{user1}.age", true},
+		{"x{user1}", "user1", true},
+		{"{}name", "{}name", true},
+		{"{}name", "name", false},
+		{"user1", "user2", false},
+	}
+
+	for i, test := range tests {
+		if same := Slot([]byte(test.a)) == Slot([]byte(test.b)); same != test.same {
+			t.Errorf("[%d] Slot('%s') == Slot('%s') is %v", i, test.a, test.b, same)
+		}
+	}
+}
+
+func TestSlotMap(t *testing.T) {
+	var tests = []struct {
+		input string
+		wants string
+		err   error
+	}{
+		{"", "", nil},
+		{"0-16383 a:1", "0-16383 a:1", nil},
+		{"0-100 a:1, 101 b:2 ,102-16383 a:1", "0-100 a:1,101 b:2,102-16383 a:1", nil},
+		{"10-5 a:1", "", ErrInvalidSlots},
+		{"0-16384 a:1", "", ErrInvalidSlots},
+		{"x a:1", "", ErrInvalidSlots},
+		{"0-10", "", ErrInvalidSlots},
+	}
+
+	for i, test := range tests {
+		m, err := ParseSlotMap(test.input)
+		if err != test.err {
+			t.Errorf("[%d] ParseSlotMap('%s') failed with %v", i, test.input, err)
+		} else if err == nil && m.String() != test.wants {
+			t.Errorf("[%d] ParseSlotMap('%s') = '%s', expected '%s'", i, test.input, m, test.wants)
+		}
+	}
+
+	m, _ := ParseSlotMap("0-100 a:1,101-16383 b:2")
+	if nodes := m.Nodes(); len(nodes) != 2 || nodes[0] != "a:1" || nodes[1] != "b:2" {
+		t.Errorf("nodes = %v", nodes)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	d, err := db.New(db.Config{QueueLength: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	time.Sleep(time.Millisecond)
+
+	slot := Slot([]byte("name"))
+	c, err := New(d, Config{
+		Self:  "a:1",
+		Slots: "0-16383 a:1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := c.Handler(func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		dc, err := db.ParseCommand(cmd)
+		if err != nil {
+			return db.Reply{}, err
+		}
+		return d.ExecReply(ctx, dc, arg)
+	})
+
+	if _, err := handler(context.Background(), []byte("set"), []byte("name,value")); err != nil {
+		t.Errorf("set failed with %v", err)
+	}
+
+	if _, err := handler(context.Background(), []byte("mset"), []byte("{user}a,1,{user}b,2")); err != nil {
+		t.Errorf("mset of single slot failed with %v", err)
+	}
+
+	if _, err := handler(context.Background(), []byte("mget"), []byte("name,other")); err != ErrCrossSlot {
+		t.Errorf("mget of different slots returned %v", err)
+	}
+
+	c.SetSlot(slot, "b:2")
+
+	_, err = handler(context.Background(), []byte("get"), []byte("name"))
+	if r, ok := err.(*server.Redirect); !ok || r.Slot != slot || r.Addr != "b:2" {
+		t.Errorf("get of foreign key returned %v", err)
+	}
+
+	if _, err := handler(context.Background(), []byte("keys"), nil); err != nil {
+		t.Errorf("keys failed with %v", err)
+	}
+
+	c.SetSlot(slot, "")
+	if _, err := handler(context.Background(), []byte("get"), []byte("name")); err != ErrSlotNotServed {
+		t.Errorf("get of unassigned slot returned %v", err)
+	}
+
+	if r, err := handler(context.Background(), []byte("cluster"), []byte("keyslot name")); err != nil || string(r.Text()) != "5798" {
+		t.Errorf("cluster keyslot returned '%s' (%v)", r.Text(), err)
+	}
+}
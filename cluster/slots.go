@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SlotCount is number of hash slots keys are distributed across
+const SlotCount = 16384
+
+// ErrInvalidSlots is returned for malformed slot map description
+var ErrInvalidSlots = errors.New("invalid slot map")
+
+// Slot returns hash slot of the key name. If name contains non-empty "{tag}",
+// only tag is hashed, so keys with the same tag are stored on the same node.
+func Slot(name []byte) int {
+	if i := bytes.IndexByte(name, '{'); i >= 0 {
+		if j := bytes.IndexByte(name[i+1:], '}'); j > 0 {
+			name = name[i+1 : i+1+j]
+		}
+	}
+	return int(crc16(name)) % SlotCount
+}
+
+// crc16 implements CRC16-CCITT (XMODEM) checksum
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// A SlotMap maps hash slots to addresses of owning nodes, empty address means
+// slot is not assigned
+type SlotMap [SlotCount]string
+
+// ParseSlotMap parses slot map in "0-8191 host1:port, 8192-16383 host2:port"
+// format, single slot may be specified without range
+func ParseSlotMap(s string) (*SlotMap, error) {
+	m := new(SlotMap)
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+
+	for _, r := range strings.Split(s, ",") {
+		fields := strings.Fields(r)
+		if len(fields) != 2 {
+			return nil, ErrInvalidSlots
+		}
+
+		bounds := strings.SplitN(fields[0], "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil {
+			return nil, ErrInvalidSlots
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, err = strconv.Atoi(bounds[1]); err != nil {
+				return nil, ErrInvalidSlots
+			}
+		}
+		if first < 0 || last >= SlotCount || first > last {
+			return nil, ErrInvalidSlots
+		}
+
+		for i := first; i <= last; i++ {
+			m[i] = fields[1]
+		}
+	}
+
+	return m, nil
+}
+
+// String implements fmt.Stringer interface, returns slot map in format
+// accepted by ParseSlotMap
+func (m *SlotMap) String() string {
+	var ranges []string
+	for first := 0; first < SlotCount; {
+		last := first
+		for last+1 < SlotCount && m[last+1] == m[first] {
+			last++
+		}
+		if m[first] != "" {
+			r := strconv.Itoa(first)
+			if last > first {
+				r += "-" + strconv.Itoa(last)
+			}
+			ranges = append(ranges, r+" "+m[first])
+		}
+		first = last + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// Nodes returns sorted addresses of nodes owning at least one slot
+func (m *SlotMap) Nodes() []string {
+	seen := make(map[string]bool)
+	var nodes []string
+	for _, addr := range m {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			nodes = append(nodes, addr)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
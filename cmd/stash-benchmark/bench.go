@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// okCode is reply code of successful command
+const okCode = 200
+
+// A config contains benchmark parameters
+type config struct {
+	Addr     string
+	Password string
+	Clients  int
+	Requests int
+	Pipeline int
+	Mix      string
+	Keyspace int
+	Size     int
+	Seed     int64
+}
+
+// A result holds latencies of completed requests of single test
+type result struct {
+	name      string
+	latencies []time.Duration
+	errors    int
+}
+
+// A report contains results of benchmark
+type report struct {
+	elapsed time.Duration
+	results []*result // in order of command mix
+}
+
+// run runs benchmark and returns its report
+func run(cfg config) (*report, error) {
+	if cfg.Clients <= 0 || cfg.Requests <= 0 || cfg.Pipeline <= 0 {
+		return nil, errors.New("clients, requests and pipeline must be positive")
+	}
+
+	w, err := newWorkload(cfg.Mix, cfg.Keyspace, cfg.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	conns := make([]net.Conn, cfg.Clients)
+	for i := range conns {
+		if conns[i], err = dial(cfg.Addr, cfg.Password); err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return nil, err
+		}
+	}
+
+	var (
+		remaining = int64(cfg.Requests)
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		errs      []error
+		results   = make([][]*result, cfg.Clients)
+	)
+
+	start := time.Now()
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+
+			r := rand.New(rand.NewSource(cfg.Seed + int64(i)))
+			res, err := bench(conn, w, r, cfg.Pipeline, &remaining)
+			results[i] = res
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+
+	rep := &report{elapsed: time.Since(start)}
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	for i, o := range w.ops {
+		res := &result{name: o.name}
+		for _, client := range results {
+			res.latencies = append(res.latencies, client[i].latencies...)
+			res.errors += client[i].errors
+		}
+		sort.Slice(res.latencies, func(a, b int) bool { return res.latencies[a] < res.latencies[b] })
+		rep.results = append(rep.results, res)
+	}
+
+	return rep, nil
+}
+
+// dial connects to server and authenticates connection
+func dial(addr string, password string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if password != "" {
+		if _, err := fmt.Fprintf(conn, "auth %s\r\n", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		code, line, err := textproto.NewReader(bufio.NewReader(conn)).ReadCodeLine(0)
+		if err == nil && code != okCode {
+			err = errors.New("authentication failed: " + line)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// bench sends batches of pipeline commands over connection until remaining
+// requests are taken by clients and returns results per op
+func bench(conn net.Conn, w *workload, r *rand.Rand, pipeline int, remaining *int64) ([]*result, error) {
+	results := make([]*result, len(w.ops))
+	for i, o := range w.ops {
+		results[i] = &result{name: o.name}
+	}
+
+	var (
+		bw    = bufio.NewWriter(conn)
+		br    = textproto.NewReader(bufio.NewReader(conn))
+		batch = make([]int, 0, pipeline)
+	)
+	for {
+		n := atomic.AddInt64(remaining, -int64(pipeline))
+		size := pipeline
+		if n < 0 {
+			size += int(n)
+		}
+		if size <= 0 {
+			return results, nil
+		}
+
+		batch = batch[:0]
+		for i := 0; i < size; i++ {
+			index, cmd := w.next(r)
+			batch = append(batch, index)
+			bw.WriteString(cmd)
+			bw.WriteString("\r\n")
+		}
+
+		sent := time.Now()
+		if err := bw.Flush(); err != nil {
+			return results, err
+		}
+
+		for _, index := range batch {
+			code, _, err := br.ReadCodeLine(0)
+			if err == io.EOF {
+				err = errors.New("connection closed")
+			}
+			if err != nil {
+				return results, err
+			}
+
+			res := results[index]
+			res.latencies = append(res.latencies, time.Since(sent))
+			if code != okCode {
+				res.errors++
+			}
+		}
+	}
+}
+
+// percentile returns latency below which p percent of sorted latencies fall
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(latencies))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i]
+}
+
+// print writes report to w
+func (rep *report) print(w io.Writer) {
+	var (
+		all    []time.Duration
+		failed int
+	)
+	for _, res := range rep.results {
+		all = append(all, res.latencies...)
+		failed += res.errors
+		printLine(w, res.name, res.latencies, res.errors, rep.elapsed)
+	}
+	sort.Slice(all, func(a, b int) bool { return all[a] < all[b] })
+
+	printLine(w, "total", all, failed, rep.elapsed)
+}
+
+// printLine writes throughput and latency percentiles of single test
+func printLine(w io.Writer, name string, latencies []time.Duration, failed int, elapsed time.Duration) {
+	rate := float64(len(latencies)) / elapsed.Seconds()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+	var max time.Duration
+	if len(latencies) > 0 {
+		max = latencies[len(latencies)-1]
+	}
+
+	fmt.Fprintf(w, "%-6s %9d requests %6d errors %12.0f requests/s   latency ms: p50 %.3f p95 %.3f p99 %.3f p99.9 %.3f max %.3f\n",
+		name, len(latencies), failed, rate,
+		ms(percentile(latencies, 50)), ms(percentile(latencies, 95)), ms(percentile(latencies, 99)),
+		ms(percentile(latencies, 99.9)), ms(max))
+}
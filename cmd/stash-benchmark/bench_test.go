@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maximp/stash/server"
+
+	"github.com/maximp/stash/db"
+)
+
+func TestWorkload(t *testing.T) {
+	tests := []struct {
+		mix   string
+		ops   []string
+		total int
+		err   bool
+	}{
+		{"set,get", []string{"set", "get"}, 2, false},
+		{"set:3, hget:2,pop", []string{"set", "hget", "pop"}, 6, false},
+		{"set:0", nil, 0, true},
+		{"set:x", nil, 0, true},
+		{"incr", nil, 0, true},
+	}
+
+	for _, test := range tests {
+		w, err := newWorkload(test.mix, 10, 3)
+		if (err != nil) != test.err {
+			t.Errorf("mix '%s' failed with %v", test.mix, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		var names []string
+		for _, o := range w.ops {
+			names = append(names, o.name)
+		}
+		if strings.Join(names, ",") != strings.Join(test.ops, ",") || w.total != test.total {
+			t.Errorf("mix '%s' parsed to %v total %d", test.mix, names, w.total)
+		}
+	}
+
+	w, err := newWorkload("set:1,hdel:1", 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		index, cmd := w.next(r)
+		if !strings.HasPrefix(cmd, []string{"set key:", "remove dict:"}[index]) {
+			t.Errorf("op %d generated '%s'", index, cmd)
+		}
+		if index == 0 && !strings.HasSuffix(cmd, ", xxx") {
+			t.Errorf("set generated '%s'", cmd)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 1000; i++ {
+		latencies = append(latencies, time.Duration(i))
+	}
+
+	tests := []struct {
+		p float64
+		d time.Duration
+	}{
+		{0, 1},
+		{50, 500},
+		{99, 990},
+		{99.9, 999},
+		{100, 1000},
+	}
+
+	for _, test := range tests {
+		if d := percentile(latencies, test.p); d != test.d {
+			t.Errorf("p%v is %v, expected: %v", test.p, d, test.d)
+		}
+	}
+
+	if d := percentile(nil, 50); d != 0 {
+		t.Errorf("p50 of no latencies is %v", d)
+	}
+}
+
+func TestRun(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		commands = map[string]int{}
+	)
+	handler := func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		mu.Lock()
+		commands[string(cmd)]++
+		mu.Unlock()
+		if string(cmd) == "pop" {
+			return db.Reply{}, server.ErrInvalidArgument
+		}
+		return db.StringReply([]byte("Ok")), nil
+	}
+
+	s, err := server.NewServer(":7802", handler, &server.Config{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.ListenAndServe()
+	defer s.Shutdown(context.Background())
+
+	time.Sleep(10 * time.Millisecond)
+
+	cfg := config{
+		Addr:     "127.0.0.1:7802",
+		Password: "secret",
+		Clients:  4,
+		Requests: 1001,
+		Pipeline: 8,
+		Mix:      "set,pop",
+		Keyspace: 100,
+		Size:     10,
+	}
+	rep, err := run(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rep.results) != 2 || rep.results[0].name != "set" || rep.results[1].name != "pop" {
+		t.Fatalf("unexpected results %v", rep.results)
+	}
+	set, pop := rep.results[0], rep.results[1]
+	if len(set.latencies)+len(pop.latencies) != cfg.Requests {
+		t.Errorf("%d requests completed, expected: %d", len(set.latencies)+len(pop.latencies), cfg.Requests)
+	}
+	if set.errors != 0 || pop.errors != len(pop.latencies) {
+		t.Errorf("set errors %d, pop errors %d of %d", set.errors, pop.errors, len(pop.latencies))
+	}
+	if commands["set"] != len(set.latencies) || commands["pop"] != len(pop.latencies) {
+		t.Errorf("server received %v", commands)
+	}
+
+	var out bytes.Buffer
+	rep.print(&out)
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != 3 ||
+		strings.Join(strings.Fields(lines[2])[:3], " ") != "total 1001 requests" {
+		t.Errorf("unexpected report:\n%s", out.String())
+	}
+
+	cfg.Password = "invalid"
+	if _, err := run(cfg); err == nil {
+		t.Error("run with invalid password succeeded")
+	}
+}
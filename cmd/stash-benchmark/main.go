@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// main implements entry point of stash-benchmark command-line application
+func main() {
+	var cfg config
+
+	fs := flag.NewFlagSet("stash-benchmark", flag.ContinueOnError)
+	fs.StringVar(&cfg.Addr, "addr", "127.0.0.1:7777", "server address, host:port")
+	fs.StringVar(&cfg.Password, "a", "", "password to authenticate with")
+	fs.IntVar(&cfg.Clients, "c", 50, "number of concurrent clients")
+	fs.IntVar(&cfg.Requests, "n", 100000, "total number of requests")
+	fs.IntVar(&cfg.Pipeline, "P", 1, "number of requests sent by client before reading replies")
+	fs.StringVar(&cfg.Mix, "t", "set,get", "command mix 'test[:weight],...', tests: set, get, push, pop, hset, hget, hdel")
+	fs.IntVar(&cfg.Keyspace, "r", 10000, "number of distinct keys")
+	fs.IntVar(&cfg.Size, "d", 3, "value size in bytes")
+	fs.Int64Var(&cfg.Seed, "seed", time.Now().UnixNano(), "random seed")
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		os.Exit(2)
+	}
+
+	fmt.Printf("%s: %d clients, %d requests, pipeline %d, keyspace %d, value %d bytes\n",
+		cfg.Addr, cfg.Clients, cfg.Requests, cfg.Pipeline, cfg.Keyspace, cfg.Size)
+
+	rep, err := run(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d requests completed in %v\n", cfg.Requests, rep.elapsed)
+	rep.print(os.Stdout)
+}
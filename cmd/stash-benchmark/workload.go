@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// errInvalidMix is returned for malformed command mix
+var errInvalidMix = errors.New("invalid command mix")
+
+// An op generates commands of single benchmark test
+type op struct {
+	name   string
+	weight int
+	gen    func(w *workload, r *rand.Rand) string
+}
+
+// ops are supported benchmark tests
+var ops = map[string]func(w *workload, r *rand.Rand) string{
+	"set": func(w *workload, r *rand.Rand) string {
+		return "set key:" + w.key(r) + ", " + w.value
+	},
+	"get": func(w *workload, r *rand.Rand) string {
+		return "get key:" + w.key(r)
+	},
+	"push": func(w *workload, r *rand.Rand) string {
+		return "push list:" + w.key(r) + ", " + w.value
+	},
+	"pop": func(w *workload, r *rand.Rand) string {
+		return "pop list:" + w.key(r)
+	},
+	"hset": func(w *workload, r *rand.Rand) string {
+		return "set dict:" + w.key(r) + ", field:" + w.key(r) + ", " + w.value
+	},
+	"hget": func(w *workload, r *rand.Rand) string {
+		return "get dict:" + w.key(r) + ", field:" + w.key(r)
+	},
+	"hdel": func(w *workload, r *rand.Rand) string {
+		return "remove dict:" + w.key(r) + ", field:" + w.key(r)
+	},
+}
+
+// A workload generates random commands according to command mix
+type workload struct {
+	ops      []op
+	total    int // sum of weights
+	keyspace int
+	value    string
+}
+
+// newWorkload parses command mix 'name[:weight],...' and returns workload
+// over keyspace keys with values of size bytes
+func newWorkload(mix string, keyspace int, size int) (*workload, error) {
+	if keyspace <= 0 || size < 0 {
+		return nil, errInvalidMix
+	}
+
+	w := &workload{keyspace: keyspace, value: strings.Repeat("x", size)}
+
+	for _, item := range strings.Split(mix, ",") {
+		fields := strings.SplitN(strings.TrimSpace(item), ":", 2)
+
+		gen, ok := ops[fields[0]]
+		if !ok {
+			return nil, errors.New("unknown test: " + fields[0])
+		}
+
+		weight := 1
+		if len(fields) == 2 {
+			n, err := strconv.Atoi(fields[1])
+			if err != nil || n <= 0 {
+				return nil, errInvalidMix
+			}
+			weight = n
+		}
+
+		w.ops = append(w.ops, op{fields[0], weight, gen})
+		w.total += weight
+	}
+
+	return w, nil
+}
+
+// next returns index of randomly chosen op and its command
+func (w *workload) next(r *rand.Rand) (int, string) {
+	n := r.Intn(w.total)
+	for i, o := range w.ops {
+		if n < o.weight {
+			return i, o.gen(w, r)
+		}
+		n -= o.weight
+	}
+	panic("unreachable")
+}
+
+// key returns random key number of keyspace
+func (w *workload) key(r *rand.Rand) string {
+	return strconv.Itoa(r.Intn(w.keyspace))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// maxHistory limits number of lines kept in history
+const maxHistory = 1000
+
+// Key codes handled by editor
+const (
+	keyCtrlA     = 1
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyBackspace = 8
+	keyTab       = 9
+	keyLF        = 10
+	keyCR        = 13
+	keyCtrlU     = 21
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// An editor reads lines from terminal in raw mode, it supports cursor
+// movement, history navigation and completion
+type editor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	fd       int
+	prompt   string
+	history  *history
+	complete func(line string) (string, []string)
+}
+
+// newEditor returns editor reading from terminal in
+func newEditor(in *os.File, out io.Writer, prompt string) (*editor, error) {
+	if !isTerminal(int(in.Fd())) {
+		return nil, fmt.Errorf("%s is not a terminal", in.Name())
+	}
+	return &editor{
+		in:      bufio.NewReader(in),
+		out:     out,
+		fd:      int(in.Fd()),
+		prompt:  prompt,
+		history: &history{},
+	}, nil
+}
+
+// readLine switches terminal to raw mode and reads single line, io.EOF is
+// returned on Ctrl-D entered on empty line
+func (e *editor) readLine() (string, error) {
+	restore, err := makeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer restore()
+
+	return e.edit()
+}
+
+// edit reads keys and edits line until it is entered
+func (e *editor) edit() (string, error) {
+	var (
+		buf   []rune
+		pos   int
+		index = len(e.history.lines) // history line shown, len - new line
+		saved []rune                 // new line saved while history is shown
+	)
+
+	refresh := func() {
+		fmt.Fprintf(e.out, "\r\x1b[K%s%s", e.prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	show := func(line []rune) {
+		buf = append([]rune(nil), line...)
+		pos = len(buf)
+		refresh()
+	}
+
+	fmt.Fprint(e.out, e.prompt)
+
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			fmt.Fprint(e.out, "\r\n")
+			if err == io.EOF && len(buf) > 0 {
+				return string(buf), nil
+			}
+			return "", err
+		}
+
+		switch r {
+		case keyCR, keyLF:
+			fmt.Fprint(e.out, "\r\n")
+			return string(buf), nil
+
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			buf, pos, index = nil, 0, len(e.history.lines)
+			refresh()
+
+		case keyCtrlD:
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+				refresh()
+			}
+
+		case keyBackspace, keyDelete:
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+				refresh()
+			}
+
+		case keyCtrlA:
+			pos = 0
+			refresh()
+
+		case keyCtrlE:
+			pos = len(buf)
+			refresh()
+
+		case keyCtrlU:
+			buf = append([]rune(nil), buf[pos:]...)
+			pos = 0
+			refresh()
+
+		case keyTab:
+			if e.complete == nil || pos != len(buf) {
+				break
+			}
+			line, candidates := e.complete(string(buf))
+			if len(candidates) > 0 {
+				fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+			}
+			show([]rune(line))
+
+		case keyEscape:
+			switch e.escape() {
+			case 'A':
+				if index > 0 {
+					if index == len(e.history.lines) {
+						saved = buf
+					}
+					index--
+					show([]rune(e.history.lines[index]))
+				}
+			case 'B':
+				if index < len(e.history.lines) {
+					index++
+					if index == len(e.history.lines) {
+						show(saved)
+					} else {
+						show([]rune(e.history.lines[index]))
+					}
+				}
+			case 'C':
+				if pos < len(buf) {
+					pos++
+					refresh()
+				}
+			case 'D':
+				if pos > 0 {
+					pos--
+					refresh()
+				}
+			case 'H':
+				pos = 0
+				refresh()
+			case 'F':
+				pos = len(buf)
+				refresh()
+			case '~':
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+					refresh()
+				}
+			}
+
+		default:
+			if r < ' ' {
+				break
+			}
+			buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+			pos++
+			refresh()
+		}
+	}
+}
+
+// escape reads escape sequence and returns its final byte, delete key
+// sequence "[3~" is returned as '~', unknown sequences are returned as 0
+func (e *editor) escape() byte {
+	b, err := e.in.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return 0
+	}
+
+	b, err = e.in.ReadByte()
+	if err != nil {
+		return 0
+	}
+	if b == '3' {
+		if b, err = e.in.ReadByte(); err != nil || b != '~' {
+			return 0
+		}
+	}
+	return b
+}
+
+// A history keeps entered lines, lines are appended to history file
+type history struct {
+	lines []string
+	file  string
+}
+
+// load reads history from file, lines added later are appended to the file
+func (h *history) load(file string) {
+	h.file = file
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	if len(h.lines) > maxHistory {
+		h.lines = h.lines[len(h.lines)-maxHistory:]
+	}
+}
+
+// add appends line to history unless it repeats the last line
+func (h *history) add(line string) {
+	if n := len(h.lines); n > 0 && h.lines[n-1] == line {
+		return
+	}
+
+	h.lines = append(h.lines, line)
+	if len(h.lines) > maxHistory {
+		h.lines = h.lines[1:]
+	}
+
+	if h.file == "" {
+		return
+	}
+	f, err := os.OpenFile(h.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// A completer completes command names
+type completer struct {
+	names []string // sorted
+}
+
+// newCompleter returns completer of given command names
+func newCompleter(names []string) *completer {
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	return &completer{names}
+}
+
+// complete completes command name in line, if name is ambiguous it is
+// completed up to common prefix and candidates are returned
+func (c *completer) complete(line string) (string, []string) {
+	if strings.Contains(line, " ") {
+		return line, nil
+	}
+
+	var matches []string
+	for _, name := range c.names {
+		if strings.HasPrefix(name, line) && (len(matches) == 0 || matches[len(matches)-1] != name) {
+			matches = append(matches, name)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return line, nil
+	case 1:
+		return matches[0] + " ", nil
+	}
+
+	prefix := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(line) {
+		return prefix, nil
+	}
+	return line, matches
+}
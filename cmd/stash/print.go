@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/maximp/stash/db"
+)
+
+// format returns reply for output, raw reply is returned in text protocol,
+// items of array replies are printed one per numbered line
+func format(r db.Reply, raw bool) string {
+	if raw {
+		return string(r.Text())
+	}
+
+	switch r.Type {
+	case db.ReplyString:
+		if len(r.Str) == 0 {
+			return "(empty)"
+		}
+		return string(r.Str)
+	case db.ReplyArray:
+		if len(r.Array) == 0 {
+			return "(empty array)"
+		}
+		return formatArray(r.Array, "")
+	}
+	return formatItem(r, "")
+}
+
+// formatArray returns items one per numbered line, lines of nested arrays
+// are indented
+func formatArray(items []db.Reply, indent string) string {
+	width := len(strconv.Itoa(len(items)))
+
+	var b strings.Builder
+	for i, item := range items {
+		n := strconv.Itoa(i + 1)
+		if i > 0 {
+			b.WriteByte('\n')
+			b.WriteString(indent)
+		}
+		b.WriteString(strings.Repeat(" ", width-len(n)))
+		b.WriteString(n)
+		b.WriteString(") ")
+		b.WriteString(formatItem(item, indent+strings.Repeat(" ", width+2)))
+	}
+	return b.String()
+}
+
+// formatItem returns single item of array reply, strings are quoted
+func formatItem(r db.Reply, indent string) string {
+	switch r.Type {
+	case db.ReplyString:
+		return strconv.Quote(string(r.Str))
+	case db.ReplyInteger:
+		return "(integer) " + strconv.FormatInt(r.Int, 10)
+	case db.ReplyError:
+		return "(error) " + string(r.Str)
+	case db.ReplyArray:
+		if len(r.Array) == 0 {
+			return "(empty array)"
+		}
+		return formatArray(r.Array, indent)
+	}
+	return "(nil)"
+}
+
+// formatError returns error reply for output
+func formatError(code int, result string, raw bool) string {
+	if raw {
+		return result
+	}
+	return "(error " + strconv.Itoa(code) + ") " + result
+}
@@ -2,68 +2,262 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/maximp/stash/client"
+	"github.com/maximp/stash/db"
 )
 
+// Exit codes of non-interactive mode
+const (
+	exitOk    = 0 // all commands succeeded
+	exitError = 1 // server replied with error to some command
+	exitFatal = 2 // invalid flags or connection failure
+)
+
+// historyFile is the name of history file in user home directory
+const historyFile = ".stash_history"
+
+// A shell executes user commands and prints replies
+type shell struct {
+	conn   *client.Client
+	out    io.Writer
+	errOut io.Writer
+	raw    bool
+}
+
 func main() {
-	connection, err := client.Dial("127.0.0.1:7777")
+	os.Exit(run(os.Args[1:]))
+}
+
+// run parses flags, connects to server and executes commands given as
+// arguments, piped to standard input or entered interactively
+func run(args []string) int {
+	fs := flag.NewFlagSet("stash", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: stash [flags] [command [arg]]")
+		fs.PrintDefaults()
+	}
+
+	var (
+		host     = fs.String("h", "127.0.0.1", "server host")
+		port     = fs.Int("p", 7777, "server port")
+		password = fs.String("a", "", "password to authenticate with")
+		database = fs.Int("n", 0, "logical database to select")
+		raw      = fs.Bool("raw", false, "print replies as received from server")
+	)
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return exitOk
+		}
+		return exitFatal
+	}
+
+	conn, err := client.Dial(net.JoinHostPort(*host, strconv.Itoa(*port)))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		return
+		return exitFatal
 	}
-	defer connection.Close()
+	defer conn.Close()
 
-	fmt.Print("Connected...\nUse 'help' command for help\n> ")
+	if *password != "" {
+		if err := conn.Auth(*password); err != nil {
+			fmt.Fprintln(os.Stderr, "authentication failed:", err)
+			return exitFatal
+		}
+	}
 
-	stdin := bufio.NewScanner(os.Stdin)
-	for stdin.Scan() {
+	if *database != 0 {
+		if err := conn.Select(*database); err != nil {
+			fmt.Fprintln(os.Stderr, "select failed:", err)
+			return exitFatal
+		}
+	}
 
-		var (
-			cmd    = strings.TrimSpace(stdin.Text())
-			code   int
-			result string
-			err    error
-		)
+	sh := &shell{conn: conn, out: os.Stdout, errOut: os.Stderr, raw: *raw}
 
-		switch cmd {
-		case "":
-		case "help":
-			help()
-		default:
-			code, result, err = connection.Cmd(cmd)
+	if fs.NArg() > 0 {
+		return sh.batch(strings.NewReader(strings.Join(fs.Args(), " ")))
+	}
+
+	if !isTerminal(int(os.Stdin.Fd())) {
+		return sh.batch(os.Stdin)
+	}
+
+	return sh.interactive()
+}
+
+// batch executes commands read from r line by line, it returns exitError if
+// any command failed and stops on connection failure
+func (sh *shell) batch(r io.Reader) int {
+	code := exitOk
+
+	lines := bufio.NewScanner(r)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" {
+			continue
 		}
 
+		ok, err := sh.exec(line)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			break
-		} else if code == 200 {
-			fmt.Print(result, "\n> ")
-		} else if code == 0 {
-			fmt.Print("> ")
-		} else {
-			fmt.Print(code, " ", result, "\n> ")
+			fmt.Fprintln(sh.errOut, err)
+			return exitFatal
+		}
+		if !ok {
+			code = exitError
 		}
 	}
 
-	if err := stdin.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "reading standard input: ", err)
+	if err := lines.Err(); err != nil {
+		fmt.Fprintln(sh.errOut, "reading standard input:", err)
+		return exitFatal
 	}
+
+	return code
+}
+
+// interactive reads commands with line editor until quit command or end of
+// input, entered commands are saved to history file
+func (sh *shell) interactive() int {
+	e, err := newEditor(os.Stdin, os.Stdout, "> ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
+	}
+
+	if home, err := os.UserHomeDir(); err == nil {
+		e.history.load(filepath.Join(home, historyFile))
+	}
+	e.complete = newCompleter(sh.commands()).complete
+
+	fmt.Fprint(sh.out, "Connected...\nUse 'help' command for help\n")
+
+	for {
+		line, err := e.readLine()
+		if err == io.EOF {
+			return exitOk
+		}
+		if err != nil {
+			fmt.Fprintln(sh.errOut, "reading standard input:", err)
+			return exitFatal
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !secret(line) {
+			e.history.add(line)
+		}
+
+		switch line {
+		case "help":
+			help(sh.out)
+			continue
+		case "quit":
+			return exitOk
+		}
+
+		if _, err := sh.exec(line); err != nil {
+			fmt.Fprintln(sh.errOut, err)
+			return exitFatal
+		}
+	}
+}
+
+// secret reports whether line is auth command carrying password, such lines
+// are not saved to history file
+func secret(line string) bool {
+	name, _, _ := strings.Cut(line, " ")
+	return strings.EqualFold(name, "auth")
+}
+
+// exec sends command to server and prints reply, it reports whether server
+// replied with success, error is returned on connection failure
+func (sh *shell) exec(line string) (bool, error) {
+	r, err := sh.conn.Reply(line)
+	if e, ok := err.(*client.ServerError); ok {
+		fmt.Fprintln(sh.errOut, formatError(e.Code, e.Message, sh.raw))
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintln(sh.out, format(r, sh.raw))
+	return true, nil
+}
+
+// commands returns names of commands from server command table, built-in
+// help list is used if server does not serve command table
+func (sh *shell) commands() []string {
+	names := []string{"help"}
+
+	r, err := sh.conn.Reply("command")
+	if err == nil && r.Type == db.ReplyArray {
+		for _, item := range r.Array {
+			names = append(names, string(item.Str))
+		}
+		return names
+	}
+
+	for _, line := range helpLines {
+		names = append(names, strings.Fields(line)[0])
+	}
+	return names
+}
+
+// helpLines contains short help on commands
+var helpLines = []string{
+	"set name, [key,] value",
+	"get name [,key]",
+	"push name, value",
+	"pop name",
+	"keys [name]",
+	"ttl name, milliseconds",
+	"remove name [,key]",
+	"mget name [,name...]",
+	"mset name, value [,name, value...]",
+	"mremove name [,name...]",
+	"mhget name, key [,key...]",
+	"mhset name, key, value [,key, value...]",
+	"hgetall name",
+	"lrange name [,start, stop]",
+	"rename src, dst",
+	"renamenx src, dst",
+	"copy src, dst",
+	"move name, n",
+	"dbsize",
+	"flush [async]",
+	"select n",
+	"eval script [,arg...]",
+	"evalsha sha1 [,arg...]",
+	"script load script | exists sha1 | flush",
+	"replicaof host:port | no one",
+	"role",
+	"cluster slots | keyslot name | setslot slot, addr | migrate slot, addr",
+	"auth password",
+	"config get pattern | set name value | rewrite",
+	"info [section]",
+	"slowlog get [n] | len | reset",
+	"client list | setname name | kill addr | pause ms",
+	"command",
+	"nop",
+	"quit",
 }
 
 // help prints short help on commands
-func help() {
-	fmt.Println("  set name, [key,] value")
-	fmt.Println("  get name [,key]")
-	fmt.Println("  push name, value")
-	fmt.Println("  pop name")
-	fmt.Println("  keys [name]")
-	fmt.Println("  ttl name, milliseconds")
-	fmt.Println("  remove name [,key]")
-	fmt.Println("  nop")
-	fmt.Println("  quit")
-	fmt.Println("  help")
+func help(w io.Writer) {
+	for _, line := range helpLines {
+		fmt.Fprintln(w, " ", line)
+	}
+	fmt.Fprintln(w, "  help")
 }
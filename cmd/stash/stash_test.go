@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/maximp/stash/db"
+)
+
+func TestFormat(t *testing.T) {
+	str := func(s string) db.Reply { return db.StringReply([]byte(s)) }
+	letters := make([]db.Reply, 10)
+	for i := range letters {
+		letters[i] = str(string(rune('a' + i)))
+	}
+
+	tests := []struct {
+		reply db.Reply
+		raw   bool
+		out   string
+	}{
+		{str("value"), false, "value"},
+		{str(""), false, "(empty)"},
+		{str(""), true, ""},
+		{str("a:1\nb:2"), false, "a:1\nb:2"},
+		{db.IntegerReply(3), false, "(integer) 3"},
+		{db.IntegerReply(3), true, "3"},
+		{db.NilReply(), false, "(nil)"},
+		{db.ArrayReply(), false, "(empty array)"},
+		{db.ArrayReply(str("a"), str("b,c")), true, "a,b,c"},
+		{db.ArrayReply(str("a"), str("b,c")), false, "1) \"a\"\n2) \"b,c\""},
+		{db.ArrayReply(letters...), false, " 1) \"a\"\n 2) \"b\"\n 3) \"c\"\n 4) \"d\"\n 5) \"e\"\n" +
+			" 6) \"f\"\n 7) \"g\"\n 8) \"h\"\n 9) \"i\"\n10) \"j\""},
+		{db.ArrayReply(str("1"), db.NilReply(), str(""), db.IntegerReply(2)), false,
+			"1) \"1\"\n2) (nil)\n3) \"\"\n4) (integer) 2"},
+		{db.ArrayReply(str("a"), db.ArrayReply(str("b"), db.NilReply())), false, "1) \"a\"\n2) 1) \"b\"\n   2) (nil)"},
+	}
+
+	for _, test := range tests {
+		if out := format(test.reply, test.raw); out != test.out {
+			t.Errorf("format of '%s' is '%s', expected: '%s'", test.reply.Typed(), out, test.out)
+		}
+	}
+
+	if out := formatError(300, "not found", false); out != "(error 300) not found" {
+		t.Errorf("formatError returned '%s'", out)
+	}
+	if out := formatError(300, "not found", true); out != "not found" {
+		t.Errorf("raw formatError returned '%s'", out)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	c := newCompleter([]string{"set", "get", "slowlog", "select", "help", "get"})
+
+	tests := []struct {
+		line       string
+		completed  string
+		candidates []string
+	}{
+		{"", "", []string{"get", "help", "select", "set", "slowlog"}},
+		{"g", "get ", nil},
+		{"s", "s", []string{"select", "set", "slowlog"}},
+		{"se", "se", []string{"select", "set"}},
+		{"sel", "select ", nil},
+		{"x", "x", nil},
+		{"get na", "get na", nil},
+	}
+
+	for _, test := range tests {
+		completed, candidates := c.complete(test.line)
+		if completed != test.completed || !reflect.DeepEqual(candidates, test.candidates) {
+			t.Errorf("complete('%s') returned '%s' %q, expected: '%s' %q",
+				test.line, completed, candidates, test.completed, test.candidates)
+		}
+	}
+}
+
+func TestEditor(t *testing.T) {
+	tests := []struct {
+		input string
+		line  string
+		err   error
+	}{
+		{"get name\r", "get name", nil},
+		{"gt\x1b[De\x1b[F name\r", "get name", nil},
+		{"get x\x7fname\r", "get name", nil},
+		{"g\t\x01x\x1b[D\x1b[3~\x05name\r", "get name", nil},
+		{"xxx\x15get name\r", "get name", nil},
+		{"xxx\x03get name\r", "get name", nil},
+		{"\x1b[A\x1b[A\x1b[B\r", "keys", nil},
+		{"get name\x1b[A\x1b[B\r", "get name", nil},
+		{"\x04", "", io.EOF},
+	}
+
+	for _, test := range tests {
+		h := &history{lines: []string{"set name, value", "keys"}}
+		e := &editor{
+			in:       bufio.NewReader(strings.NewReader(test.input)),
+			out:      ioutil.Discard,
+			prompt:   "> ",
+			history:  h,
+			complete: newCompleter([]string{"get", "set"}).complete,
+		}
+		if line, err := e.edit(); line != test.line || err != test.err {
+			t.Errorf("edit of %q returned '%s' (%v), expected: '%s' (%v)", test.input, line, err, test.line, test.err)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := dir + "/history"
+
+	h := &history{}
+	h.load(file)
+	h.add("get name")
+	h.add("get name")
+	h.add("keys")
+
+	h = &history{}
+	h.load(file)
+	if !reflect.DeepEqual(h.lines, []string{"get name", "keys"}) {
+		t.Errorf("loaded history %q", h.lines)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	var tests = []struct {
+		line   string
+		secret bool
+	}{
+		{"auth password", true},
+		{"AUTH user password", true},
+		{"auth", true},
+		{"authx password", false},
+		{"get auth", false},
+	}
+
+	for _, test := range tests {
+		if s := secret(test.line); s != test.secret {
+			t.Errorf("secret(%q) = %v, expected: %v", test.line, s, test.secret)
+		}
+	}
+}
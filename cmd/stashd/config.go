@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/server"
+)
+
+// Errors returned by config command
+var (
+	errUnknownParameter = errors.New("unknown parameter")
+	errNotLive          = errors.New("parameter can not be changed at runtime")
+	errNoConfigFile     = errors.New("server is started without config file")
+)
+
+// A config holds parameters of stashd. Every parameter is a flag of own flag
+// set, so the same name is used on command line, in config file and by
+// config command.
+type config struct {
+	fs   *flag.FlagSet
+	file string
+
+	Bind             string
+	Metrics          string
+	LogFile          string
+	LogFormat        string
+	LogLevel         slog.Level
+	Shards           uint
+	Databases        uint
+	QueueLength      uint
+	MaxMemory        uint64
+	Eviction         db.EvictionPolicy
+	ScriptSteps      int
+	ScriptTimeout    time.Duration
+	RequirePass      string
+	ReplicaOf        string
+	PrimaryAuth      string
+	ClusterSelf      string
+	ClusterSlots     string
+	SlowlogThreshold time.Duration
+	SlowlogLen       int
+	ShutdownTimeout  time.Duration
+	Limits           server.Limits
+
+	mu   sync.Mutex
+	live map[string]func() error // appliers of parameters changeable at runtime
+}
+
+// newConfig creates config with default values
+func newConfig() *config {
+	c := &config{
+		fs:   flag.NewFlagSet("stashd", flag.ContinueOnError),
+		live: make(map[string]func() error),
+	}
+
+	fs := c.fs
+	fs.StringVar(&c.file, "config", "", "load parameters from file, command line flags take precedence")
+	fs.StringVar(&c.Bind, "bind", ":7777", "listen address, host:port")
+	fs.StringVar(&c.Metrics, "metrics", "", "serve Prometheus metrics at host:port")
+	fs.StringVar(&c.LogFile, "logfile", "", "append log to file, empty - standard output")
+	fs.StringVar(&c.LogFormat, "logformat", "text", "log format: text or json")
+	fs.TextVar(&c.LogLevel, "loglevel", slog.LevelInfo, "log level: debug, info, warn or error")
+	fs.UintVar(&c.Shards, "shards", 0, "number of database engine loops, 0 - number of CPUs")
+	fs.UintVar(&c.Databases, "databases", 1, "number of logical databases chosen by select command")
+	fs.UintVar(&c.QueueLength, "queue-length", 10, "length of command queue of every engine loop")
+	fs.Uint64Var(&c.MaxMemory, "maxmemory", 0, "approximate memory limit in bytes, 0 - unlimited")
+	fs.Var(policyValue{&c.Eviction}, "maxmemory-policy", "eviction policy: noeviction, allkeys-lru, allkeys-lfu, volatile-lru, allkeys-random")
+	fs.IntVar(&c.ScriptSteps, "script-steps", db.DefaultScriptSteps, "max number of expressions evaluated by single script")
+	fs.DurationVar(&c.ScriptTimeout, "script-timeout", db.DefaultScriptTimeout, "max run time of single script, database is blocked while it runs")
+	fs.StringVar(&c.RequirePass, "requirepass", "", "password required by auth command, empty - no authentication")
+	fs.StringVar(&c.ReplicaOf, "replicaof", "", "replicate primary at host:port")
+	fs.StringVar(&c.PrimaryAuth, "primaryauth", "", "password to authenticate at primary")
+	fs.StringVar(&c.ClusterSelf, "cluster-self", "", "cluster mode, host:port of this node")
+	fs.StringVar(&c.ClusterSlots, "cluster-slots", "", "cluster mode, slot map '0-8191 host1:port,8192-16383 host2:port'")
+	fs.DurationVar(&c.SlowlogThreshold, "slowlog-threshold", 10*time.Millisecond, "log commands slower than threshold, negative disables slow log")
+	fs.IntVar(&c.SlowlogLen, "slowlog-len", 128, "number of commands kept in slow log")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 10*time.Second, "time to let clients finish commands on shutdown")
+	fs.IntVar(&c.Limits.MaxClients, "max-clients", 10000, "max number of connected clients, 0 - unlimited")
+	fs.DurationVar(&c.Limits.IdleTimeout, "idle-timeout", 0, "close connections idle longer, 0 - never")
+	fs.DurationVar(&c.Limits.ReadTimeout, "read-timeout", 10*time.Second, "time to read command line, 0 - unlimited")
+	fs.DurationVar(&c.Limits.WriteTimeout, "write-timeout", 10*time.Second, "time to send reply, 0 - unlimited")
+	fs.DurationVar(&c.Limits.CommandTimeout, "command-timeout", 0, "time to execute single command, 0 - unlimited")
+	fs.IntVar(&c.Limits.MaxLineBytes, "max-line-bytes", 64<<20, "max length of command line, 0 - unlimited")
+	fs.IntVar(&c.Limits.MaxValueBytes, "max-value-bytes", 16<<20, "max length of command argument, 0 - unlimited")
+
+	return c
+}
+
+// parse parses command line arguments and config file given by -config flag
+func (c *config) parse(args []string) error {
+	if err := c.fs.Parse(args); err != nil {
+		return err
+	}
+
+	if c.file == "" {
+		return nil
+	}
+
+	// command line flags take precedence over config file
+	set := make(map[string]bool)
+	c.fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	return c.load(c.file, set)
+}
+
+// load reads "name = value" lines from config file, lines starting with '#'
+// are comments, values may be quoted. Parameters in skip are not changed.
+func (c *config) load(file string, skip map[string]bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return fmt.Errorf("%s:%d: expected 'name = value'", file, n)
+		}
+
+		name := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+		if strings.HasPrefix(value, "\"") {
+			if value, err = strconv.Unquote(value); err != nil {
+				return fmt.Errorf("%s:%d: invalid quoted value", file, n)
+			}
+		}
+
+		if name == "config" || c.fs.Lookup(name) == nil {
+			return fmt.Errorf("%s:%d: %v '%s'", file, n, errUnknownParameter, name)
+		}
+		if skip[name] {
+			continue
+		}
+		if err := c.fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// setLive registers function applying parameter changed at runtime
+func (c *config) setLive(name string, apply func() error) {
+	c.mu.Lock()
+	c.live[name] = apply
+	c.mu.Unlock()
+}
+
+// get returns "name value" lines of parameters matching glob pattern
+func (c *config) get(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var lines []string
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if ok, _ := path.Match(pattern, f.Name); ok {
+			lines = append(lines, f.Name+" "+f.Value.String())
+		}
+	})
+	return lines, nil
+}
+
+// set changes parameter at runtime
+func (c *config) set(name, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f := c.fs.Lookup(name)
+	if f == nil {
+		return errUnknownParameter
+	}
+
+	apply, ok := c.live[name]
+	if !ok {
+		return errNotLive
+	}
+
+	// failed Set of numeric flag still changes the value, so old value is
+	// restored on any error
+	old := f.Value.String()
+	err := f.Value.Set(value)
+	if err == nil {
+		err = apply()
+	}
+	if err != nil {
+		f.Value.Set(old)
+		return err
+	}
+
+	return nil
+}
+
+// rewrite writes current values of all parameters to config file
+func (c *config) rewrite() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == "" {
+		return errNoConfigFile
+	}
+
+	var b strings.Builder
+	b.WriteString("# stashd configuration, rewritten by config rewrite command\n")
+	c.fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		value := f.Value.String()
+		if value == "" || strings.ContainsAny(value, " \t\"#") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString("\n# " + f.Usage + "\n" + f.Name + " = " + value + "\n")
+	})
+
+	// replace file atomically
+	tmp, err := os.CreateTemp(filepath.Dir(c.file), filepath.Base(c.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	// temporary file is created with 0600, mode of config file is kept
+	if fi, err := os.Stat(c.file); err == nil {
+		if err := tmp.Chmod(fi.Mode().Perm()); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.file)
+}
+
+// Handler wraps handler to serve config commands:
+//
+//	config get pattern   - array of "name value" of parameters matching glob pattern
+//	config set name value - change parameter at runtime
+//	config rewrite        - write current parameters to config file
+func (c *config) Handler(next server.Handler) server.Handler {
+	return func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		if string(cmd) != "config" {
+			return next(ctx, cmd, arg)
+		}
+
+		fields := strings.Fields(string(arg))
+		if len(fields) == 0 {
+			return db.Reply{}, server.ErrInvalidArgument
+		}
+
+		switch {
+		case fields[0] == "get" && len(fields) == 2:
+			lines, err := c.get(fields[1])
+			if err != nil {
+				return db.Reply{}, server.ErrInvalidArgument
+			}
+			items := make([]db.Reply, len(lines))
+			for i, l := range lines {
+				items[i] = db.StringReply([]byte(l))
+			}
+			return db.ArrayReply(items...), nil
+
+		case fields[0] == "set" && len(fields) >= 2:
+			// value is the rest of argument, it may contain spaces
+			value := strings.TrimSpace(strings.TrimSpace(string(arg))[len("set"):])
+			value = strings.TrimSpace(value[len(fields[1]):])
+			if err := c.set(fields[1], value); err != nil {
+				return db.Reply{}, err
+			}
+			return db.StringReply([]byte("Ok")), nil
+
+		case fields[0] == "rewrite" && len(fields) == 1:
+			if err := c.rewrite(); err != nil {
+				return db.Reply{}, err
+			}
+			return db.StringReply([]byte("Ok")), nil
+
+		default:
+			return db.Reply{}, server.ErrInvalidArgument
+		}
+	}
+}
+
+// A policyValue implements flag.Value interface for eviction policy
+type policyValue struct {
+	p *db.EvictionPolicy
+}
+
+func (v policyValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return v.p.String()
+}
+
+func (v policyValue) Set(s string) error {
+	p, err := db.ParseEvictionPolicy(s)
+	if err != nil {
+		return err
+	}
+	*v.p = p
+	return nil
+}
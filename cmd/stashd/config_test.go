@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/maximp/stash/db"
+)
+
+func TestConfigParse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stashd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "stashd.conf")
+	data := `# comment
+bind = 127.0.0.1:8888
+maxmemory = 1024
+maxmemory-policy = allkeys-lru
+cluster-slots = "0-8191 a:1,8192-16383 b:2"
+slowlog-threshold = 5ms
+`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newConfig()
+	if err := c.parse([]string{"-config", file, "-maxmemory", "2048"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Bind != "127.0.0.1:8888" || c.MaxMemory != 2048 || c.Eviction != db.EvictionAllKeysLRU ||
+		c.ClusterSlots != "0-8191 a:1,8192-16383 b:2" || c.SlowlogThreshold != 5*time.Millisecond ||
+		c.QueueLength != 10 {
+		t.Errorf("invalid config %+v", c)
+	}
+
+	for _, data := range []string{"unknown = 1", "maxmemory", "maxmemory = x", "bind = \"a"} {
+		if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := newConfig().parse([]string{"-config", file}); err == nil {
+			t.Errorf("invalid config file '%s' is parsed", data)
+		}
+	}
+}
+
+func TestConfigCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "stashd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "stashd.conf")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newConfig()
+	if err := c.parse([]string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+
+	var applied uint64
+	c.setLive("maxmemory", func() error {
+		applied = c.MaxMemory
+		return nil
+	})
+
+	handler := c.Handler(func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		return db.StringReply([]byte("next")), nil
+	})
+
+	var configTests = []struct {
+		arg   string
+		wants string
+		err   error
+	}{
+		{"get maxmemory*", "*2,$maxmemory 0,$maxmemory-policy noeviction", nil},
+		{"set maxmemory 100", "$Ok", nil},
+		{"get maxmemory", "*1,$maxmemory 100", nil},
+		{"set maxmemory x", "", nil},
+		{"set bind :1", "", errNotLive},
+		{"set unknown 1", "", errUnknownParameter},
+		{"rewrite", "$Ok", nil},
+		{"unknown", "", nil},
+	}
+
+	for _, test := range configTests {
+		r, err := handler(context.Background(), []byte("config"), []byte(test.arg))
+		if test.wants == "" {
+			if err == nil || (test.err != nil && err != test.err) {
+				t.Errorf("config %s succeeded with '%s', expected error %v", test.arg, r.Text(), test.err)
+			}
+		} else if err != nil || string(r.Typed()) != test.wants {
+			t.Errorf("config %s failed with '%s' (%v), expected: '%s'", test.arg, r.Typed(), err, test.wants)
+		}
+	}
+
+	if applied != 100 {
+		t.Errorf("maxmemory is not applied, value %d", applied)
+	}
+
+	reloaded := newConfig()
+	if err := reloaded.parse([]string{"-config", file}); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.MaxMemory != 100 || reloaded.Bind != ":7777" {
+		t.Errorf("invalid rewritten config %+v", reloaded)
+	}
+
+	// mode of config file is kept
+	if fi, err := os.Stat(file); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0644 {
+		t.Errorf("rewritten config mode is %v, expected: %v", fi.Mode().Perm(), os.FileMode(0644))
+	}
+}
@@ -1,56 +1,319 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"syscall"
 
+	"github.com/maximp/stash/cluster"
 	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/metrics"
+	"github.com/maximp/stash/replication"
 	"github.com/maximp/stash/server"
 )
 
 // main implements entry point of stashd command-line application
 func main() {
-	log := log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
+	os.Exit(run())
+}
+
+// run runs stashd and returns exit code, deferred closes are done before
+// process exits
+func run() int {
+	cfg := newConfig()
+	if err := cfg.parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	out := io.Writer(os.Stdout)
+	if cfg.LogFile != "" {
+		f, err := os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+
+	level := new(slog.LevelVar)
+	level.Set(cfg.LogLevel)
+	cfg.setLive("loglevel", func() error {
+		level.Set(cfg.LogLevel)
+		return nil
+	})
+
+	var (
+		opts = &slog.HandlerOptions{Level: level}
+		log  *slog.Logger
+	)
+	switch cfg.LogFormat {
+	case "text":
+		log = slog.New(slog.NewTextHandler(out, opts))
+	case "json":
+		log = slog.New(slog.NewJSONHandler(out, opts))
+	default:
+		fmt.Fprintln(os.Stderr, "invalid log format:", cfg.LogFormat)
+		return 2
+	}
+
+	shards := cfg.Shards
+	if shards == 0 {
+		shards = uint(runtime.GOMAXPROCS(0))
+	}
+
+	if cfg.Databases == 0 {
+		fmt.Fprintln(os.Stderr, "invalid number of databases: 0")
+		return 2
+	}
+	if cfg.Databases > 1 && cfg.ClusterSelf != "" {
+		fmt.Fprintln(os.Stderr, "cluster mode supports single database")
+		return 2
+	}
+
+	// every logical database is own keyspace with own engine loops, memory
+	// limit applies to each of them
+	dbs := make([]*db.Database, cfg.Databases)
+	for i := range dbs {
+		d, err := db.New(db.Config{
+			Log:         log.With("db", i),
+			QueueLength: cfg.QueueLength,
+			Shards:      shards,
+			MaxMemory:   cfg.MaxMemory,
+			Eviction:    cfg.Eviction,
+
+			ScriptSteps:   cfg.ScriptSteps,
+			ScriptTimeout: cfg.ScriptTimeout,
+		})
+		if err != nil {
+			panic(err)
+		}
+		defer d.Close()
+		dbs[i] = d
+	}
+	d := dbs[0]
+
+	cfg.setLive("maxmemory", func() error {
+		for _, d := range dbs {
+			if err := d.SetMaxMemory(cfg.MaxMemory); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	cfg.setLive("maxmemory-policy", func() error {
+		for _, d := range dbs {
+			if err := d.SetEviction(cfg.Eviction); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 
-	d, err := db.New(db.Config{
-		Log:         log,
-		QueueLength: 10,
+	node, err := replication.New(d, replication.Config{
+		Log:       log,
+		Primary:   cfg.ReplicaOf,
+		Auth:      cfg.PrimaryAuth,
+		Databases: dbs[1:],
 	})
 	if err != nil {
 		panic(err)
 	}
-	defer d.Close()
+	defer node.Close()
 
-	stop := make(chan struct{})
+	var handler server.Handler = func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		c, err := db.ParseCommand(cmd)
+		if err != nil {
+			return db.Reply{}, err
+		}
+		return dbs[server.Database(ctx)].ExecReply(ctx, c, arg)
+	}
+
+	handler = node.Handler(handler)
+	handler = moveHandler(dbs, node, handler)
+
+	commands := []string{"replicaof", "role", "info", "slowlog", "config", "move"}
+	for _, c := range db.Commands {
+		commands = append(commands, c.String())
+	}
+
+	if cfg.ClusterSelf != "" {
+		c, err := cluster.New(d, cluster.Config{
+			Log:   log,
+			Self:  cfg.ClusterSelf,
+			Slots: cfg.ClusterSlots,
+		})
+		if err != nil {
+			panic(err)
+		}
+		handler = c.Handler(handler)
+		commands = append(commands, "cluster")
+	}
+
+	stats := &server.Stats{}
+
+	info := server.NewInfo(stats)
+	info.Section("replication", node.Info)
+	for _, name := range db.InfoSections {
+		name := name
+		info.Section(name, func() ([]byte, error) { return d.Info(name) })
+	}
+	if len(dbs) > 1 {
+		info.Section("keyspace", func() ([]byte, error) { return keyspace(dbs) })
+	}
+	handler = info.Handler(handler)
+
+	slowlog := server.NewSlowLog(cfg.SlowlogThreshold, cfg.SlowlogLen)
+	handler = slowlog.Handler(handler)
+	cfg.setLive("slowlog-threshold", func() error {
+		slowlog.SetThreshold(cfg.SlowlogThreshold)
+		return nil
+	})
+
+	handler = cfg.Handler(handler)
+	handler = server.Commands(handler, commands...)
+
+	var metricsSrv *http.Server
+	if cfg.Metrics != "" {
+		m := metrics.New()
+		m.Database(dbs...)
+		m.Server(stats)
+		handler = m.Handler(handler)
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m)
+		metricsSrv = &http.Server{Addr: cfg.Metrics, Handler: mux}
+		defer metricsSrv.Close()
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Error("metrics server failed", "err", err)
+			}
+		}()
+	}
+
+	srv, err := server.NewServer(cfg.Bind, handler, &server.Config{
+		Logger:    log,
+		Streams:   map[string]server.StreamHandler{"psync": node.Sync},
+		Stats:     stats,
+		SlowLog:   slowlog,
+		Limits:    cfg.Limits,
+		Password:  cfg.RequirePass,
+		Databases: len(dbs),
+	})
+	if err != nil {
+		panic(err)
+	}
+	cfg.setLive("requirepass", func() error {
+		srv.SetPassword(cfg.RequirePass)
+		return nil
+	})
+
+	// on signal stop accepting connections and let clients finish commands
+	// in progress, replication node and database are closed after that
+	shutdown := make(chan struct{})
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-sig
-
 		signal.Stop(sig)
-		close(sig)
+		log.Info("received stop signal")
 
-		stop <- struct{}{}
-		close(stop)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Warn("shutdown timed out", "err", err)
+		}
+		if metricsSrv != nil {
+			if err := metricsSrv.Shutdown(ctx); err != nil {
+				log.Warn("metrics server shutdown timed out", "err", err)
+			}
+		}
+
+		close(shutdown)
 	}()
 
-	handler := func(cmd []byte, arg []byte) ([]byte, error) {
-		c, err := db.ParseCommand(cmd)
+	if err := srv.ListenAndServe(); err != server.ErrServerClosed {
+		log.Error("server failed", "err", err)
+		return 1
+	}
+
+	<-shutdown
+	log.Info("finished")
+	return 0
+}
+
+// moveHandler wraps handler to serve 'move name, n' command, it moves key
+// with its TTL from selected database to database n, replica rejects it
+func moveHandler(dbs []*db.Database, node *replication.Node, next server.Handler) server.Handler {
+	return func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		if string(cmd) != "move" {
+			return next(ctx, cmd, arg)
+		}
+		if node.Replicating() {
+			return db.Reply{}, replication.ErrReadOnly
+		}
+
+		args := db.SplitArg(arg)
+		if len(args) != 2 {
+			return db.Reply{}, db.ErrInvalidFormat
+		}
+		n, err := strconv.Atoi(string(args[1]))
+		if err != nil || n < 0 || n >= len(dbs) {
+			return db.Reply{}, server.ErrInvalidDatabase
+		}
+
+		if err := db.Move(ctx, dbs[server.Database(ctx)], dbs[n], args[0]); err != nil {
+			return db.Reply{}, err
+		}
+		return db.StringReply([]byte("Ok")), nil
+	}
+}
+
+// keyspace returns keyspace info section of several logical databases, it
+// contains "dbN:keys=...,expiring=..." line per database followed by
+// totals of all databases
+func keyspace(dbs []*db.Database) ([]byte, error) {
+	var (
+		b     []byte
+		total db.Stats
+	)
+	for i, d := range dbs {
+		s, err := d.Stats()
 		if err != nil {
 			return nil, err
 		}
-		return d.Exec(c, arg)
-	}
+		keys := s.Strings + s.Dicts + s.Lists
+		b = append(b, "db"+strconv.Itoa(i)+":keys="+strconv.Itoa(keys)+
+			",expiring="+strconv.Itoa(s.Expiring)+"\n"...)
 
-	cfg := server.Config{
-		Logger: log,
-		Stop:   stop,
+		total.Strings += s.Strings
+		total.Dicts += s.Dicts
+		total.Lists += s.Lists
+		total.Expiring += s.Expiring
+		total.Expired += s.Expired
+		total.Evicted += s.Evicted
 	}
 
-	if err := server.ListenAndServe(":7777", handler, &cfg); err != nil {
-		log.Println(err)
-	} else {
-		log.Println("finished")
+	field := func(name string, value string) {
+		b = append(b, name+":"+value+"\n"...)
 	}
+	field("str_keys", strconv.Itoa(total.Strings))
+	field("dict_keys", strconv.Itoa(total.Dicts))
+	field("list_keys", strconv.Itoa(total.Lists))
+	field("expiring_keys", strconv.Itoa(total.Expiring))
+	field("expired_keys", strconv.FormatUint(total.Expired, 10))
+	field("evicted_keys", strconv.FormatUint(total.Evicted, 10))
+	return b, nil
 }
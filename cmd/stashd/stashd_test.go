@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/replication"
+	"github.com/maximp/stash/server"
+)
+
+func TestMoveHandler(t *testing.T) {
+	dbs := make([]*db.Database, 2)
+	for i := range dbs {
+		d, err := db.New(db.Config{QueueLength: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		dbs[i] = d
+	}
+
+	node, err := replication.New(dbs[0], replication.Config{Databases: dbs[1:]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	handler := moveHandler(dbs, node, func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		return db.StringReply([]byte("next")), nil
+	})
+
+	dbs[0].Set("a,b", []byte("value"))
+	dbs[0].Set("c", []byte("value"))
+	dbs[1].Set("c", []byte("other"))
+
+	var moveTests = []struct {
+		arg   string
+		wants string
+		err   error
+	}{
+		{"a\\,b, 1", "Ok", nil},
+		{"a\\,b, 1", "", db.ErrNotFound},
+		{"c, 1", "", db.ErrKeyExists},
+		{"c, 0", "", db.ErrInvalidFormat},
+		{"c, 2", "", server.ErrInvalidDatabase},
+		{"c, x", "", server.ErrInvalidDatabase},
+		{"c", "", db.ErrInvalidFormat},
+	}
+
+	for _, test := range moveTests {
+		r, err := handler(context.Background(), []byte("move"), []byte(test.arg))
+		if err != test.err || string(r.Text()) != test.wants {
+			t.Errorf("move %s failed with '%s' (%v), expected: '%s' (%v)", test.arg, r.Text(), err, test.wants, test.err)
+		}
+	}
+
+	if v, err := dbs[1].Get("a,b"); err != nil || string(v) != "value" {
+		t.Errorf("moved key returned '%s' (%v)", v, err)
+	}
+	if r, err := handler(context.Background(), []byte("get"), []byte("c")); err != nil || string(r.Text()) != "next" {
+		t.Errorf("get failed with '%s' (%v)", r.Text(), err)
+	}
+}
@@ -2,48 +2,53 @@ package stash
 
 import (
 	"bytes"
+	"context"
 	"errors"
-	"log"
+	"log/slog"
+	"net/textproto"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/maximp/stash/client"
+	"github.com/maximp/stash/cluster"
+	"github.com/maximp/stash/db"
 	"github.com/maximp/stash/server"
 )
 
 func TestServerComm(t *testing.T) {
-	stop := make(chan struct{})
-
 	var buf bytes.Buffer
 	cfg := server.Config{
-		Logger: log.New(&buf, "", 0),
-		Stop:   stop,
+		Logger: slog.New(slog.NewTextHandler(&buf, nil)),
 	}
 
 	var cmd string
 	var arg string
-	handler := func(c []byte, a []byte) ([]byte, error) {
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
 		cmd = string(c)
 		arg = string(a)
 		if cmd == "error" {
-			return nil, errors.New("error")
+			return db.Reply{}, errors.New("error")
 		}
-		return []byte("ok"), nil
+		return db.StringReply([]byte("ok")), nil
+	}
+
+	s, err := server.NewServer("", handler, &cfg)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	var err error
 	stopped := make(chan struct{})
 	go func() {
-		err = server.ListenAndServe("", handler, &cfg)
+		s.ListenAndServe()
 		stopped <- struct{}{}
 	}()
 
 	time.Sleep(10 * time.Millisecond)
 
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	if conn, err := client.Dial("127.0.0.1:7777"); err != nil {
 		t.Error(err)
 	} else {
@@ -59,6 +64,555 @@ func TestServerComm(t *testing.T) {
 		}
 	}
 
-	stop <- struct{}{}
+	s.Shutdown(context.Background())
 	<-stopped
 }
+
+// startNode starts database server at addr, returned function stops it.
+// Optional wrap function is used to decorate database handler.
+func startNode(t *testing.T, addr string, wrap func(d *db.Database, h server.Handler) server.Handler) func() {
+	d, err := db.New(db.Config{
+		QueueLength: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		c, err := db.ParseCommand(cmd)
+		if err != nil {
+			return db.Reply{}, err
+		}
+		return d.ExecReply(ctx, c, arg)
+	}
+
+	if wrap != nil {
+		handler = wrap(d, handler)
+	}
+
+	s, err := server.NewServer(addr, handler, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	return func() {
+		s.Shutdown(context.Background())
+		<-stopped
+		d.Close()
+	}
+}
+
+func TestRing(t *testing.T) {
+	addrs := []string{"127.0.0.1:7791", "127.0.0.1:7792", "127.0.0.1:7793"}
+	for _, addr := range addrs {
+		defer startNode(t, addr, nil)()
+	}
+
+	ring, err := client.NewRing(addrs[:2], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.Close()
+
+	var names []string
+	for i := 0; i < 100; i++ {
+		name := "name" + strconv.Itoa(i)
+		names = append(names, name)
+		if code, line, err := ring.Cmd("set " + name + ", value" + strconv.Itoa(i)); code != server.ServerOperationOk || err != nil {
+			t.Fatalf("set %s failed with %d %s (%v)", name, code, line, err)
+		}
+	}
+
+	// keys are distributed across nodes
+	for _, addr := range addrs[:2] {
+		conn, err := client.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, line, _ := conn.Cmd("keys"); line == "" {
+			t.Errorf("node %s has no keys", addr)
+		}
+		conn.Close()
+	}
+
+	_, line, err := ring.Cmd("keys")
+	keys := strings.Split(line, ",")
+	sorted := append([]string(nil), names...)
+	sort.Strings(keys)
+	sort.Strings(sorted)
+	if err != nil || strings.Join(keys, ",") != strings.Join(sorted, ",") {
+		t.Errorf("keys failed with '%s' (%v)", line, err)
+	}
+
+	// multi key commands are split by nodes
+	var mget []string
+	for i := 0; i < 10; i++ {
+		mget = append(mget, "value"+strconv.Itoa(i))
+	}
+	if code, line, err := ring.Cmd("mget " + strings.Join(names[:10], ",") + ",none"); err != nil ||
+		code != server.ServerOperationOk || line != strings.Join(mget, ",")+"," {
+		t.Errorf("mget replied %d %s (%v)", code, line, err)
+	}
+	if code, line, err := ring.Cmd("mremove none1,none2,none3"); err != nil || code != server.ServerOperationOk || line != "0" {
+		t.Errorf("mremove replied %d %s (%v)", code, line, err)
+	}
+	if code, line, err := ring.Cmd("mget"); err != nil || code != server.ServerOperationError {
+		t.Errorf("mget without keys replied %d %s (%v)", code, line, err)
+	}
+	cross := ""
+	for _, name := range names {
+		if ring.Node(name) != ring.Node(names[0]) {
+			cross = name
+			break
+		}
+	}
+	if _, _, err := ring.Cmd("mset " + names[0] + ",1," + cross + ",2"); err != client.ErrCrossNode {
+		t.Errorf("mset of keys on different nodes failed with %v, expected: %v", err, client.ErrCrossNode)
+	}
+	if _, _, err := ring.Cmd("rename " + names[0] + "," + cross); err != client.ErrCrossNode {
+		t.Errorf("rename of keys on different nodes failed with %v, expected: %v", err, client.ErrCrossNode)
+	}
+	if code, line, err := ring.Cmd("mremove " + names[0] + ",none," + cross); err != nil || code != server.ServerOperationOk || line != "2" {
+		t.Errorf("mremove replied %d %s (%v)", code, line, err)
+	}
+	for i, name := range names {
+		if name == names[0] || name == cross {
+			ring.Cmd("set " + name + ", value" + strconv.Itoa(i))
+		}
+	}
+
+	// adding node keeps keys of other nodes reachable
+	if err := ring.Add(addrs[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	found := 0
+	for i, name := range names {
+		code, line, err := ring.Cmd("get " + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ring.Node(name) != addrs[2] {
+			if code != server.ServerOperationOk || line != "value"+strconv.Itoa(i) {
+				t.Errorf("get %s failed with %d %s", name, code, line)
+			}
+			found++
+		}
+	}
+	if found == len(names) || found < len(names)/2 {
+		t.Errorf("%d of %d keys are not moved to the new node", found, len(names))
+	}
+
+	if err := ring.Remove(addrs[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, name := range names {
+		if code, line, err := ring.Cmd("get " + name); code != server.ServerOperationOk || line != "value"+strconv.Itoa(i) || err != nil {
+			t.Errorf("get %s after node remove failed with %d %s (%v)", name, code, line, err)
+		}
+	}
+}
+
+func TestCluster(t *testing.T) {
+	addrs := []string{"127.0.0.1:7794", "127.0.0.1:7795"}
+	slots := "0-8191 " + addrs[0] + ",8192-16383 " + addrs[1]
+
+	for _, addr := range addrs {
+		self := addr
+		defer startNode(t, addr, func(d *db.Database, h server.Handler) server.Handler {
+			c, err := cluster.New(d, cluster.Config{Self: self, Slots: slots})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c.Handler(h)
+		})()
+	}
+
+	conn, err := client.Dial(addrs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// keys of both nodes are available through single client
+	var names []string
+	for i := 0; i < 20; i++ {
+		name := "name" + strconv.Itoa(i)
+		names = append(names, name)
+		if code, line, err := conn.Cmd("set " + name + ", value" + strconv.Itoa(i)); code != server.ServerOperationOk || err != nil {
+			t.Fatalf("set %s failed with %d %s (%v)", name, code, line, err)
+		}
+	}
+
+	for i, name := range names {
+		if code, line, err := conn.Cmd("get " + name); code != server.ServerOperationOk || line != "value"+strconv.Itoa(i) || err != nil {
+			t.Errorf("get %s failed with %d %s (%v)", name, code, line, err)
+		}
+	}
+
+	slot := cluster.Slot([]byte("name0"))
+	owner, other := addrs[0], addrs[1]
+	if slot >= 8192 {
+		owner, other = other, owner
+	}
+
+	// migrate slot with TTL key
+	if code, line, err := conn.Cmd("ttl name0, 200"); code != server.ServerOperationOk || err != nil {
+		t.Fatalf("ttl failed with %d %s (%v)", code, line, err)
+	}
+	if code, line, err := conn.Cmd("push {name0}.list, 1"); code != server.ServerOperationOk || err != nil {
+		t.Fatalf("push failed with %d %s (%v)", code, line, err)
+	}
+
+	admin, err := client.Dial(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	if code, line, err := admin.Cmd("cluster migrate " + strconv.Itoa(slot) + ", " + other); code != server.ServerOperationOk || err != nil {
+		t.Fatalf("cluster migrate failed with %d %s (%v)", code, line, err)
+	}
+
+	raw, err := textproto.Dial("tcp", owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	raw.Cmd("get {name0}.list,0")
+	if code, line, err := raw.ReadCodeLine(0); code != server.ServerOperationRedirect || line != "moved "+strconv.Itoa(slot)+" "+other || err != nil {
+		t.Errorf("get of migrated key on old owner returned %d %s (%v)", code, line, err)
+	}
+
+	if code, line, err := conn.Cmd("get name0"); code != server.ServerOperationOk || line != "value0" || err != nil {
+		t.Errorf("get of migrated key failed with %d %s (%v)", code, line, err)
+	}
+	if code, line, err := conn.Cmd("get {name0}.list,0"); code != server.ServerOperationOk || line != "1" || err != nil {
+		t.Errorf("get of migrated list failed with %d %s (%v)", code, line, err)
+	}
+
+	// TTL is moved with the key
+	time.Sleep(300 * time.Millisecond)
+	if code, _, err := conn.Cmd("get name0"); code != server.ServerOperationError || err != nil {
+		t.Errorf("migrated key is not expired, code %d (%v)", code, err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	handler := func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		d, err := time.ParseDuration(string(arg))
+		if err != nil {
+			return db.Reply{}, err
+		}
+		select {
+		case <-time.After(d):
+			return db.StringReply([]byte("ok")), nil
+		case <-ctx.Done():
+			return db.Reply{}, ctx.Err()
+		}
+	}
+
+	s, err := server.NewServer("127.0.0.1:7784", handler, &server.Config{
+		Limits: server.Limits{CommandTimeout: 50 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-stopped
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := client.Dial("127.0.0.1:7784")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// server side deadline
+	if code, line, err := conn.Cmd("sleep 1ms"); err != nil || code != server.ServerOperationOk || line != "ok" {
+		t.Errorf("sleep 1ms replied %d %s (%v)", code, line, err)
+	}
+	if code, line, err := conn.Cmd("sleep 1s"); err != nil || code != server.ServerOperationError ||
+		line != context.DeadlineExceeded.Error() {
+		t.Errorf("sleep 1s replied %d %s (%v)", code, line, err)
+	}
+
+	// client side deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := conn.CmdContext(ctx, "sleep 1ms"); err != nil {
+		t.Errorf("sleep 1ms with context failed with %v", err)
+	}
+	if _, _, err := conn.CmdContext(ctx, "sleep 1s"); err != context.DeadlineExceeded {
+		t.Errorf("sleep 1s with context failed with %v, expected: %v", err, context.DeadlineExceeded)
+	}
+
+	// late reply is not read, client reconnects
+	if code, line, err := conn.Cmd("sleep 1ms"); err != nil || code != server.ServerOperationOk || line != "ok" {
+		t.Errorf("sleep 1ms after context deadline replied %d %s (%v)", code, line, err)
+	}
+
+	conn.Close()
+	if _, _, err := conn.Cmd("sleep 1ms"); err != client.ErrClosed {
+		t.Errorf("sleep 1ms on closed client failed with %v, expected: %v", err, client.ErrClosed)
+	}
+}
+
+func TestMulti(t *testing.T) {
+	stop := startNode(t, "127.0.0.1:7785", nil)
+	defer stop()
+
+	conn, err := client.Dial("127.0.0.1:7785")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.MSet("a", "1", "b", "", "c", "line1\nline2"); err != nil {
+		t.Errorf("mset failed with %v", err)
+	}
+
+	values, err := conn.MGet("a", "b", "c", "none")
+	if err != nil || len(values) != 4 || string(values[0]) != "1" || values[1] == nil || len(values[1]) != 0 ||
+		string(values[2]) != "line1\nline2" || values[3] != nil {
+		t.Errorf("mget returned %q (%v)", values, err)
+	}
+
+	if err := conn.MHSet("dict", "f1", "v1", "f2", "v2"); err != nil {
+		t.Errorf("mhset failed with %v", err)
+	}
+
+	values, err = conn.MHGet("dict", "f2", "f3", "f1")
+	if err != nil || len(values) != 3 || string(values[0]) != "v2" || values[1] != nil || string(values[2]) != "v1" {
+		t.Errorf("mhget returned %q (%v)", values, err)
+	}
+
+	if _, err := conn.MHGet("a", "f1"); err == nil {
+		t.Error("mhget of string key succeeded")
+	}
+
+	if m, err := conn.HGetAll("dict"); err != nil || len(m) != 2 || string(m["f1"]) != "v1" || string(m["f2"]) != "v2" {
+		t.Errorf("hgetall returned %q (%v)", m, err)
+	}
+
+	for _, v := range []string{"a", "b", "c"} {
+		conn.Cmd("push list, " + v)
+	}
+	if values, err := conn.LRange("list", -2, -1); err != nil || len(values) != 2 ||
+		string(values[0]) != "b" || string(values[1]) != "c" {
+		t.Errorf("lrange returned %q (%v)", values, err)
+	}
+
+	if err := conn.Copy("list", "list2"); err != nil {
+		t.Errorf("copy failed with %v", err)
+	}
+	if err := conn.RenameNX("list2", "list"); err == nil || err.Error() != db.ErrKeyExists.Error() {
+		t.Errorf("renamenx returned %v, expected: %v", err, db.ErrKeyExists)
+	}
+	if err := conn.Rename("list2", "list3"); err != nil {
+		t.Errorf("rename failed with %v", err)
+	}
+	if values, err := conn.LRange("list3", 0, -1); err != nil || len(values) != 3 {
+		t.Errorf("lrange of renamed copy returned %q (%v)", values, err)
+	}
+
+	if n, err := conn.MRemove("a", "b", "none", "dict"); err != nil || n != 3 {
+		t.Errorf("mremove returned %d (%v), expected: 3", n, err)
+	}
+
+	// commas and backslashes in names and values
+	if err := conn.MSet("a,b", "x,y", "c\\", "\\,"); err != nil {
+		t.Errorf("mset with commas failed with %v", err)
+	}
+	values, err = conn.MGet("a,b", "c\\", "a")
+	if err != nil || len(values) != 3 || string(values[0]) != "x,y" || string(values[1]) != "\\," || values[2] != nil {
+		t.Errorf("mget with commas returned %q (%v)", values, err)
+	}
+	if err := conn.MHSet("d,1", "f,1", "v\\1"); err != nil {
+		t.Errorf("mhset with commas failed with %v", err)
+	}
+	if m, err := conn.HGetAll("d,1"); err != nil || len(m) != 1 || string(m["f,1"]) != "v\\1" {
+		t.Errorf("hgetall with commas returned %q (%v)", m, err)
+	}
+	if err := conn.Rename("a,b", "e,f"); err != nil {
+		t.Errorf("rename with commas failed with %v", err)
+	}
+	if n, err := conn.MRemove("e,f", "c\\", "d,1"); err != nil || n != 3 {
+		t.Errorf("mremove with commas returned %d (%v), expected: 3", n, err)
+	}
+}
+
+func TestDatabases(t *testing.T) {
+	dbs := make([]*db.Database, 2)
+	for i := range dbs {
+		d, err := db.New(db.Config{QueueLength: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		dbs[i] = d
+	}
+
+	handler := func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		c, err := db.ParseCommand(cmd)
+		if err != nil {
+			return db.Reply{}, err
+		}
+		return dbs[server.Database(ctx)].ExecReply(ctx, c, arg)
+	}
+
+	s, err := server.NewServer("127.0.0.1:7796", handler, &server.Config{Databases: len(dbs)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-stopped
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := client.Dial("127.0.0.1:7796")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Cmd("set name, value0")
+	if err := conn.Select(1); err != nil {
+		t.Fatalf("select failed with %v", err)
+	}
+	if _, line, _ := conn.Cmd("get name"); line != db.ErrNotFound.Error() {
+		t.Errorf("database 1 replied '%s' to get of key of database 0", line)
+	}
+	conn.Cmd("set name, value1")
+	conn.Cmd("set other, value1")
+
+	if n, err := conn.DBSize(); err != nil || n != 2 {
+		t.Errorf("dbsize of database 1 returned %d (%v), expected: 2", n, err)
+	}
+	if err := conn.Select(2); err == nil || err.Error() != server.ErrInvalidDatabase.Error() {
+		t.Errorf("select of missing database returned %v", err)
+	}
+	if n, err := conn.DBSize(); err != nil || n != 2 {
+		t.Errorf("dbsize after failed select returned %d (%v), expected: 2", n, err)
+	}
+
+	if err := conn.Flush(true); err != nil {
+		t.Errorf("flush failed with %v", err)
+	}
+	if r, err := dbs[1].ExecReply(context.Background(), db.CommandDBSize, nil); err != nil || r.Int != 0 {
+		t.Errorf("database 1 has %d keys after flush (%v)", r.Int, err)
+	}
+
+	conn.Select(0)
+	if _, line, _ := conn.Cmd("get name"); line != "value0" {
+		t.Errorf("database 0 replied '%s', expected: 'value0'", line)
+	}
+}
+
+func TestScript(t *testing.T) {
+	stop := startNode(t, "127.0.0.1:7797", nil)
+	defer stop()
+
+	conn, err := client.Dial("127.0.0.1:7797")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Cmd("push queue, job")
+	r, err := conn.Eval(`(var v (pop $1)) (if v (push $2 v)) (lrange $2)`, "queue", "done")
+	if err != nil || len(r.Array) != 1 || string(r.Array[0].Str) != "job" {
+		t.Errorf("eval replied %+v (%v)", r, err)
+	}
+
+	sha, err := conn.ScriptLoad(`(concat "hello, " $1)`)
+	if err != nil {
+		t.Fatalf("script load failed with %v", err)
+	}
+	if r, err := conn.EvalSHA(sha, "world"); err != nil || string(r.Str) != "hello, world" {
+		t.Errorf("evalsha replied '%s' (%v)", r.Str, err)
+	}
+	if _, err := conn.Eval("(while 1)"); err == nil || err.Error() != db.ErrScriptSteps.Error() {
+		t.Errorf("endless script returned %v", err)
+	}
+}
+
+func TestReply(t *testing.T) {
+	stop := startNode(t, "127.0.0.1:7787", nil)
+	defer stop()
+
+	conn, err := client.Dial("127.0.0.1:7787")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, cmd := range []string{"set a\\,b, 1", "set dict, f1, v1", "set dict, f2, line1\nline2", "set path, C:\\new\r\nx"} {
+		if _, err := conn.Reply(cmd); err != nil {
+			t.Errorf("%s failed with %v", cmd, err)
+		}
+	}
+
+	names, err := conn.Keys("")
+	sort.Strings(names)
+	if err != nil || !reflect.DeepEqual(names, []string{"a,b", "dict", "path"}) {
+		t.Errorf("keys returned %q (%v)", names, err)
+	}
+
+	// text reply of typed connection
+	if code, line, err := conn.Cmd("keys dict"); err != nil || code != server.ServerOperationOk ||
+		(line != "f1,f2" && line != "f2,f1") {
+		t.Errorf("keys dict replied %d %s (%v)", code, line, err)
+	}
+	if _, line, err := conn.Cmd("get path"); err != nil || line != "C:\\new\r\nx" {
+		t.Errorf("get path replied %q (%v)", line, err)
+	}
+
+	var replyTests = []struct {
+		cmd   string
+		value interface{}
+	}{
+		{"get dict", int64(2)},
+		{"get dict, f2", "line1\nline2"},
+		{"get path", "C:\\new\r\nx"},
+		{"mget a\\,b, none", []interface{}{"1", nil}},
+	}
+
+	for _, test := range replyTests {
+		if v, err := conn.Do(test.cmd); err != nil || !reflect.DeepEqual(v, test.value) {
+			t.Errorf("%s returned %#v (%v), expected: %#v", test.cmd, v, err, test.value)
+		}
+	}
+
+	_, err = conn.Reply("get none")
+	if e, ok := err.(*client.ServerError); !ok || e.Code != server.ServerOperationError || e.Message != db.ErrNotFound.Error() {
+		t.Errorf("get of missing key failed with %v", err)
+	}
+}
@@ -0,0 +1,339 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A call holds arguments of typed API call executed by engine loop
+type call struct {
+	name  key
+	field key
+	value []byte
+	ttl   time.Duration
+	start int // index range of list
+	stop  int
+}
+
+// rets pools channels returning results of typed calls
+var rets = sync.Pool{
+	New: func() interface{} { return make(chan result, 1) },
+}
+
+// do runs op with arguments c in engine loop of shard owning the key
+func (d *Database) do(op func(s *shard, c call) result, c call) result {
+	ret := rets.Get().(chan result)
+	defer rets.Put(ret)
+
+	if err := d.send(context.Background(), d.shard([]byte(c.name)), task{op: op, c: c, ret: ret}); err != nil {
+		return result{err: err}
+	}
+	return <-ret
+}
+
+// Get returns copy of value of string key name
+func (d *Database) Get(name string) ([]byte, error) {
+	r := d.do(opGet, call{name: key(name)})
+	return r.value, r.err
+}
+
+// Len returns number of elements of dict or list key name
+func (d *Database) Len(name string) (int, error) {
+	r := d.do(opLen, call{name: key(name)})
+	return int(r.reply.Int), r.err
+}
+
+// Set sets value of string key name, value is copied
+func (d *Database) Set(name string, value []byte) error {
+	return d.do(opSet, call{name: key(name), value: value}).err
+}
+
+// HGet returns copy of value of field of dict key name
+func (d *Database) HGet(name string, field string) ([]byte, error) {
+	r := d.do(opHGet, call{name: key(name), field: key(field)})
+	return r.value, r.err
+}
+
+// HSet sets value of field of dict key name, dict is created if key does not
+// exist, value is copied
+func (d *Database) HSet(name string, field string, value []byte) error {
+	return d.do(opHSet, call{name: key(name), field: key(field), value: value}).err
+}
+
+// HDel removes field of dict key name
+func (d *Database) HDel(name string, field string) error {
+	return d.do(opHDel, call{name: key(name), field: key(field)}).err
+}
+
+// HGetAll returns copies of all fields of dict key name
+func (d *Database) HGetAll(name string) (map[string][]byte, error) {
+	r := d.do(opHGetAll, call{name: key(name)})
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	items := r.reply.Array
+	m := make(map[string][]byte, len(items)/2)
+	for i := 0; i < len(items); i += 2 {
+		m[string(items[i].Str)] = items[i+1].Str
+	}
+	return m, nil
+}
+
+// LRange returns copies of elements of list key name from start to stop
+// index inclusive, negative index counts from the end of list
+func (d *Database) LRange(name string, start int, stop int) ([][]byte, error) {
+	r := d.do(opLRange, call{name: key(name), start: start, stop: stop})
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	values := make([][]byte, len(r.reply.Array))
+	for i, item := range r.reply.Array {
+		values[i] = item.Str
+	}
+	return values, nil
+}
+
+// Push appends value to list key name, list is created if key does not exist,
+// value is copied
+func (d *Database) Push(name string, value []byte) error {
+	return d.do(opPush, call{name: key(name), value: value}).err
+}
+
+// Pop removes and returns the last value of list key name, empty list is removed
+func (d *Database) Pop(name string) ([]byte, error) {
+	r := d.do(opPop, call{name: key(name)})
+	return r.value, r.err
+}
+
+// Remove removes key name
+func (d *Database) Remove(name string) error {
+	return d.do(opRemove, call{name: key(name)}).err
+}
+
+// Expire sets TTL of key name, key is removed after ttl from now
+func (d *Database) Expire(name string, ttl time.Duration) error {
+	return d.do(opExpire, call{name: key(name), ttl: ttl}).err
+}
+
+func opGet(s *shard, c call) result {
+	v, ok := s.m[c.name]
+	if !ok {
+		return resultNotFound
+	}
+
+	sv, ok := v.(str)
+	if !ok {
+		return resultInvalidType
+	}
+	s.access(c.name)
+
+	return result{value: append([]byte(nil), sv...)}
+}
+
+func opLen(s *shard, c call) result {
+	v, ok := s.m[c.name]
+	if !ok {
+		return resultNotFound
+	}
+
+	if _, ok := v.(str); ok {
+		return resultInvalidType
+	}
+	s.access(c.name)
+
+	return v.get()
+}
+
+func opSet(s *shard, c call) result {
+	if err := s.reclaim(s.growth(c.name, len(c.value))); err != nil {
+		return result{err: err}
+	}
+
+	if v, ok := s.m[c.name]; ok {
+		if _, ok := v.(str); !ok {
+			return resultInvalidType
+		}
+	}
+
+	s.m[c.name] = str(append([]byte{}, c.value...))
+	s.update(c.name)
+	s.feedCall(CommandSet, c.name, c.value)
+
+	return resultOk
+}
+
+func opHGet(s *shard, c call) result {
+	v, ok := s.m[c.name]
+	if !ok {
+		return resultNotFound
+	}
+
+	dv, ok := v.(*dict)
+	if !ok {
+		return resultInvalidType
+	}
+	s.access(c.name)
+
+	val, ok := dv.m[c.field]
+	if !ok {
+		return resultKeyNotFound
+	}
+
+	return result{value: append([]byte(nil), val...)}
+}
+
+func opHSet(s *shard, c call) result {
+	if err := s.reclaim(s.growth(c.name, sizeOverhead+len(c.field)+len(c.value))); err != nil {
+		return result{err: err}
+	}
+
+	v, ok := s.m[c.name]
+	if !ok {
+		v = newDict()
+		s.m[c.name] = v
+	}
+
+	dv, ok := v.(*dict)
+	if !ok {
+		return resultInvalidType
+	}
+
+	dv.setKey([]byte(c.field), append([]byte{}, c.value...))
+	s.update(c.name)
+	s.feedCall(CommandSet, c.name, []byte(c.field), c.value)
+
+	return resultOk
+}
+
+func opHDel(s *shard, c call) result {
+	v, ok := s.m[c.name]
+	if !ok {
+		return resultNotFound
+	}
+
+	dv, ok := v.(*dict)
+	if !ok {
+		return resultInvalidType
+	}
+
+	dv.setKey([]byte(c.field), nil)
+	s.update(c.name)
+	s.feedCall(CommandRemove, c.name, []byte(c.field))
+
+	return resultOk
+}
+
+func opHGetAll(s *shard, c call) result {
+	v, ok := s.m[c.name]
+	if !ok {
+		return resultNotFound
+	}
+
+	dv, ok := v.(*dict)
+	if !ok {
+		return resultInvalidType
+	}
+	s.access(c.name)
+
+	return result{reply: dv.all(true)}
+}
+
+func opLRange(s *shard, c call) result {
+	v, ok := s.m[c.name]
+	if !ok {
+		return resultNotFound
+	}
+
+	lv, ok := v.(*list)
+	if !ok {
+		return resultInvalidType
+	}
+	s.access(c.name)
+
+	return result{reply: lv.slice(c.start, c.stop, true)}
+}
+
+func opPush(s *shard, c call) result {
+	if err := s.reclaim(s.growth(c.name, sizeOverhead+len(c.value))); err != nil {
+		return result{err: err}
+	}
+
+	v, ok := s.m[c.name]
+	if !ok {
+		v = new(list)
+		s.m[c.name] = v
+	}
+
+	if _, ok := v.(*list); !ok {
+		return resultInvalidType
+	}
+
+	v.push(append([]byte{}, c.value...))
+	s.update(c.name)
+	s.feedCall(CommandPush, c.name, c.value)
+
+	return resultOk
+}
+
+func opPop(s *shard, c call) result {
+	v, ok := s.m[c.name]
+	if !ok {
+		return resultNotFound
+	}
+
+	if _, ok := v.(*list); !ok {
+		return resultInvalidType
+	}
+
+	r := v.pop()
+	if v.empty() {
+		s.drop(c.name)
+	} else {
+		s.update(c.name)
+	}
+	if r.err == nil {
+		s.feedCall(CommandPop, c.name)
+	}
+
+	return r
+}
+
+func opRemove(s *shard, c call) result {
+	if _, ok := s.m[c.name]; !ok {
+		return resultNotFound
+	}
+
+	s.drop(c.name)
+	s.feedCall(CommandRemove, c.name)
+
+	return resultOk
+}
+
+func opExpire(s *shard, c call) result {
+	if _, ok := s.m[c.name]; !ok {
+		return resultNotFound
+	}
+
+	s.expire(c.name, c.ttl)
+	s.feedCall(CommandTTL, c.name, strconv.AppendInt(nil, int64(c.ttl/time.Millisecond), 10))
+
+	return resultOk
+}
+
+// feedCall passes typed call as command to Feed, argument is built only if
+// Feed is attached
+func (s *shard) feedCall(cmd Command, name key, args ...[]byte) {
+	if s.db.feed == nil {
+		return
+	}
+
+	arg := appendArg(nil, []byte(name))
+	for _, a := range args {
+		arg = appendArg(append(arg, ','), a)
+	}
+	s.db.feed(cmd, arg)
+}
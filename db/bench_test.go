@@ -1,7 +1,9 @@
 package db
 
 import (
+	"runtime"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -64,3 +66,127 @@ func BenchmarkDbGet(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func benchmarkDbSetGetParallel(b *testing.B, shards uint) {
+	dd, err := New(Config{
+		QueueLength: 10,
+		Shards:      shards,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dd.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	var worker int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		prefix := "name" + strconv.FormatInt(atomic.AddInt64(&worker, 1), 10) + "-"
+		i := 0
+		for pb.Next() {
+			name := []byte(prefix + strconv.Itoa(i%1024))
+			if _, err := dd.Exec(CommandSet, append(name, ",value"...)); err != nil {
+				b.Fatalf("set str, test failed %v", err)
+			}
+			if _, err := dd.Exec(CommandGet, name); err != nil {
+				b.Fatalf("get str, test failed %v", err)
+			}
+			i++
+		}
+	})
+	b.StopTimer()
+}
+
+// BenchmarkDbSetGetParallel measures single loop engine, run with -cpu 1,2,4,...
+func BenchmarkDbSetGetParallel(b *testing.B) {
+	benchmarkDbSetGetParallel(b, 1)
+}
+
+// BenchmarkDbShardedSetGetParallel measures engine with shard per CPU, its
+// throughput is expected to grow with GOMAXPROCS
+func BenchmarkDbShardedSetGetParallel(b *testing.B) {
+	benchmarkDbSetGetParallel(b, uint(runtime.GOMAXPROCS(0)))
+}
+
+// BenchmarkDbExecHGet and BenchmarkDbHGet compare allocations of Exec and
+// typed API, run with -benchmem
+func BenchmarkDbExecHGet(b *testing.B) {
+	dd := createBenchDb(b)
+	defer dd.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := dd.Exec(CommandSet, []byte("dict,key,value")); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dd.Exec(CommandGet, []byte("dict,key")); err != nil {
+			b.Fatalf("get dict key, test failed %v", err)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkDbHGet(b *testing.B) {
+	dd := createBenchDb(b)
+	defer dd.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if err := dd.HSet("dict", "key", []byte("value")); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dd.HGet("dict", "key"); err != nil {
+			b.Fatalf("hget, test failed %v", err)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkDbExecPushPop(b *testing.B) {
+	dd := createBenchDb(b)
+	defer dd.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := dd.Exec(CommandPush, []byte("list,value")); err != nil {
+			b.Fatalf("push, test failed %v", err)
+		}
+		if _, err := dd.Exec(CommandPop, []byte("list")); err != nil {
+			b.Fatalf("pop, test failed %v", err)
+		}
+	}
+	b.StopTimer()
+}
+
+func BenchmarkDbPushPop(b *testing.B) {
+	dd := createBenchDb(b)
+	defer dd.Close()
+
+	time.Sleep(10 * time.Millisecond)
+
+	value := []byte("value")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := dd.Push("list", value); err != nil {
+			b.Fatalf("push, test failed %v", err)
+		}
+		if _, err := dd.Pop("list"); err != nil {
+			b.Fatalf("pop, test failed %v", err)
+		}
+	}
+	b.StopTimer()
+}
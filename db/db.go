@@ -2,30 +2,54 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type result struct {
 	value []byte
 	err   error
+	reply Reply // typed reply, if not set value is string reply
+}
+
+// typed returns typed reply of result
+func (r result) typed() Reply {
+	if r.reply.Type == 0 {
+		return StringReply(r.value)
+	}
+	return r.reply
+}
+
+// text returns reply of result in text protocol
+func (r result) text() []byte {
+	if r.reply.Type == 0 {
+		return r.value
+	}
+	return r.reply.Text()
 }
 
 var (
-	resultOk            = result{[]byte("Ok"), nil}
-	resultNotFound      = result{nil, ErrNotFound}
-	resultInvalidFormat = result{nil, ErrInvalidFormat}
-	resultInvalidIndex  = result{nil, ErrInvalidIndex}
-	resultInvalidType   = result{nil, ErrInvalidType}
-	resultKeyNotFound   = result{nil, ErrKeyNotFound}
+	resultOk            = result{value: []byte("Ok")}
+	resultNotFound      = result{err: ErrNotFound}
+	resultInvalidFormat = result{err: ErrInvalidFormat}
+	resultInvalidIndex  = result{err: ErrInvalidIndex}
+	resultInvalidType   = result{err: ErrInvalidType}
+	resultKeyNotFound   = result{err: ErrKeyNotFound}
 )
 
 type task struct {
+	ctx context.Context // command is skipped if ctx is done, nil - never
 	cmd Command
 	arg []byte
 	ret chan result
+	fn  func()                        // executed instead of command if defined
+	op  func(s *shard, c call) result // typed call executed instead of command if defined
+	c   call
 }
 
 type key string
@@ -38,112 +62,462 @@ type value interface {
 	pop() result
 	push(k []byte) result
 	empty() bool
+	size() int
+	clone() value // deep copy
 }
 
-// A Database type implements in-memory cache engine
+// A Database type implements in-memory cache engine. Keys are distributed
+// across shards by hash of the key name, every shard has its own map and
+// engine loop, so commands on different shards are executed in parallel.
 type Database struct {
-	queue   chan task
-	started bool
+	expired uint64 // accessed atomically, first for 64-bit alignment
+	id      uint64 // order of creation by New, see Move
+	shards  []*shard
+	mu      sync.RWMutex // guards closing, held for reading while tasks are queued
 	closing bool
-	log     *log.Logger
-	m       map[key]value
-	t       map[key]*time.Timer
+	loops   sync.WaitGroup // running engine loops
+	timers  sync.WaitGroup // TTL timer callbacks in progress
+	barrier chan struct{}  // held by atomic, nil if database is not created by New
+	log     *slog.Logger
 	e       EventHandler
+	feed    Feed
+
+	eviction EvictionPolicy
+
+	scriptSteps   int
+	scriptTimeout time.Duration
+	scriptsMu     sync.Mutex
+	scripts       map[string]*script // loaded scripts by SHA1
+}
+
+// A shard represents single engine loop with its own part of keys
+type shard struct {
+	db    *Database
+	queue chan task
+	m     map[key]value
+	t     map[key]*expiry
+	u     map[key]*usage
+
+	used      int
+	maxMemory int
+	clock     uint64
+	evicted   uint64
+}
+
+// An expiry is TTL timer of single key. Timer is identified by its address,
+// so callback of replaced or stopped timer does not remove the key.
+type expiry struct {
+	*time.Timer
 }
 
-// New creates new Database instance
+// New creates new Database instance, it returns when engine loops are running
 func New(cfg Config) (*Database, error) {
 	d := &Database{
-		queue:   make(chan task, cfg.QueueLength),
-		started: false,
-		closing: false,
-		log:     cfg.Log,
-		m:       make(map[key]value, 1024),
-		t:       make(map[key]*time.Timer, 1024),
-		e:       cfg.Handler,
+		id:       atomic.AddUint64(&created, 1),
+		closing:  false,
+		barrier:  make(chan struct{}, 1),
+		log:      cfg.Log,
+		e:        cfg.Handler,
+		eviction: cfg.Eviction,
+
+		scriptSteps:   cfg.ScriptSteps,
+		scriptTimeout: cfg.ScriptTimeout,
+		scripts:       make(map[string]*script),
+	}
+
+	if d.scriptSteps <= 0 {
+		d.scriptSteps = DefaultScriptSteps
+	}
+	if d.scriptTimeout <= 0 {
+		d.scriptTimeout = DefaultScriptTimeout
 	}
 
 	if d.log == nil {
-		d.log = log.New(ioutil.Discard, "", 0)
+		d.log = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	}
+
+	n := int(cfg.Shards)
+	if n == 0 {
+		n = 1
+	}
+
+	d.shards = make([]*shard, n)
+	for i := range d.shards {
+		d.shards[i] = &shard{
+			db:    d,
+			queue: make(chan task, cfg.QueueLength),
+			m:     make(map[key]value, 1024),
+			t:     make(map[key]*expiry, 1024),
+			u:     make(map[key]*usage, 1024),
+
+			maxMemory: shardMemory(cfg.MaxMemory, n),
+		}
+	}
+
+	var running sync.WaitGroup
+	running.Add(n)
+	d.loops.Add(n)
+	for _, s := range d.shards {
+		go s.run(&running)
 	}
+	running.Wait()
 
-	go d.run()
+	d.log.Debug("database started", "shards", n, "maxmemory", cfg.MaxMemory, "eviction", d.eviction.String())
 
 	return d, nil
 }
 
-// Close closes in-memory cache database
+// Close closes in-memory cache database. Commands already queued are
+// executed, Close returns when engine loops and TTL timer callbacks in
+// progress are finished, so it must not be called from EventHandler.
 func (d *Database) Close() error {
-	d.closing = true
+	d.mu.Lock()
 
-	if d.queue == nil {
+	if d.closing {
+		d.mu.Unlock()
 		return ErrAlreadyClosed
 	}
 
-	close(d.queue)
-	d.queue = nil
+	d.closing = true
+
+	for _, s := range d.shards {
+		close(s.queue)
+	}
+	d.mu.Unlock()
+
+	d.loops.Wait()
+	d.timers.Wait()
+
+	d.log.Debug("database closed")
 
 	return nil
 }
 
 // Exec executes single command
 func (d *Database) Exec(cmd Command, arg []byte) ([]byte, error) {
+	return d.ExecContext(context.Background(), cmd, arg)
+}
 
-	if d.closing {
-		return nil, ErrAlreadyClosed
+// ExecContext executes single command. If ctx is done while command waits in
+// queue or for result, ctx error is returned, command not yet started by
+// engine loop is skipped. Command started before ctx is done still completes.
+func (d *Database) ExecContext(ctx context.Context, cmd Command, arg []byte) ([]byte, error) {
+	r := d.exec(ctx, cmd, arg)
+	return r.text(), r.err
+}
+
+// ExecReply is like ExecContext but returns typed reply, so that items of
+// array replies and missing values are distinguished
+func (d *Database) ExecReply(ctx context.Context, cmd Command, arg []byte) (Reply, error) {
+	r := d.exec(ctx, cmd, arg)
+	if r.err != nil {
+		return Reply{}, r.err
+	}
+	return r.typed(), nil
+}
+
+// exec executes single command
+func (d *Database) exec(ctx context.Context, cmd Command, arg []byte) result {
+	if err := ctx.Err(); err != nil {
+		return result{err: err}
 	}
 
-	if !d.started {
-		return nil, ErrNotStarted
+	if cmd == CommandKeys && len(arg) == 0 {
+		return d.keys(ctx)
 	}
 
-	// create channel to get result
-	ret := make(chan result)
+	switch cmd {
+	case CommandMGet, CommandMSet, CommandMRemove, CommandRename, CommandRenameNX, CommandCopy:
+		return d.multi(ctx, cmd, arg)
+	case CommandDBSize:
+		return d.dbsize(arg)
+	case CommandFlush:
+		return d.flush(arg)
+	case CommandEval, CommandEvalSHA:
+		return d.eval(ctx, cmd, arg)
+	case CommandScript:
+		return d.script(arg)
+	}
+
+	// create channel to get result, engine loop never blocks on it if
+	// caller is gone
+	ret := make(chan result, 1)
 
 	// create and send task
-	d.queue <- task{cmd: cmd, arg: arg, ret: ret}
+	if err := d.send(ctx, d.shard(FirstArg(arg)), task{ctx: ctx, cmd: cmd, arg: arg, ret: ret}); err != nil {
+		return result{err: err}
+	}
 
-	// wait for result
-	result := <-ret
+	// wait for result, result already received wins over done ctx
+	select {
+	case r := <-ret:
+		return r
+	case <-ctx.Done():
+		select {
+		case r := <-ret:
+			return r
+		default:
+			return result{err: ctx.Err()}
+		}
+	}
+}
 
-	// return result
-	return result.value, result.err
+// send puts task to shard queue. Queues are closed under write lock, so
+// task is never sent to closed queue. It gives up if ctx is done while queue
+// is full.
+func (d *Database) send(ctx context.Context, s *shard, t task) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closing {
+		return ErrAlreadyClosed
+	}
+
+	if s == nil {
+		return ErrNotStarted
+	}
+
+	select {
+	case s.queue <- t:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shard returns shard owning the key name, nil if database is not created by New
+func (d *Database) shard(name []byte) *shard {
+	if len(d.shards) == 0 {
+		return nil
+	}
+	if len(d.shards) == 1 {
+		return d.shards[0]
+	}
+
+	// FNV-1a
+	h := uint32(2166136261)
+	for _, b := range name {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+
+	return d.shards[h%uint32(len(d.shards))]
+}
+
+// atomic parks engine loops of all shards and runs fn. While fn is running
+// no other command is executed, so fn can access state of any shard directly.
+// It is used to implement commands spanning several shards.
+func (d *Database) atomic(fn func()) error {
+	return d.atomicContext(context.Background(), fn)
+}
+
+// atomicContext is like atomic but gives up if ctx is done before engine
+// loops are parked, fn is not run and loops already parked are released
+func (d *Database) atomicContext(ctx context.Context, fn func()) error {
+	if d.barrier == nil {
+		return ErrNotStarted
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case d.barrier <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-d.barrier }()
+
+	var parked sync.WaitGroup
+	release := make(chan struct{})
+	defer close(release)
+	park := func(*shard) {
+		parked.Done()
+		<-release
+	}
+
+	if err := d.broadcast(ctx, park, &parked); err != nil {
+		return err
+	}
+
+	all := make(chan struct{})
+	go func() {
+		parked.Wait()
+		close(all)
+	}()
+
+	// parked loops win over done ctx
+	select {
+	case <-all:
+	case <-ctx.Done():
+		select {
+		case <-all:
+		default:
+			return ctx.Err()
+		}
+	}
+
+	fn()
+
+	return nil
 }
 
-func (d *Database) run() {
-	d.started = true
+// broadcast sends fn to engine loop of every shard, wg is incremented for
+// every shard fn is sent to. It gives up if ctx is done while queue is full,
+// fn may be already sent to some shards then.
+func (d *Database) broadcast(ctx context.Context, fn func(s *shard), wg *sync.WaitGroup) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closing {
+		return ErrAlreadyClosed
+	}
+
+	if len(d.shards) == 0 {
+		return ErrNotStarted
+	}
+
+	for _, s := range d.shards {
+		s := s
+		wg.Add(1)
+		select {
+		case s.queue <- task{fn: func() { fn(s) }}:
+		case <-ctx.Done():
+			wg.Done()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// keys returns keys of all shards
+func (d *Database) keys(ctx context.Context) result {
+	var r result
+	if err := d.atomicContext(ctx, func() { r = d.allKeys() }); err != nil {
+		return result{err: err}
+	}
+	return r
+}
+
+// allKeys returns keys of all shards, engine loops must be parked
+func (d *Database) allKeys() result {
+	var names []Reply
+	for _, s := range d.shards {
+		names = append(names, s.keys(nil).reply.Array...)
+	}
+	return result{reply: ArrayReply(names...)}
+}
+
+// run executes tasks of shard queue until queue is closed, running is
+// marked done when loop is started
+func (s *shard) run(running *sync.WaitGroup) {
+	defer s.db.loops.Done()
+	running.Done()
+
 	for {
-		t, ok := <-d.queue
+		t, ok := <-s.queue
 		if !ok {
 			break
 		}
-		switch t.cmd {
-		case CommandNop:
-			t.ret <- resultOk
-		case CommandGet:
-			t.ret <- d.get(t.arg)
-		case CommandSet:
-			t.ret <- d.set(t.arg)
-		case CommandPush:
-			t.ret <- d.push(t.arg)
-		case CommandPop:
-			t.ret <- d.pop(t.arg)
-		case CommandRemove:
-			t.ret <- d.remove(t.arg)
-		case CommandTTL:
-			t.ret <- d.ttl(t.arg)
-		case CommandKeys:
-			t.ret <- d.keys(t.arg)
-		default:
-			t.ret <- result{nil, ErrInvalidCommand}
+		if t.fn != nil {
+			t.fn()
+			continue
+		}
+		if t.ctx != nil {
+			if err := t.ctx.Err(); err != nil {
+				t.ret <- result{err: err}
+				continue
+			}
 		}
+		if t.op != nil {
+			t.ret <- t.op(s, t.c)
+			continue
+		}
+		t.ret <- s.exec(t.cmd, t.arg)
 	}
 
-	for _, t := range d.t {
+	for _, t := range s.t {
 		t.Stop()
 	}
+}
+
+// exec executes single key command on shard, mutating command is passed to
+// Feed if it succeeds
+func (s *shard) exec(cmd Command, arg []byte) result {
+	var r result
+	switch cmd {
+	case CommandNop:
+		r = resultOk
+	case CommandGet:
+		r = s.get(arg)
+	case CommandSet:
+		r = s.set(arg)
+	case CommandPush:
+		r = s.push(arg)
+	case CommandPop:
+		r = s.pop(arg)
+	case CommandRemove:
+		r = s.remove(arg)
+	case CommandTTL:
+		r = s.ttl(arg)
+	case CommandKeys:
+		r = s.keys(arg)
+	case CommandMHGet:
+		r = s.mhget(arg)
+	case CommandMHSet:
+		r = s.mhset(arg)
+	case CommandHGetAll:
+		r = s.hgetall(arg)
+	case CommandLRange:
+		r = s.lrange(arg)
+	default:
+		r = result{err: ErrInvalidCommand}
+	}
+	if r.err == nil && s.db.feed != nil && cmd.Mutating() {
+		s.db.feed(cmd, arg)
+	}
+	return r
+}
+
+// Key returns name of the key command is applied to, or nil if command
+// has no key argument
+func Key(cmd Command, arg []byte) []byte {
+	switch {
+	case cmd == CommandNop, cmd == CommandDBSize, cmd == CommandFlush, cmd == CommandScript, len(arg) == 0:
+		return nil
+	case cmd == CommandEval, cmd == CommandEvalSHA:
+		if names := Keys(cmd, arg); len(names) > 0 {
+			return names[0]
+		}
+		return nil
+	}
+	return FirstArg(arg)
+}
+
+// FirstArg returns the first comma separated argument of command, name of
+// the key most commands are applied to, without parsing the rest. Commas
+// escaped with backslash do not separate arguments.
+func FirstArg(arg []byte) []byte {
+	slash := false
+	for i, b := range arg {
+		if slash {
+			slash = false
+			continue
+		}
+		switch b {
+		case '\\':
+			slash = true
+		case ',':
+			return unescapeArg(bytes.TrimSpace(arg[:i]))
+		}
+	}
+	return unescapeArg(bytes.TrimSpace(arg))
+}
 
-	d.started = false
+// SplitArg splits argument of command by commas not escaped with backslash,
+// spaces around arguments are trimmed and escaping is removed
+func SplitArg(arg []byte) [][]byte {
+	return parseArg(arg)
 }
 
 func parseArg(arg []byte) [][]byte {
@@ -152,26 +526,42 @@ func parseArg(arg []byte) [][]byte {
 	slash := false
 	start := 0
 	for i, b := range arg {
+		if slash {
+			slash = false
+			continue
+		}
 		switch b {
 		case '\\':
 			slash = true
 		case ',':
-			if !slash {
-				result = append(result, bytes.TrimSpace(arg[start:i]))
-				start = i + 1
-			}
-			fallthrough
-		default:
-			slash = false
+			result = append(result, unescapeArg(bytes.TrimSpace(arg[start:i])))
+			start = i + 1
 		}
 	}
 
-	result = append(result, bytes.TrimSpace(arg[start:]))
+	result = append(result, unescapeArg(bytes.TrimSpace(arg[start:])))
 
 	return result
 }
 
-func (d *Database) get(arg []byte) result {
+// unescapeArg converts escaped comma and backslash back, other backslash
+// sequences are kept as is
+func unescapeArg(a []byte) []byte {
+	if bytes.IndexByte(a, '\\') < 0 {
+		return a
+	}
+
+	r := make([]byte, 0, len(a))
+	for i := 0; i < len(a); i++ {
+		if a[i] == '\\' && i+1 < len(a) && (a[i+1] == '\\' || a[i+1] == ',') {
+			i++
+		}
+		r = append(r, a[i])
+	}
+	return r
+}
+
+func (s *shard) get(arg []byte) result {
 	if len(arg) == 0 {
 		return resultInvalidFormat
 	}
@@ -179,25 +569,29 @@ func (d *Database) get(arg []byte) result {
 	args := parseArg(arg)
 	switch len(args) {
 	case 1:
-		if v, ok := d.m[key(args[0])]; ok {
+		k := key(args[0])
+		if v, ok := s.m[k]; ok {
+			s.access(k)
 			return v.get()
 		}
 
 		return resultNotFound
 
 	case 2:
-		if v, ok := d.m[key(args[0])]; ok {
+		k := key(args[0])
+		if v, ok := s.m[k]; ok {
+			s.access(k)
 			return v.getKey(args[1])
 		}
 
 		return resultNotFound
 
 	default:
-		return result{nil, ErrInvalidFormat}
+		return result{err: ErrInvalidFormat}
 	}
 }
 
-func (d *Database) set(arg []byte) result {
+func (s *shard) set(arg []byte) result {
 	if len(arg) == 0 {
 		return resultInvalidFormat
 	}
@@ -207,23 +601,60 @@ func (d *Database) set(arg []byte) result {
 	switch len(args) {
 	case 2:
 		k := key(args[0])
-		if v, ok := d.m[k]; ok {
-			return v.set(args[1])
+		size := s.growth(k, len(args[1]))
+
+		// new list elements are reserved before resize, list which can not
+		// fit the limit is rejected without evictions
+		if l, ok := s.m[k].(*list); ok {
+			n, err := l.growth(args[1])
+			if err != nil {
+				return result{err: err}
+			}
+			if s.maxMemory > 0 && n > s.maxMemory {
+				return result{err: ErrOutOfMemory}
+			}
+			size += n
 		}
 
-		d.m[k] = str(args[1])
+		if err := s.reclaim(size); err != nil {
+			return result{err: err}
+		}
+
+		// string value is replaced, list is resized
+		if v, ok := s.m[k]; ok {
+			if _, ok := v.(str); !ok {
+				r := v.set(args[1])
+				s.update(k)
+				return r
+			}
+		}
+
+		s.m[k] = str(args[1])
+		s.update(k)
 
 		return resultOk
 
 	case 3:
 		k := key(args[0])
-		if v, ok := d.m[k]; ok {
-			return v.setKey(args[1], args[2])
+		if err := s.reclaim(s.growth(k, sizeOverhead+len(args[1])+len(args[2]))); err != nil {
+			return result{err: err}
+		}
+
+		nv := args[2]
+		if nv == nil {
+			nv = []byte{} // nil value removes field
+		}
+
+		if v, ok := s.m[k]; ok {
+			r := v.setKey(args[1], nv)
+			s.update(k)
+			return r
 		}
 
-		v := make(dict)
-		v.setKey(args[1], args[2])
-		d.m[k] = v
+		v := newDict()
+		v.setKey(args[1], nv)
+		s.m[k] = v
+		s.update(k)
 
 		return resultOk
 
@@ -232,7 +663,7 @@ func (d *Database) set(arg []byte) result {
 	}
 }
 
-func (d *Database) push(arg []byte) result {
+func (s *shard) push(arg []byte) result {
 	if len(arg) == 0 {
 		return resultInvalidFormat
 	}
@@ -241,13 +672,20 @@ func (d *Database) push(arg []byte) result {
 	switch len(args) {
 	case 2:
 		k := key(args[0])
-		if v, ok := d.m[k]; ok {
-			return v.push(args[1])
+		if err := s.reclaim(s.growth(k, sizeOverhead+len(args[1]))); err != nil {
+			return result{err: err}
+		}
+
+		if v, ok := s.m[k]; ok {
+			r := v.push(args[1])
+			s.update(k)
+			return r
 		}
 
 		v := new(list)
 		v.push(args[1])
-		d.m[k] = v
+		s.m[k] = v
+		s.update(k)
 
 		return resultOk
 
@@ -256,7 +694,7 @@ func (d *Database) push(arg []byte) result {
 	}
 }
 
-func (d *Database) pop(arg []byte) result {
+func (s *shard) pop(arg []byte) result {
 	if len(arg) == 0 {
 		return resultInvalidFormat
 	}
@@ -265,14 +703,12 @@ func (d *Database) pop(arg []byte) result {
 	switch len(args) {
 	case 1:
 		k := key(args[0])
-		if v, ok := d.m[k]; ok {
+		if v, ok := s.m[k]; ok {
 			r := v.pop()
 			if v.empty() {
-				delete(d.m, k)
-				if t, ok := d.t[k]; ok {
-					t.Stop()
-					delete(d.t, k)
-				}
+				s.drop(k)
+			} else {
+				s.update(k)
 			}
 			return r
 		}
@@ -283,7 +719,7 @@ func (d *Database) pop(arg []byte) result {
 	}
 }
 
-func (d *Database) remove(arg []byte) result {
+func (s *shard) remove(arg []byte) result {
 	if len(arg) == 0 {
 		return resultInvalidFormat
 	}
@@ -292,12 +728,8 @@ func (d *Database) remove(arg []byte) result {
 	switch len(args) {
 	case 1:
 		k := key(args[0])
-		if _, ok := d.m[k]; ok {
-			delete(d.m, k)
-			if t, ok := d.t[k]; ok {
-				t.Stop()
-				delete(d.t, k)
-			}
+		if _, ok := s.m[k]; ok {
+			s.drop(k)
 			return resultOk
 		}
 
@@ -305,8 +737,10 @@ func (d *Database) remove(arg []byte) result {
 
 	case 2:
 		k := key(args[0])
-		if v, ok := d.m[k]; ok {
-			return v.setKey(args[1], nil)
+		if v, ok := s.m[k]; ok {
+			r := v.setKey(args[1], nil)
+			s.update(k)
+			return r
 		}
 
 		return resultNotFound
@@ -316,7 +750,7 @@ func (d *Database) remove(arg []byte) result {
 	}
 }
 
-func (d *Database) ttl(arg []byte) result {
+func (s *shard) ttl(arg []byte) result {
 	if len(arg) == 0 {
 		return resultInvalidFormat
 	}
@@ -326,30 +760,15 @@ func (d *Database) ttl(arg []byte) result {
 	case 2:
 		timeout, err := strconv.ParseUint(string(args[1]), 10, 64)
 		if err != nil {
-			return result{nil, err}
+			return result{err: err}
 		}
 
 		k := key(args[0])
-		if _, ok := d.m[k]; !ok {
+		if _, ok := s.m[k]; !ok {
 			return resultNotFound
 		}
 
-		duration := time.Millisecond * time.Duration(timeout)
-		if t, ok := d.t[k]; ok {
-			if !t.Stop() {
-				<-t.C
-			}
-			t.Reset(duration)
-		} else {
-			t := time.AfterFunc(duration, func() {
-				k := args[0]
-				d.Exec(CommandRemove, k)
-				if d.e != nil {
-					d.e(EventExpired, k)
-				}
-			})
-			d.t[k] = t
-		}
+		s.expire(k, time.Millisecond*time.Duration(timeout))
 
 		return resultOk
 
@@ -358,46 +777,87 @@ func (d *Database) ttl(arg []byte) result {
 	}
 }
 
-func (d *Database) keys(arg []byte) result {
+// expire starts or restarts TTL timer of existing key k
+func (s *shard) expire(k key, duration time.Duration) {
+	if u, ok := s.u[k]; ok {
+		u.expire = time.Now().Add(duration)
+	}
+	if t, ok := s.t[k]; ok {
+		t.Stop()
+	}
+
+	e := &expiry{}
+	e.Timer = time.AfterFunc(duration, func() { s.expired(k, e) })
+	s.t[k] = e
+}
+
+// expired is called by TTL timer e of the key k, it removes the key unless
+// timer is replaced or stopped meanwhile, or database is closing
+func (s *shard) expired(k key, e *expiry) {
+	d := s.db
+
+	d.mu.RLock()
+	if d.closing {
+		d.mu.RUnlock()
+		return
+	}
+	d.timers.Add(1)
+	d.mu.RUnlock()
+	defer d.timers.Done()
+
+	removed := make(chan bool, 1)
+	err := d.send(context.Background(), s, task{fn: func() {
+		if s.t[k] != e {
+			removed <- false
+			return
+		}
+		s.drop(k)
+		atomic.AddUint64(&d.expired, 1)
+		if d.feed != nil {
+			d.feed(CommandRemove, appendArg(nil, []byte(k)))
+		}
+		removed <- true
+	}})
+	if err != nil || !<-removed {
+		return
+	}
+
+	d.log.Debug("key expired", "key", string(k))
+	if d.e != nil {
+		d.e(EventExpired, []byte(k))
+	}
+}
+
+func (s *shard) keys(arg []byte) result {
 	if arg == nil || bytes.Equal(arg, []byte("")) {
-		var r []byte
-		var first = false
-		for k := range d.m {
-			if first {
-				r = append(r, ',')
-			} else {
-				first = true
-			}
-			r = append(r, k...)
+		names := make([]Reply, 0, len(s.m))
+		for k := range s.m {
+			names = append(names, StringReply([]byte(k)))
 		}
-		return result{r, nil}
+		return result{reply: ArrayReply(names...)}
 	}
 
 	args := parseArg(arg)
 	switch len(args) {
 	case 1:
-		v, ok := d.m[key(args[0])]
+		k := key(args[0])
+		v, ok := s.m[k]
 		if !ok {
 			return resultNotFound
 		}
 
-		dv, ok := v.(dict)
+		dv, ok := v.(*dict)
 		if !ok {
 			return resultNotFound
 		}
+		s.access(k)
 
-		var r []byte
-		var first = false
-		for k := range dv {
-			if first {
-				r = append(r, ',')
-			} else {
-				first = true
-			}
-			r = append(r, k...)
+		names := make([]Reply, 0, len(dv.m))
+		for k := range dv.m {
+			names = append(names, StringReply([]byte(k)))
 		}
 
-		return result{r, nil}
+		return result{reply: ArrayReply(names...)}
 
 	default:
 		return resultInvalidFormat
@@ -2,11 +2,14 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -25,12 +28,11 @@ func (t *testLog) Write(p []byte) (n int, err error) {
 func createDb(t *testing.T) *Database {
 	d, err := New(Config{
 		QueueLength: 10,
-		Log:         log.New(&testLog{t}, "", log.LstdFlags|log.Lmicroseconds),
+		Log:         slog.New(slog.NewTextHandler(&testLog{t}, &slog.HandlerOptions{Level: slog.LevelDebug})),
 	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	time.Sleep(time.Millisecond)
 	return d
 }
 
@@ -43,12 +45,6 @@ func TestDatabaseCreateClose(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	time.Sleep(time.Millisecond)
-
-	if !dd.started {
-		t.Fatal("database is not started")
-	}
-
 	if _, err := dd.Exec(CommandNop, nil); err != nil {
 		t.Errorf("failed execute command 'nop', err = %v", err)
 	}
@@ -61,9 +57,8 @@ func TestDatabaseCreateClose(t *testing.T) {
 		t.Errorf("failed execute command 'ttl a,N', err = %v", err)
 	}
 
-	dd.Close()
-	if !dd.started {
-		t.Errorf("database is started")
+	if err := dd.Close(); err != nil {
+		t.Errorf("db close failed with %v", err)
 	}
 
 	if err := dd.Close(); err != ErrAlreadyClosed {
@@ -259,14 +254,16 @@ func TestDatabaseString(t *testing.T) {
 		result string
 		err    error
 	}{
-		{CommandSet, "str,1", "Ok", nil},                // create string key 'str'->'1'
-		{CommandGet, "str", "1", nil},                   // get string key '1'
-		{CommandSet, "str,2", "Ok", nil},                // modify string key 'str'->'2'
-		{CommandGet, "str", "2", nil},                   // get string key '2'
-		{CommandRemove, "str", "Ok", nil},               // remove string key
-		{CommandGet, "str", "", ErrNotFound},            // get removed string key
-		{CommandSet, "str a\\,bc,\\,cde\\,", "Ok", nil}, // set string value with commas
-		{CommandGet, "str a\\,bc", "\\,cde\\,", nil},    // get string value with commas
+		{CommandSet, "str,1", "Ok", nil},                 // create string key 'str'->'1'
+		{CommandGet, "str", "1", nil},                    // get string key '1'
+		{CommandSet, "str,2", "Ok", nil},                 // modify string key 'str'->'2'
+		{CommandGet, "str", "2", nil},                    // get string key '2'
+		{CommandRemove, "str", "Ok", nil},                // remove string key
+		{CommandGet, "str", "", ErrNotFound},             // get removed string key
+		{CommandSet, "str a\\,bc,\\,cde\\,", "Ok", nil},  // set string value with commas
+		{CommandGet, "str a\\,bc", ",cde,", nil},         // get string value with commas
+		{CommandSet, "str\\\\x,a\\\\\\,b\\n", "Ok", nil}, // set value with escaped backslash
+		{CommandGet, "str\\\\x", "a\\,b\\n", nil},        // get value with backslash
 	}
 
 	for i, test := range tests {
@@ -378,11 +375,14 @@ func TestDatabaseTtl(t *testing.T) {
 	defer dd.Close()
 
 	var (
+		mu          sync.Mutex // event is raised by timer goroutine
 		evtReceived = false
 		evt         Event
 		evtName     string
 	)
 	dd.e = func(e Event, name []byte) {
+		mu.Lock()
+		defer mu.Unlock()
 		evtReceived = true
 		evt = e
 		evtName = string(name)
@@ -402,6 +402,7 @@ func TestDatabaseTtl(t *testing.T) {
 		t.Error("found str value after expired ttl")
 	}
 
+	mu.Lock()
 	if !evtReceived || evt != EventExpired || evtName != "str" {
 		t.Errorf("event problem: rcvd = %v, evt = %v, name = %s",
 			evtReceived, evt, evtName)
@@ -409,6 +410,7 @@ func TestDatabaseTtl(t *testing.T) {
 
 	evtReceived = false
 	evtName = ""
+	mu.Unlock()
 
 	// create list var
 	if _, err := dd.Exec(CommandPush, []byte("list, value")); err != nil {
@@ -432,6 +434,8 @@ func TestDatabaseTtl(t *testing.T) {
 		t.Errorf("failed set pop list value: %v", err)
 	}
 
+	mu.Lock()
+	defer mu.Unlock()
 	if evtReceived || evtName == "list" {
 		t.Errorf("event problem after list pop: rcvd = %v, evt = %v, name = %s",
 			evtReceived, evt, evtName)
@@ -443,11 +447,14 @@ func TestDatabaseTtlExpireAfterChange(t *testing.T) {
 	defer dd.Close()
 
 	var (
+		mu          sync.Mutex // event is raised by timer goroutine
 		evtReceived = false
 		evt         Event
 		evtName     string
 	)
 	dd.e = func(e Event, name []byte) {
+		mu.Lock()
+		defer mu.Unlock()
 		evtReceived = true
 		evt = e
 		evtName = string(name)
@@ -474,10 +481,12 @@ func TestDatabaseTtlExpireAfterChange(t *testing.T) {
 		t.Error("found str value after expired ttl")
 	}
 
+	mu.Lock()
 	if !evtReceived || evt != EventExpired || evtName != "str" {
 		t.Errorf("event problem: rcvd = %v, evt = %v, name = %s",
 			evtReceived, evt, evtName)
 	}
+	mu.Unlock()
 }
 
 func TestDatabaseKeys(t *testing.T) {
@@ -505,3 +514,1397 @@ func TestDatabaseKeys(t *testing.T) {
 		t.Fatalf("keys failed with value %v", str)
 	}
 }
+
+func createLimitedDb(t *testing.T, limit uint64, policy EvictionPolicy) *Database {
+	d, err := New(Config{
+		QueueLength: 10,
+		Log:         slog.New(slog.NewTextHandler(&testLog{t}, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		MaxMemory:   limit,
+		Eviction:    policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDatabaseMemoryAccounting(t *testing.T) {
+	dd := createDb(t)
+	defer dd.Close()
+
+	var cmds = []struct {
+		cmd Command
+		arg string
+	}{
+		{CommandSet, "str,value"},
+		{CommandSet, "dict,key1,value1"},
+		{CommandSet, "dict,key2,value2"},
+		{CommandSet, "dict,key1,v"},
+		{CommandPush, "list,1"},
+		{CommandPush, "list,22"},
+		{CommandSet, "list,0,333"},
+		{CommandSet, "list,5"},
+		{CommandSet, "list,1"},
+		{CommandRemove, "dict,key2"},
+	}
+
+	for i, test := range cmds {
+		if _, err := dd.Exec(test.cmd, []byte(test.arg)); err != nil {
+			t.Fatalf("[%d] - '%s %s' failed with %v", i, test.cmd, test.arg, err)
+		}
+	}
+
+	used := dd.shards[0].used
+	want := 3*keyOverhead + len("str") + len("dict") + len("list") +
+		len("value") +
+		sizeOverhead + len("key1") + len("v") +
+		sizeOverhead + len("333")
+	if used != want {
+		t.Errorf("used memory = %d, expected %d", used, want)
+	}
+
+	dd.Exec(CommandRemove, []byte("str"))
+	dd.Exec(CommandRemove, []byte("dict"))
+	dd.Exec(CommandPop, []byte("list"))
+
+	if dd.shards[0].used != 0 || len(dd.shards[0].u) != 0 {
+		t.Errorf("used memory = %d (%d keys) after removing all keys", dd.shards[0].used, len(dd.shards[0].u))
+	}
+}
+
+func TestDatabaseNoEviction(t *testing.T) {
+	// enough memory for 2 keys
+	dd := createLimitedDb(t, uint64(2*(keyOverhead+len("str0")+len("value"))), EvictionNone)
+	defer dd.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, err := dd.Exec(CommandSet, []byte("str"+strconv.Itoa(i)+",value")); err != nil {
+			t.Fatalf("set failed with %v", err)
+		}
+	}
+
+	if _, err := dd.Exec(CommandSet, []byte("str2,value")); err != ErrOutOfMemory {
+		t.Errorf("set over memory limit returned %v, expected %v", err, ErrOutOfMemory)
+	}
+
+	if _, err := dd.Exec(CommandGet, []byte("str0")); err != nil {
+		t.Errorf("get over memory limit failed with %v", err)
+	}
+
+	dd.Exec(CommandRemove, []byte("str0"))
+
+	if _, err := dd.Exec(CommandSet, []byte("str2,value")); err != nil {
+		t.Errorf("set after remove failed with %v", err)
+	}
+
+	// size of written value is counted
+	if _, err := dd.Exec(CommandSet, []byte("str1,"+strings.Repeat("x", 1<<20))); err != ErrOutOfMemory {
+		t.Errorf("set of large value returned %v, expected %v", err, ErrOutOfMemory)
+	}
+	if err := dd.HSet("dict", "f", make([]byte, 1<<20)); err != ErrOutOfMemory {
+		t.Errorf("hset of large value returned %v, expected %v", err, ErrOutOfMemory)
+	}
+	if r, err := dd.Exec(CommandGet, []byte("str1")); err != nil || string(r) != "value" {
+		t.Errorf("value replaced over memory limit, get replied '%s' (%v)", r, err)
+	}
+	if dd.shards[0].used > dd.shards[0].maxMemory {
+		t.Errorf("used memory %d is over limit %d", dd.shards[0].used, dd.shards[0].maxMemory)
+	}
+
+	// shorter value fits
+	if _, err := dd.Exec(CommandSet, []byte("str1,v")); err != nil {
+		t.Errorf("set of shorter value failed with %v", err)
+	}
+	if r, _ := dd.Exec(CommandGet, []byte("str1")); string(r) != "v" {
+		t.Errorf("get of replaced value replied '%s'", r)
+	}
+}
+
+func TestDatabaseListResize(t *testing.T) {
+	dd := createLimitedDb(t, 1000, EvictionAllKeysLRU)
+	defer dd.Close()
+
+	dd.Exec(CommandSet, []byte("a,value"))
+	dd.Exec(CommandPush, []byte("l,x"))
+
+	var tests = []struct {
+		arg string
+		err error
+	}{
+		{"l,10", nil},
+		{"l,1000", ErrOutOfMemory},
+		{"l,18446744073709551615", ErrInvalidIndex},
+		{"l,1", nil},
+	}
+
+	for i, test := range tests {
+		if _, err := dd.Exec(CommandSet, []byte(test.arg)); err != test.err {
+			t.Errorf("[%d] set %s returned %v, expected %v", i, test.arg, err, test.err)
+		}
+	}
+
+	// list which can not fit the limit does not evict other keys
+	if r, err := dd.Exec(CommandGet, []byte("a")); err != nil || string(r) != "value" {
+		t.Errorf("get replied '%s' (%v), expected 'value'", r, err)
+	}
+	if r, err := dd.Exec(CommandGet, []byte("l")); err != nil || string(r) != "1" {
+		t.Errorf("list length is '%s' (%v), expected 1", r, err)
+	}
+
+	dd.SetMaxMemory(0)
+	if _, err := dd.Exec(CommandSet, []byte("l,18446744073709551615")); err != ErrInvalidIndex {
+		t.Errorf("set of huge list size without limit returned %v", err)
+	}
+}
+
+func TestDatabaseMemoryShards(t *testing.T) {
+	dd, err := New(Config{QueueLength: 10, Shards: 4, MaxMemory: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	if _, err := dd.Exec(CommandSet, []byte("key,value")); err != ErrOutOfMemory {
+		t.Errorf("set over limit smaller than number of shards returned %v", err)
+	}
+
+	if err := dd.SetMaxMemory(2); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range dd.shards {
+		if s.maxMemory != 1 {
+			t.Errorf("shard limit is %d, expected: 1", s.maxMemory)
+		}
+	}
+
+	if err := dd.SetMaxMemory(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dd.Exec(CommandSet, []byte("key,value")); err != nil {
+		t.Errorf("set without limit failed with %v", err)
+	}
+}
+
+func TestDatabaseEviction(t *testing.T) {
+	var tests = []struct {
+		policy  EvictionPolicy
+		evicted string
+	}{
+		{EvictionAllKeysLRU, "b"},
+		{EvictionAllKeysLFU, "d"},
+		{EvictionVolatileLRU, "c"},
+		{EvictionRandom, ""},
+	}
+
+	for i, test := range tests {
+		// enough memory for 4 keys
+		dd := createLimitedDb(t, uint64(4*(keyOverhead+len("a")+len("value"))), test.policy)
+
+		var evicted []string
+		dd.e = func(e Event, name []byte) {
+			if e == EventEvicted {
+				evicted = append(evicted, string(name))
+			}
+		}
+
+		dd.Exec(CommandSet, []byte("a,value"))
+		dd.Exec(CommandSet, []byte("b,value"))
+		dd.Exec(CommandSet, []byte("c,value"))
+		dd.Exec(CommandTTL, []byte("c,1000000"))
+		dd.Exec(CommandGet, []byte("b"))
+		dd.Exec(CommandGet, []byte("b"))
+		dd.Exec(CommandGet, []byte("c"))
+		dd.Exec(CommandSet, []byte("d,value"))
+		dd.Exec(CommandGet, []byte("a"))
+
+		if _, err := dd.Exec(CommandSet, []byte("e,value")); err != nil {
+			t.Errorf("[%d] %s - set failed with %v", i, test.policy, err)
+		}
+
+		if len(evicted) != 1 || (test.evicted != "" && evicted[0] != test.evicted) {
+			t.Errorf("[%d] %s - evicted %v, expected [%s]", i, test.policy, evicted, test.evicted)
+		}
+
+		if _, err := dd.Exec(CommandGet, []byte(evicted[0])); err != ErrNotFound {
+			t.Errorf("[%d] %s - evicted key '%s' found", i, test.policy, evicted[0])
+		}
+
+		dd.Close()
+	}
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	for _, p := range []EvictionPolicy{EvictionNone, EvictionAllKeysLRU,
+		EvictionAllKeysLFU, EvictionVolatileLRU, EvictionRandom} {
+		if r, err := ParseEvictionPolicy(p.String()); r != p || err != nil {
+			t.Errorf("ParseEvictionPolicy('%s') = %v, %v", p, r, err)
+		}
+	}
+
+	if _, err := ParseEvictionPolicy("unknown"); err != ErrInvalidPolicy {
+		t.Errorf("ParseEvictionPolicy('unknown') returned %v", err)
+	}
+}
+
+func TestDatabaseSharded(t *testing.T) {
+	dd, err := New(Config{
+		QueueLength: 10,
+		Shards:      4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	time.Sleep(time.Millisecond)
+
+	var names []string
+	for i := 0; i < 100; i++ {
+		name := "name" + strconv.Itoa(i)
+		names = append(names, name)
+		if _, err := dd.Exec(CommandSet, []byte(name+",value"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("set %s failed with %v", name, err)
+		}
+	}
+
+	for i, name := range names {
+		if r, err := dd.Exec(CommandGet, []byte(name)); err != nil || string(r) != "value"+strconv.Itoa(i) {
+			t.Errorf("get %s failed with '%s' (%v)", name, r, err)
+		}
+	}
+
+	for i, s := range dd.shards {
+		if len(s.m) == 0 {
+			t.Errorf("shard %d is empty", i)
+		}
+	}
+
+	r, err := dd.Exec(CommandKeys, nil)
+	if err != nil {
+		t.Fatalf("keys failed with %v", err)
+	}
+
+	keys := strings.Split(string(r), ",")
+	sort.Strings(keys)
+	sort.Strings(names)
+	if strings.Join(keys, ",") != strings.Join(names, ",") {
+		t.Errorf("keys failed with value %s", r)
+	}
+
+	if _, err := dd.Exec(CommandTTL, []byte("name1,1")); err != nil {
+		t.Errorf("ttl failed with %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := dd.Exec(CommandGet, []byte("name1")); err != ErrNotFound {
+		t.Errorf("found name1 value after expired ttl, err = %v", err)
+	}
+}
+
+func TestDatabaseShardedConcurrent(t *testing.T) {
+	dd, err := New(Config{
+		QueueLength: 10,
+		Shards:      4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	time.Sleep(time.Millisecond)
+
+	done := make(chan struct{})
+	for w := 0; w < 8; w++ {
+		go func(w int) {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 100; i++ {
+				name := "list" + strconv.Itoa(i%10)
+				if _, err := dd.Exec(CommandPush, []byte(name+","+strconv.Itoa(w))); err != nil {
+					t.Errorf("push %s failed with %v", name, err)
+				}
+				if i%10 == 0 {
+					if _, err := dd.Exec(CommandKeys, nil); err != nil {
+						t.Errorf("keys failed with %v", err)
+					}
+				}
+			}
+		}(w)
+	}
+
+	for w := 0; w < 8; w++ {
+		<-done
+	}
+
+	for i := 0; i < 10; i++ {
+		name := "list" + strconv.Itoa(i)
+		if r, err := dd.Exec(CommandGet, []byte(name)); err != nil || string(r) != "80" {
+			t.Errorf("get %s failed with '%s' (%v), expected: '80'", name, r, err)
+		}
+	}
+}
+
+func TestDatabaseStats(t *testing.T) {
+	dd, err := New(Config{
+		QueueLength: 10,
+		Shards:      4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	time.Sleep(time.Millisecond)
+
+	for _, c := range []struct {
+		cmd Command
+		arg string
+	}{
+		{CommandSet, "str1,value"},
+		{CommandSet, "str2,value"},
+		{CommandSet, "dict,key,value"},
+		{CommandPush, "list,value"},
+		{CommandTTL, "str1,1"},
+		{CommandTTL, "dict,100000"},
+	} {
+		if _, err := dd.Exec(c.cmd, []byte(c.arg)); err != nil {
+			t.Fatalf("%v %s failed with %v", c.cmd, c.arg, err)
+		}
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	s, err := dd.Stats()
+	if err != nil {
+		t.Fatalf("stats failed with %v", err)
+	}
+
+	if s.Strings != 1 || s.Dicts != 1 || s.Lists != 1 {
+		t.Errorf("stats keys %d,%d,%d, expected 1,1,1", s.Strings, s.Dicts, s.Lists)
+	}
+	if s.Expiring != 1 || s.Expired != 1 {
+		t.Errorf("stats expiring %d, expired %d, expected 1, 1", s.Expiring, s.Expired)
+	}
+	if s.Memory <= 0 {
+		t.Errorf("stats memory %d, expected positive", s.Memory)
+	}
+}
+
+func TestDatabaseInfo(t *testing.T) {
+	dd := createDb(t)
+	defer dd.Close()
+
+	if _, err := dd.Exec(CommandSet, []byte("dict,key,value")); err != nil {
+		t.Fatalf("set failed with %v", err)
+	}
+
+	var infoTests = []struct {
+		section string
+		wants   string
+	}{
+		{"keyspace", "str_keys:0\ndict_keys:1\nlist_keys:0\nexpiring_keys:0\nexpired_keys:0\nevicted_keys:0\n"},
+		{"persistence", ""},
+		{"config", "shards:1\nqueue_length:10\n"},
+	}
+
+	for _, test := range infoTests {
+		if r, err := dd.Info(test.section); test.wants == "" {
+			if err != ErrInvalidFormat {
+				t.Errorf("info %s returned '%s' (%v), expected: %v", test.section, r, err, ErrInvalidFormat)
+			}
+		} else if err != nil || string(r) != test.wants {
+			t.Errorf("info %s failed with '%s' (%v), expected: '%s'", test.section, r, err, test.wants)
+		}
+	}
+
+	r, err := dd.Info("memory")
+	if err != nil || !strings.HasSuffix(string(r), "maxmemory:0\nmaxmemory_policy:noeviction\n") {
+		t.Errorf("info memory failed with '%s' (%v)", r, err)
+	}
+
+	if _, err := dd.Info("unknown"); err != ErrInvalidFormat {
+		t.Errorf("info unknown failed with %v, expected: %v", err, ErrInvalidFormat)
+	}
+}
+
+func TestDatabaseTyped(t *testing.T) {
+	dd := createDb(t)
+	defer dd.Close()
+
+	var fed []string
+	if err := dd.SetFeed(func(cmd Command, arg []byte) {
+		fed = append(fed, cmd.String()+" "+string(arg))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	value := []byte("value")
+	if err := dd.Set("str", value); err != nil {
+		t.Fatalf("set failed with %v", err)
+	}
+	value[0] = 'V'
+	if v, err := dd.Get("str"); err != nil || string(v) != "value" {
+		t.Errorf("get returned '%s' (%v)", v, err)
+	}
+	if v, err := dd.Exec(CommandGet, []byte("str")); err != nil || string(v) != "value" {
+		t.Errorf("exec get returned '%s' (%v)", v, err)
+	}
+	if err := dd.Set("str", []byte("x")); err != nil {
+		t.Fatalf("set failed with %v", err)
+	}
+	if v, err := dd.Get("str"); err != nil || string(v) != "x" {
+		t.Errorf("get returned '%s' (%v)", v, err)
+	}
+
+	if err := dd.HSet("dict", "key", []byte("value")); err != nil {
+		t.Fatalf("hset failed with %v", err)
+	}
+	if v, err := dd.HGet("dict", "key"); err != nil || string(v) != "value" {
+		t.Errorf("hget returned '%s' (%v)", v, err)
+	}
+	if v, err := dd.Exec(CommandGet, []byte("dict,key")); err != nil || string(v) != "value" {
+		t.Errorf("exec get returned '%s' (%v)", v, err)
+	}
+	if _, err := dd.HGet("dict", "none"); err != ErrKeyNotFound {
+		t.Errorf("hget of unknown field failed with %v, expected: %v", err, ErrKeyNotFound)
+	}
+	if n, err := dd.Len("dict"); err != nil || n != 1 {
+		t.Errorf("len returned %d (%v)", n, err)
+	}
+	if err := dd.HDel("dict", "key"); err != nil {
+		t.Errorf("hdel failed with %v", err)
+	}
+	if n, err := dd.Len("dict"); err != nil || n != 0 {
+		t.Errorf("len returned %d (%v)", n, err)
+	}
+
+	for _, v := range []string{"a", "b"} {
+		if err := dd.Push("list", []byte(v)); err != nil {
+			t.Fatalf("push failed with %v", err)
+		}
+	}
+	if n, err := dd.Len("list"); err != nil || n != 2 {
+		t.Errorf("len returned %d (%v)", n, err)
+	}
+	if v, err := dd.Pop("list"); err != nil || string(v) != "b" {
+		t.Errorf("pop returned '%s' (%v)", v, err)
+	}
+
+	errs := []struct {
+		name string
+		err  error
+		exp  error
+	}{
+		{"get dict", func() error { _, err := dd.Get("dict"); return err }(), ErrInvalidType},
+		{"get none", func() error { _, err := dd.Get("none"); return err }(), ErrNotFound},
+		{"len str", func() error { _, err := dd.Len("str"); return err }(), ErrInvalidType},
+		{"set list", dd.Set("list", []byte("x")), ErrInvalidType},
+		{"hget str", func() error { _, err := dd.HGet("str", "key"); return err }(), ErrInvalidType},
+		{"hset list", dd.HSet("list", "key", []byte("x")), ErrInvalidType},
+		{"hdel none", dd.HDel("none", "key"), ErrNotFound},
+		{"push str", dd.Push("str", []byte("x")), ErrInvalidType},
+		{"pop dict", func() error { _, err := dd.Pop("dict"); return err }(), ErrInvalidType},
+		{"remove none", dd.Remove("none"), ErrNotFound},
+		{"expire none", dd.Expire("none", time.Second), ErrNotFound},
+	}
+	for _, e := range errs {
+		if e.err != e.exp {
+			t.Errorf("%s failed with %v, expected: %v", e.name, e.err, e.exp)
+		}
+	}
+
+	if err := dd.Expire("str", time.Millisecond); err != nil {
+		t.Errorf("expire failed with %v", err)
+	}
+	if err := dd.Remove("list"); err != nil {
+		t.Errorf("remove failed with %v", err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := dd.Get("str"); err != ErrNotFound {
+		t.Errorf("get of expired key failed with %v, expected: %v", err, ErrNotFound)
+	}
+
+	if err := dd.SetFeed(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"set str,value",
+		"set str,x",
+		"set dict,key,value",
+		"remove dict,key",
+		"push list,a",
+		"push list,b",
+		"pop list",
+		"ttl str,1",
+		"remove list",
+		"remove str",
+	}
+	if strings.Join(fed, "|") != strings.Join(expected, "|") {
+		t.Errorf("fed commands %q, expected: %q", fed, expected)
+	}
+}
+
+func TestDatabaseExecContext(t *testing.T) {
+	dd := createDb(t)
+	defer dd.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dd.ExecContext(ctx, CommandSet, []byte("str,value")); err != context.Canceled {
+		t.Errorf("set with cancelled context failed with %v, expected: %v", err, context.Canceled)
+	}
+
+	// park engine loop, command waits in queue until deadline
+	parked, release := make(chan struct{}), make(chan struct{})
+	go dd.atomic(func() {
+		close(parked)
+		<-release
+	})
+	<-parked
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := dd.ExecContext(ctx, CommandSet, []byte("str,value")); err != context.DeadlineExceeded {
+		t.Errorf("set on parked database failed with %v, expected: %v", err, context.DeadlineExceeded)
+	}
+
+	// commands parking all engine loops give up waiting too
+	for _, test := range []struct {
+		cmd Command
+		arg string
+	}{
+		{CommandKeys, ""},
+		{CommandEval, "(get $1), str"},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if _, err := dd.ExecContext(ctx, test.cmd, []byte(test.arg)); err != context.DeadlineExceeded {
+			t.Errorf("%v on parked database failed with %v, expected: %v", test.cmd, err, context.DeadlineExceeded)
+		}
+		cancel()
+	}
+
+	close(release)
+
+	// expired command is skipped by engine loop
+	if _, err := dd.Exec(CommandGet, []byte("str")); err != ErrNotFound {
+		t.Errorf("get of skipped set failed with %v, expected: %v", err, ErrNotFound)
+	}
+
+	if _, err := dd.ExecContext(context.Background(), CommandSet, []byte("str,value")); err != nil {
+		t.Errorf("set failed with %v", err)
+	}
+}
+
+func TestDatabaseNotStarted(t *testing.T) {
+	var dd Database
+	if _, err := dd.Exec(CommandGet, []byte("name")); err != ErrNotStarted {
+		t.Errorf("exec on zero database failed with %v, expected: %v", err, ErrNotStarted)
+	}
+	if _, err := dd.Stats(); err != ErrNotStarted {
+		t.Errorf("stats on zero database failed with %v, expected: %v", err, ErrNotStarted)
+	}
+}
+
+func TestDatabaseCloseConcurrent(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		var events int64
+		dd, err := New(Config{
+			QueueLength: 1,
+			Shards:      4,
+			Handler:     func(e Event, name []byte) { atomic.AddInt64(&events, 1) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			wg   sync.WaitGroup
+			stop = make(chan struct{})
+		)
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+
+				for n := 0; ; n++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					name := fmt.Sprintf("key%d-%d", w, n%16)
+					errs := []error{
+						func() error { _, err := dd.Exec(CommandSet, []byte(name+",value")); return err }(),
+						func() error { _, err := dd.Exec(CommandTTL, []byte(name+",1")); return err }(),
+						dd.Push(name+"list", []byte("value")),
+						func() error { _, err := dd.Stats(); return err }(),
+						func() error { _, err := dd.Exec(CommandKeys, nil); return err }(),
+					}
+					for _, err := range errs {
+						if err != nil && err != ErrAlreadyClosed && err != ErrNotFound {
+							t.Errorf("command failed with %v", err)
+							return
+						}
+					}
+				}
+			}(w)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+
+		if err := dd.Close(); err != nil {
+			t.Fatalf("close failed with %v", err)
+		}
+
+		// no TTL timer callback is running or started after Close
+		fired := atomic.LoadInt64(&events)
+		time.Sleep(5 * time.Millisecond)
+		if n := atomic.LoadInt64(&events); n != fired {
+			t.Errorf("%d events raised after close", n-fired)
+		}
+
+		if _, err := dd.Exec(CommandNop, nil); err != ErrAlreadyClosed {
+			t.Errorf("exec after close failed with %v, expected: %v", err, ErrAlreadyClosed)
+		}
+		if err := dd.Set("name", nil); err != ErrAlreadyClosed {
+			t.Errorf("set after close failed with %v, expected: %v", err, ErrAlreadyClosed)
+		}
+
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestDatabaseTtlReset(t *testing.T) {
+	dd := createDb(t)
+	defer dd.Close()
+
+	// reset of TTL while previous timer fires must not block engine loop
+	// and stale timer must not remove the key
+	for i := 0; i < 100; i++ {
+		if _, err := dd.Exec(CommandSet, []byte("str,value")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dd.Exec(CommandTTL, []byte("str,0")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dd.Exec(CommandTTL, []byte("str,100000")); err != nil && err != ErrNotFound {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := dd.Exec(CommandSet, []byte("str,value")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dd.Exec(CommandTTL, []byte("str,1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dd.Exec(CommandTTL, []byte("str,100000")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := dd.Exec(CommandGet, []byte("str")); err != nil {
+		t.Errorf("key with reset TTL is removed by stale timer: %v", err)
+	}
+}
+
+func TestDatabaseMulti(t *testing.T) {
+	for _, shards := range []uint{1, 4} {
+		dd, err := New(Config{QueueLength: 10, Shards: shards})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var tests = []struct {
+			cmd   Command
+			arg   string
+			reply string
+			err   error
+		}{
+			{CommandMSet, "a,1,b,,c,x\\,y", "$Ok", nil},
+			{CommandMGet, "a,b,c,none", "*4,$1,$,$x\\,y,_", nil},
+			{CommandMSet, "a,1,b", "", ErrInvalidFormat},
+			{CommandMGet, "", "", ErrInvalidFormat},
+			{CommandPush, "list,value", "$Ok", nil},
+			{CommandMSet, "a,2,list,value", "", ErrInvalidType},
+			{CommandMGet, "a,list", "*2,$1,_", nil},
+			{CommandMHSet, "dict,f1,v1,f2,", "$Ok", nil},
+			{CommandMHGet, "dict,f1,f2,f3", "*3,$v1,$,_", nil},
+			{CommandMHSet, "dict,f1", "", ErrInvalidFormat},
+			{CommandMHSet, "list,f1,v1", "", ErrInvalidType},
+			{CommandMHGet, "none,f1", "", ErrNotFound},
+			{CommandMRemove, "a,b,none", ":2", nil},
+			{CommandMGet, "a,b,c", "*3,_,_,$x\\,y", nil},
+		}
+
+		for _, test := range tests {
+			r, err := dd.ExecReply(context.Background(), test.cmd, []byte(test.arg))
+			if err != test.err || (err == nil && string(r.Typed()) != test.reply) {
+				t.Errorf("%d shards: %v %s replied '%s' (%v), expected: '%s' (%v)",
+					shards, test.cmd, test.arg, r.Typed(), err, test.reply, test.err)
+			}
+		}
+
+		dd.Close()
+	}
+}
+
+func TestDatabaseMSetEviction(t *testing.T) {
+	dd := createLimitedDb(t, 1000, EvictionAllKeysLRU)
+	defer dd.Close()
+
+	var evicted []string
+	dd.e = func(e Event, name []byte) {
+		if e == EventEvicted {
+			evicted = append(evicted, string(name))
+		}
+	}
+
+	dd.Exec(CommandSet, []byte("a,value"))
+	dd.Exec(CommandPush, []byte("list,value"))
+
+	// type of later key is checked before memory is reclaimed for first one
+	if _, err := dd.Exec(CommandMSet, []byte("b,"+strings.Repeat("x", 800)+",list,value")); err != ErrInvalidType {
+		t.Errorf("mset returned %v, expected %v", err, ErrInvalidType)
+	}
+	if len(evicted) != 0 {
+		t.Errorf("failed mset evicted %v", evicted)
+	}
+
+	if _, err := dd.Exec(CommandMSet, []byte("b,"+strings.Repeat("x", 800))); err != nil {
+		t.Errorf("mset failed with %v", err)
+	}
+	if len(evicted) == 0 {
+		t.Error("mset over limit evicted nothing")
+	}
+}
+
+func TestDatabaseExecReply(t *testing.T) {
+	dd, err := New(Config{QueueLength: 10, Shards: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	for _, arg := range []string{"a\\,b,1", "dict,f\\,1,v", "list,v"} {
+		cmd := CommandSet
+		if strings.HasPrefix(arg, "list") {
+			cmd = CommandPush
+		}
+		if _, err := dd.Exec(cmd, []byte(arg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		cmd   Command
+		arg   string
+		reply string
+	}{
+		{CommandGet, "a\\,b", "$1"},
+		{CommandGet, "dict", ":1"},
+		{CommandGet, "list", ":1"},
+		{CommandKeys, "dict", "*1,$f\\,1"},
+	}
+
+	for _, test := range tests {
+		r, err := dd.ExecReply(context.Background(), test.cmd, []byte(test.arg))
+		if err != nil || string(r.Typed()) != test.reply {
+			t.Errorf("%v %s replied '%s' (%v), expected: '%s'", test.cmd, test.arg, r.Typed(), err, test.reply)
+		}
+	}
+
+	r, err := dd.ExecReply(context.Background(), CommandKeys, nil)
+	var names []string
+	for _, item := range r.Array {
+		names = append(names, string(item.Str))
+	}
+	sort.Strings(names)
+	if err != nil || r.Type != ReplyArray || strings.Join(names, "|") != "a,b|dict|list" {
+		t.Errorf("keys replied %q (%v)", names, err)
+	}
+
+	if _, err := dd.ExecReply(context.Background(), CommandGet, []byte("none")); err != ErrNotFound {
+		t.Errorf("get of missing key failed with %v, expected: %v", err, ErrNotFound)
+	}
+}
+
+func TestDatabaseRange(t *testing.T) {
+	dd, err := New(Config{QueueLength: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	for _, v := range []string{"a", "b", "c", "d"} {
+		dd.Exec(CommandPush, []byte("list,"+v))
+	}
+	dd.Exec(CommandSet, []byte("dict,f1,v1"))
+	dd.Exec(CommandSet, []byte("str,value"))
+
+	var tests = []struct {
+		cmd   Command
+		arg   string
+		reply string
+		err   error
+	}{
+		{CommandLRange, "list", "*4,$a,$b,$c,$d", nil},
+		{CommandLRange, "list,0,-1", "*4,$a,$b,$c,$d", nil},
+		{CommandLRange, "list,1,2", "*2,$b,$c", nil},
+		{CommandLRange, "list,-2,10", "*2,$c,$d", nil},
+		{CommandLRange, "list,-10,0", "*1,$a", nil},
+		{CommandLRange, "list,3,1", "*0", nil},
+		{CommandLRange, "list,5,6", "*0", nil},
+		{CommandLRange, "list,1", "", ErrInvalidFormat},
+		{CommandLRange, "list,a,1", "", ErrInvalidIndex},
+		{CommandLRange, "dict", "", ErrInvalidType},
+		{CommandLRange, "none", "", ErrNotFound},
+		{CommandHGetAll, "dict", "*2,$f1,$v1", nil},
+		{CommandHGetAll, "str", "", ErrInvalidType},
+		{CommandHGetAll, "none", "", ErrNotFound},
+		{CommandHGetAll, "", "", ErrInvalidFormat},
+	}
+
+	for _, test := range tests {
+		r, err := dd.ExecReply(context.Background(), test.cmd, []byte(test.arg))
+		if err != test.err || (err == nil && string(r.Typed()) != test.reply) {
+			t.Errorf("%v %s replied '%s' (%v), expected: '%s' (%v)",
+				test.cmd, test.arg, r.Typed(), err, test.reply, test.err)
+		}
+	}
+
+	dd.Exec(CommandSet, []byte("dict,f2,v2"))
+	if r, err := dd.Exec(CommandHGetAll, []byte("dict")); err != nil || (string(r) != "f1,v1,f2,v2" && string(r) != "f2,v2,f1,v1") {
+		t.Errorf("hgetall replied '%s' (%v)", r, err)
+	}
+
+	m, err := dd.HGetAll("dict")
+	if err != nil || len(m) != 2 || string(m["f1"]) != "v1" || string(m["f2"]) != "v2" {
+		t.Errorf("HGetAll returned %q (%v)", m, err)
+	}
+
+	values, err := dd.LRange("list", 1, -2)
+	if err != nil || len(values) != 2 || string(values[0]) != "b" || string(values[1]) != "c" {
+		t.Errorf("LRange returned %q (%v)", values, err)
+	}
+
+	// copies are not changed by later writes
+	values[0][0] = 'x'
+	if r, _ := dd.Exec(CommandGet, []byte("list,1")); string(r) != "b" {
+		t.Errorf("list element changed to '%s' by write to copy", r)
+	}
+}
+
+func TestDatabaseRename(t *testing.T) {
+	for _, shards := range []uint{1, 4} {
+		dd, err := New(Config{QueueLength: 10, Shards: shards})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dd.Exec(CommandSet, []byte("str,value"))
+		dd.Exec(CommandSet, []byte("dict,f1,v1"))
+		dd.Exec(CommandPush, []byte("list,a"))
+		dd.Exec(CommandSet, []byte("other,x"))
+
+		var tests = []struct {
+			cmd Command
+			arg string
+			err error
+		}{
+			{CommandRename, "str,str2", nil},
+			{CommandRename, "str,str3", ErrNotFound},
+			{CommandRename, "str2,str2", nil},
+			{CommandRenameNX, "str2,other", ErrKeyExists},
+			{CommandRenameNX, "str2,str", nil},
+			{CommandRename, "str,other", nil},
+			{CommandCopy, "dict,dict2", nil},
+			{CommandCopy, "list,list2", nil},
+			{CommandCopy, "none,list2", ErrNotFound},
+			{CommandRename, "str", ErrInvalidFormat},
+			{CommandRename, "a,b,c", ErrInvalidFormat},
+			{CommandCopy, ",b", ErrInvalidFormat},
+		}
+
+		for _, test := range tests {
+			if _, err := dd.Exec(test.cmd, []byte(test.arg)); err != test.err {
+				t.Errorf("%d shards: %v %s returned %v, expected: %v", shards, test.cmd, test.arg, err, test.err)
+			}
+		}
+
+		var values = []struct {
+			arg   string
+			value string
+			err   error
+		}{
+			{"str", "", ErrNotFound},
+			{"str2", "", ErrNotFound},
+			{"other", "value", nil},
+			{"dict,f1", "v1", nil},
+			{"dict2,f1", "v1", nil},
+			{"list2,0", "a", nil},
+		}
+
+		for _, test := range values {
+			if r, err := dd.Exec(CommandGet, []byte(test.arg)); err != test.err || string(r) != test.value {
+				t.Errorf("%d shards: get %s replied '%s' (%v), expected: '%s' (%v)", shards, test.arg, r, err, test.value, test.err)
+			}
+		}
+
+		// copies are deep
+		dd.Exec(CommandSet, []byte("dict2,f1,v2"))
+		dd.Exec(CommandPush, []byte("list2,b"))
+		if r, _ := dd.Exec(CommandGet, []byte("dict,f1")); string(r) != "v1" {
+			t.Errorf("%d shards: dict changed to '%s' by write to copy", shards, r)
+		}
+		if n, _ := dd.Len("list"); n != 1 {
+			t.Errorf("%d shards: list length changed to %d by write to copy", shards, n)
+		}
+
+		// TTL follows renamed key and is copied, timer of the old key does
+		// not remove new key of the same name
+		dd.Exec(CommandTTL, []byte("dict,100"))
+		dd.Exec(CommandRename, []byte("dict,dict3"))
+		dd.Exec(CommandCopy, []byte("dict3,dict4"))
+		dd.Exec(CommandSet, []byte("dict,f1,v3"))
+
+		time.Sleep(300 * time.Millisecond)
+
+		for _, name := range []string{"dict3", "dict4"} {
+			if r, err := dd.Exec(CommandGet, []byte(name+",f1")); err != ErrNotFound {
+				t.Errorf("%d shards: %s is not expired, replied '%s' (%v)", shards, name, r, err)
+			}
+		}
+		if r, err := dd.Exec(CommandGet, []byte("dict,f1")); err != nil || string(r) != "v3" {
+			t.Errorf("%d shards: new dict replied '%s' (%v)", shards, r, err)
+		}
+
+		dd.Close()
+	}
+}
+
+func TestDatabaseRenameMemory(t *testing.T) {
+	dd, err := New(Config{QueueLength: 10, Shards: 2, MaxMemory: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	// src is in other shard than full shard of dst
+	var names []string
+	for i := 0; len(names) < 2; i++ {
+		name := "key" + strconv.Itoa(i)
+		if dd.shard([]byte(name)) != dd.shard([]byte("src")) {
+			names = append(names, name)
+		}
+	}
+
+	value := strings.Repeat("x", 600)
+	dd.Exec(CommandSet, []byte("src,"+value))
+	dd.Exec(CommandSet, []byte(names[0]+","+value))
+
+	if _, err := dd.Exec(CommandRename, []byte("src,"+names[1])); err != ErrOutOfMemory {
+		t.Errorf("rename to full shard returned %v, expected %v", err, ErrOutOfMemory)
+	}
+	if r, err := dd.Exec(CommandGet, []byte("src")); err != nil || string(r) != value {
+		t.Errorf("src is not intact after failed rename, get replied '%s' (%v)", r, err)
+	}
+	if _, err := dd.Exec(CommandGet, []byte(names[1])); err != ErrNotFound {
+		t.Errorf("dst is set by failed rename: %v", err)
+	}
+
+	// replaced dst frees its memory
+	if _, err := dd.Exec(CommandRename, []byte("src,"+names[0])); err != nil {
+		t.Errorf("rename replacing dst failed with %v", err)
+	}
+}
+
+func TestDatabaseFlush(t *testing.T) {
+	dd, err := New(Config{QueueLength: 10, Shards: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	size := func() int64 {
+		r, err := dd.ExecReply(context.Background(), CommandDBSize, nil)
+		if err != nil {
+			t.Fatalf("dbsize failed with %v", err)
+		}
+		return r.Int
+	}
+
+	if n := size(); n != 0 {
+		t.Errorf("dbsize of empty database is %d", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		dd.Exec(CommandSet, []byte("key"+strconv.Itoa(i)+",value"))
+	}
+	dd.Exec(CommandSet, []byte("dict,f1,v1"))
+	dd.Exec(CommandPush, []byte("list,a"))
+
+	if n := size(); n != 12 {
+		t.Errorf("dbsize is %d, expected: 12", n)
+	}
+
+	for _, cmd := range []Command{CommandDBSize, CommandFlush} {
+		if _, err := dd.Exec(cmd, []byte("x")); err != ErrInvalidFormat {
+			t.Errorf("%v with argument returned %v, expected: %v", cmd, err, ErrInvalidFormat)
+		}
+	}
+
+	for _, arg := range []string{"", "sync", "async"} {
+		dd.Exec(CommandSet, []byte("str,value"))
+		dd.Exec(CommandSet, []byte("ttl,value"))
+		dd.Exec(CommandTTL, []byte("ttl,100"))
+
+		if r, err := dd.Exec(CommandFlush, []byte(arg)); err != nil || string(r) != "Ok" {
+			t.Errorf("flush %s replied '%s' (%v)", arg, r, err)
+		}
+		if n := size(); n != 0 {
+			t.Errorf("dbsize after flush %s is %d", arg, n)
+		}
+
+		// timer of flushed key does not remove new key of the same name
+		dd.Exec(CommandSet, []byte("ttl,new"))
+		time.Sleep(200 * time.Millisecond)
+		if r, err := dd.Exec(CommandGet, []byte("ttl")); err != nil || string(r) != "new" {
+			t.Errorf("key written after flush %s replied '%s' (%v)", arg, r, err)
+		}
+		dd.Exec(CommandFlush, nil)
+	}
+
+	if s, _ := dd.Stats(); s.Expired != 0 || s.Expiring != 0 || s.Memory != 0 {
+		t.Errorf("stats after flush %+v", s)
+	}
+}
+
+func TestDatabaseScript(t *testing.T) {
+	dd, err := New(Config{QueueLength: 10, Shards: 4, ScriptSteps: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	var fed []string
+	if err := dd.SetFeed(func(cmd Command, arg []byte) {
+		fed = append(fed, cmd.String()+" "+string(arg))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	dd.Exec(CommandPush, []byte("A,1"))
+	dd.Exec(CommandPush, []byte("A,2"))
+	dd.Exec(CommandSet, []byte("C,f,yes"))
+	dd.Set("big", make([]byte, maxScriptValue+1))
+	dd.Push("E", []byte("x,y\\z"))
+	fed = nil
+
+	tests := []struct {
+		arg   string
+		reply string
+		err   error
+	}{
+		{`(+ 1 (* 2 3) (- 4))`, ":3", nil},
+		{`(concat "a\"b" 1 nil)`, `$a"b1`, nil},
+		{`(var x 2) (while (< x 5) (var x (+ x 1))) x`, ":5", nil},
+		{`(list (and 1 0 2) (or nil "" 3) (not 0) (= 1 "1"))`, "*4,:0,:3,:1,:1", nil},
+		{`(nth (list 1 2 3) -1) (len "abc")`, ":3", nil},
+		{`(list $1 $2 $3), a, b`, "*3,$a,$b,_", nil},
+		{`(if (get "C" "f") (do (var v (pop "A")) (if v (push "B" v))))`, "$Ok", nil},
+		{`(list (lrange "A") (lrange "B") (get "missing"))`, "*3,*1,$1,*1,$2,_", nil},
+		{`(var n (+ (or (get $1) 0) 1)) (set $1 n) n, counter`, ":1", nil},
+		{`(push "C" 1)`, "", ErrInvalidType},
+		{`(flush)`, "", ErrScriptCommand},
+		{`(while 1)`, "", ErrScriptSteps},
+		{`(var s "abcd") (while 1 (var s (concat s s)))`, "", ErrScriptValue},
+		{`(var l (list "abcd")) (while 1 (var l (list l l)))`, "", ErrScriptValue},
+		{`(len (get "big"))`, "", ErrScriptValue},
+		{`(push "D" (pop "E")) (lrange "D")`, "*1,$x\\,y\\\\z", nil},
+		{`(set "k" $1) (get "k"), a\,b\\c`, "$a\\,b\\\\c", nil},
+		{`(set "d" "f,1" "v,1") (get "d" "f,1")`, "$v\\,1", nil},
+		{`(+ 1`, "", ErrScriptSyntax},
+		{`(+ 1))`, "", ErrScriptSyntax},
+		{`, a`, "", ErrScriptSyntax},
+	}
+
+	for _, test := range tests {
+		r, err := dd.ExecReply(context.Background(), CommandEval, []byte(test.arg))
+		if err != test.err || (err == nil && string(r.Typed()) != test.reply) {
+			t.Errorf("eval %s replied '%s' (%v), expected: '%s' (%v)", test.arg, r.Typed(), err, test.reply, test.err)
+		}
+	}
+
+	if _, err := dd.Exec(CommandEval, []byte(`(error "failed")`)); err == nil || err.Error() != "failed" {
+		t.Errorf("error function returned %v", err)
+	}
+	if _, err := dd.Exec(CommandEval, []byte(`(+ "x" 1)`)); err == nil {
+		t.Errorf("sum of string succeeded")
+	}
+
+	expected := []string{"pop A", "push B,2", "set counter,1", "pop E", "push D,x\\,y\\\\z",
+		"set k,a\\,b\\\\c", "set d,f\\,1,v\\,1"}
+	if strings.Join(fed, "; ") != strings.Join(expected, "; ") {
+		t.Errorf("feed received %q, expected: %q", fed, expected)
+	}
+
+	sha, err := dd.Exec(CommandScript, []byte(`load (+ $1 $2)`))
+	if err != nil || len(sha) != 40 {
+		t.Fatalf("script load replied '%s' (%v)", sha, err)
+	}
+	if r, err := dd.Exec(CommandEvalSHA, []byte(string(sha)+",2,3")); err != nil || string(r) != "5" {
+		t.Errorf("evalsha replied '%s' (%v)", r, err)
+	}
+	if r, _ := dd.Exec(CommandScript, []byte("exists "+string(sha))); string(r) != "1" {
+		t.Errorf("script exists replied '%s'", r)
+	}
+	if _, err := dd.Exec(CommandScript, []byte(`load (+ 1, 2`)); err != ErrScriptSyntax {
+		t.Errorf("load of invalid script returned %v", err)
+	}
+	if r, err := dd.Exec(CommandScript, []byte("flush")); err != nil || string(r) != "Ok" {
+		t.Errorf("script flush replied '%s' (%v)", r, err)
+	}
+	if _, err := dd.Exec(CommandEvalSHA, sha); err != ErrScriptNotFound {
+		t.Errorf("evalsha of flushed script returned %v", err)
+	}
+
+	if names := Keys(CommandEval, []byte(`(get $1), a, b`)); len(names) != 2 || string(names[1]) != "b" {
+		t.Errorf("keys of eval are %q", names)
+	}
+}
+
+func TestDatabaseScriptTimeout(t *testing.T) {
+	dd, err := New(Config{QueueLength: 10, ScriptSteps: 1 << 30, ScriptTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dd.Close()
+
+	start := time.Now()
+	if _, err := dd.Exec(CommandEval, []byte("(while 1)")); err != ErrScriptTimeout {
+		t.Errorf("endless script returned %v, expected: %v", err, ErrScriptTimeout)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("endless script ran %v", d)
+	}
+
+	// database is not blocked after script
+	if r, err := dd.Exec(CommandSet, []byte("key,value")); err != nil || string(r) != "Ok" {
+		t.Errorf("set after script replied '%s' (%v)", r, err)
+	}
+
+	// time limit is checked on every step, even short script is stopped
+	short, err := New(Config{QueueLength: 10, ScriptTimeout: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer short.Close()
+
+	if _, err := short.Exec(CommandEval, []byte("(+ 1 2)")); err != ErrScriptTimeout {
+		t.Errorf("script returned %v, expected: %v", err, ErrScriptTimeout)
+	}
+}
+
+func TestLine(t *testing.T) {
+	tests := []struct {
+		input string
+		wants string
+	}{
+		{"", ""},
+		{"\\", "\\\\"},
+		{"\\'", "\\\\'"},
+		{"\n", "\\n"},
+		{"\\n", "\\\\n"},
+		{"\r", "\\r"},
+		{"\\r", "\\\\r"},
+		{"C:\\new\r\nline,\\,", "C:\\\\new\\r\\nline,\\\\,"},
+	}
+
+	for _, test := range tests {
+		if result := EncodeLine(test.input); result != test.wants {
+			t.Errorf("EncodeLine(%q) = %q, expected: %q", test.input, result, test.wants)
+		} else if decoded := DecodeLine(result); decoded != test.input {
+			t.Errorf("DecodeLine(%q) = %q, expected: %q", result, decoded, test.input)
+		}
+	}
+
+	// unknown escapes are kept as is
+	for _, s := range []string{"\\", "\\'", "a\\,b", "nr"} {
+		if decoded := DecodeLine(s); decoded != s {
+			t.Errorf("DecodeLine(%q) = %q", s, decoded)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	var tests = []struct {
+		reply Reply
+		text  string
+		typed string
+	}{
+		{StringReply([]byte("value")), "value", "$value"},
+		{StringReply([]byte{}), "", "$"},
+		{StringReply([]byte("a,b\\c\nd")), "a,b\\c\nd", "$a\\,b\\\\c\\nd"},
+		{IntegerReply(-42), "-42", ":-42"},
+		{NilReply(), "", "_"},
+		{ErrorReply(ErrNotFound), ErrNotFound.Error(), "!" + ErrNotFound.Error()},
+		{ArrayReply(), "", "*0"},
+		{ArrayReply(StringReply([]byte("a")), NilReply(), StringReply([]byte("b,c"))), "a,,b,c", "*3,$a,_,$b\\,c"},
+		{ArrayReply(ArrayReply(IntegerReply(1), StringReply(nil)), NilReply()), "1,,", "*2,*2,:1,$,_"},
+	}
+
+	for _, test := range tests {
+		if text := string(test.reply.Text()); text != test.text {
+			t.Errorf("text of %v is '%s', expected: '%s'", test.reply, text, test.text)
+		}
+
+		typed := string(test.reply.Typed())
+		if typed != test.typed {
+			t.Errorf("typed encoding of %v is '%s', expected: '%s'", test.reply, typed, test.typed)
+			continue
+		}
+
+		r, err := ParseReply([]byte(typed))
+		if err != nil || string(r.Typed()) != typed {
+			t.Errorf("ParseReply('%s') returned %v (%v)", typed, r, err)
+		}
+	}
+
+	for _, bad := range []string{"", "value", "$a,", "$a\\", ":", ":x", "*", "*2,$a", "*1,$a,$b", "_x", "*-1"} {
+		if _, err := ParseReply([]byte(bad)); err != ErrInvalidFormat {
+			t.Errorf("ParseReply('%s') failed with %v, expected: %v", bad, err, ErrInvalidFormat)
+		}
+	}
+}
+
+func TestArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		arg  string
+	}{
+		{[]string{""}, ""},
+		{[]string{"a", "b"}, "a,b"},
+		{[]string{"a,b", "c\\d", ""}, "a\\,b,c\\\\d,"},
+		{[]string{"\\", ","}, "\\\\,\\,"},
+		{[]string{"x\\n"}, "x\\\\n"},
+	}
+
+	for _, test := range tests {
+		arg := JoinArgs(test.args...)
+		if arg != test.arg {
+			t.Errorf("JoinArgs(%q) = %q, expected: %q", test.args, arg, test.arg)
+			continue
+		}
+
+		var split []string
+		for _, a := range SplitArg([]byte(arg)) {
+			split = append(split, string(a))
+		}
+		if strings.Join(split, "|") != strings.Join(test.args, "|") {
+			t.Errorf("SplitArg(%q) = %q, expected: %q", arg, split, test.args)
+		}
+		if first := string(FirstArg([]byte(arg))); first != test.args[0] {
+			t.Errorf("FirstArg(%q) = %q, expected: %q", arg, first, test.args[0])
+		}
+	}
+
+	// unknown escapes are kept as is
+	if split := SplitArg([]byte("a\\n,\\b")); string(split[0]) != "a\\n" || string(split[1]) != "\\b" {
+		t.Errorf("SplitArg kept %q", split)
+	}
+}
+
+func TestHSetEmpty(t *testing.T) {
+	dd := createDb(t)
+	defer dd.Close()
+
+	if err := dd.HSet("dict", "f1", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dd.HSet("dict", "f2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dd.Exec(CommandSet, []byte("dict,f3,")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"f1", "f2", "f3"} {
+		if v, err := dd.HGet("dict", f); err != nil || len(v) != 0 {
+			t.Errorf("HGet(%s) = '%s' (%v), expected empty value", f, v, err)
+		}
+	}
+	if n, err := dd.Len("dict"); err != nil || n != 3 {
+		t.Errorf("Len = %d (%v), expected: 3", n, err)
+	}
+}
+
+func TestMove(t *testing.T) {
+	src, dst := createDb(t), createDb(t)
+	defer src.Close()
+	defer dst.Close()
+
+	var fed []string
+	feed := func(name string) Feed {
+		return func(cmd Command, arg []byte) {
+			fed = append(fed, name+" "+cmd.String()+" "+string(arg))
+		}
+	}
+	src.SetFeed(feed("src"))
+	dst.SetFeed(feed("dst"))
+
+	src.Set("a,b", []byte("value"))
+	src.Expire("a,b", time.Minute)
+	src.HSet("dict", "f", []byte("v"))
+	dst.Set("dict", []byte("other"))
+	fed = nil
+
+	tests := []struct {
+		src  *Database
+		dst  *Database
+		name string
+		err  error
+	}{
+		{src, dst, "a,b", nil},
+		{src, dst, "a,b", ErrNotFound},
+		{src, dst, "dict", ErrKeyExists},
+		{src, src, "dict", ErrInvalidFormat},
+		{src, dst, "", ErrInvalidFormat},
+	}
+	for i, test := range tests {
+		if err := Move(context.Background(), test.src, test.dst, []byte(test.name)); err != test.err {
+			t.Errorf("[%d] move %s failed with %v, expected: %v", i, test.name, err, test.err)
+		}
+	}
+
+	if _, err := src.Get("a,b"); err != ErrNotFound {
+		t.Errorf("moved key is found in source database (%v)", err)
+	}
+	if v, err := dst.Get("a,b"); err != nil || string(v) != "value" {
+		t.Errorf("moved key returned '%s' (%v)", v, err)
+	}
+	if s, err := dst.Stats(); err != nil || s.Expiring != 1 || s.Memory == 0 {
+		t.Errorf("destination stats %+v (%v), expected moved TTL", s, err)
+	}
+	if s, err := src.Stats(); err != nil || s.Expiring != 0 || s.Dicts != 1 {
+		t.Errorf("source stats %+v (%v)", s, err)
+	}
+
+	expected := []string{"src remove a\\,b", "dst set a\\,b,value", "dst ttl a\\,b,60000"}
+	if len(fed) != 3 || strings.Join(fed[:2], "|") != strings.Join(expected[:2], "|") ||
+		!strings.HasPrefix(fed[2], "dst ttl a\\,b,") {
+		t.Errorf("fed commands %q, expected: %q", fed, expected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := Move(ctx, dst, src, []byte("a,b")); err != context.Canceled {
+		t.Errorf("move with cancelled context failed with %v, expected: %v", err, context.Canceled)
+	}
+}
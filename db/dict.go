@@ -1,42 +1,63 @@
 package db
 
-import "strconv"
+type dict struct {
+	m map[key][]byte
+	n int
+}
 
-type dict map[key][]byte
+func newDict() *dict {
+	return &dict{m: make(map[key][]byte)}
+}
 
-func (v dict) get() result {
-	return result{[]byte(strconv.Itoa(len(v))), nil}
+func (v *dict) get() result {
+	return result{reply: IntegerReply(int64(len(v.m)))}
 }
 
-func (v dict) set(k []byte) result {
+func (v *dict) set(k []byte) result {
 	return resultInvalidType
 }
 
-func (v dict) getKey(k []byte) result {
-	if val, ok := v[key(k)]; ok {
-		return result{val, nil}
+func (v *dict) getKey(k []byte) result {
+	if val, ok := v.m[key(k)]; ok {
+		return result{value: val}
 	}
 
 	return resultKeyNotFound
 }
 
-func (v dict) setKey(k []byte, nv []byte) result {
+func (v *dict) setKey(k []byte, nv []byte) result {
+	if old, ok := v.m[key(k)]; ok {
+		v.n -= sizeOverhead + len(k) + len(old)
+	}
 	if nv == nil {
-		delete(v, key(k))
+		delete(v.m, key(k))
 	} else {
-		v[key(k)] = nv
+		v.m[key(k)] = nv
+		v.n += sizeOverhead + len(k) + len(nv)
 	}
 	return resultOk
 }
 
-func (v dict) empty() bool {
-	return len(v) == 0
+func (v *dict) empty() bool {
+	return len(v.m) == 0
 }
 
-func (v dict) pop() result {
+func (v *dict) pop() result {
 	return resultInvalidType
 }
 
-func (v dict) push(k []byte) result {
+func (v *dict) push(k []byte) result {
 	return resultInvalidType
 }
+
+func (v *dict) size() int {
+	return v.n
+}
+
+func (v *dict) clone() value {
+	c := &dict{m: make(map[key][]byte, len(v.m)), n: v.n}
+	for f, e := range v.m {
+		c.m[f] = append([]byte{}, e...)
+	}
+	return c
+}
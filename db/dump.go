@@ -0,0 +1,111 @@
+package db
+
+import (
+	"strconv"
+	"time"
+)
+
+// SetFeed attaches f to receive mutating commands, nil detaches current feed
+func (d *Database) SetFeed(f Feed) error {
+	return d.atomic(func() {
+		d.feed = f
+	})
+}
+
+// Dump calls fn with commands recreating every key of database including its
+// TTL, fn must not retain arg. All engine loops are parked during dump, mark
+// is called before first command to let caller synchronize dump with Feed stream.
+func (d *Database) Dump(mark func(), fn func(cmd Command, arg []byte)) error {
+	return d.atomic(func() {
+		if mark != nil {
+			mark()
+		}
+
+		now := time.Now()
+		for _, s := range d.shards {
+			s.dump(now, nil, fn)
+		}
+	})
+}
+
+// Extract calls fn with commands recreating every key matching the filter,
+// including its TTL, and removes these keys from database, fn must not
+// retain arg. Keys are extracted atomically.
+func (d *Database) Extract(match func(name []byte) bool, fn func(cmd Command, arg []byte)) error {
+	return d.atomic(func() {
+		now := time.Now()
+		for _, s := range d.shards {
+			for _, k := range s.dump(now, match, fn) {
+				s.drop(k)
+				if d.feed != nil {
+					d.feed(CommandRemove, appendArg(nil, []byte(k)))
+				}
+			}
+		}
+	})
+}
+
+// Clear removes all keys and stops their TTL timers
+func (d *Database) Clear() error {
+	return d.atomic(func() {
+		for _, s := range d.shards {
+			s.clear()
+		}
+	})
+}
+
+// dump calls fn with commands recreating keys matching the filter, nil filter
+// matches all keys. It returns list of matched keys.
+func (s *shard) dump(now time.Time, match func(name []byte) bool, fn func(cmd Command, arg []byte)) []key {
+	var (
+		arg     []byte
+		matched []key
+	)
+	for k, v := range s.m {
+		if match != nil {
+			if !match([]byte(k)) {
+				continue
+			}
+			matched = append(matched, k)
+		}
+		arg = s.dumpKey(arg, now, k, v, fn)
+	}
+	return matched
+}
+
+// dumpKey calls fn with commands recreating key k with value v and its TTL,
+// arguments are built in arg buffer, which is returned for reuse
+func (s *shard) dumpKey(arg []byte, now time.Time, k key, v value, fn func(cmd Command, arg []byte)) []byte {
+	switch v := v.(type) {
+	case str:
+		arg = appendArg(append(appendArg(arg[:0], []byte(k)), ','), v)
+		fn(CommandSet, arg)
+	case *dict:
+		for f, e := range v.m {
+			arg = appendArg(append(appendArg(arg[:0], []byte(k)), ','), []byte(f))
+			arg = appendArg(append(arg, ','), e)
+			fn(CommandSet, arg)
+		}
+	case *list:
+		for _, e := range v.v {
+			arg = appendArg(append(appendArg(arg[:0], []byte(k)), ','), e)
+			fn(CommandPush, arg)
+		}
+	}
+
+	if u, ok := s.u[k]; ok && !u.expire.IsZero() {
+		ms := int64(u.expire.Sub(now) / time.Millisecond)
+		if ms < 1 {
+			ms = 1
+		}
+		arg = append(appendArg(arg[:0], []byte(k)), ',')
+		arg = strconv.AppendInt(arg, ms, 10)
+		fn(CommandTTL, arg)
+	}
+	return arg
+}
+
+// clear removes all keys of shard and stops their TTL timers
+func (s *shard) clear() {
+	s.detach().free()
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// eval executes script of eval or evalsha command. Script is executed with
+// all engine loops parked, so it is atomic. Database commands executed by
+// script are passed to Feed instead of the script itself.
+//
+//	eval script [, arg...]
+//	evalsha sha1 [, arg...]
+func (d *Database) eval(ctx context.Context, cmd Command, arg []byte) result {
+	var (
+		p    *script
+		args [][]byte
+	)
+
+	if cmd == CommandEval {
+		var (
+			rest []byte
+			err  error
+		)
+		if p, rest, err = parseScript(arg); err != nil {
+			return result{err: err}
+		}
+		if rest != nil {
+			args = parseArg(rest)
+		}
+	} else {
+		all := parseArg(arg)
+		d.scriptsMu.Lock()
+		p = d.scripts[string(all[0])]
+		d.scriptsMu.Unlock()
+		if p == nil {
+			return result{err: ErrScriptNotFound}
+		}
+		args = all[1:]
+	}
+
+	var r result
+	if err := d.atomicContext(ctx, func() { r = d.execScript(ctx, p, args) }); err != nil {
+		return result{err: err}
+	}
+	return r
+}
+
+// script serves script command, scripts are cached until flushed
+//
+//	script load script - cache script and reply with its SHA1
+//	script exists sha1 - 1 if script is cached, 0 otherwise
+//	script flush       - remove all cached scripts
+func (d *Database) script(arg []byte) result {
+	sub, rest := arg, []byte(nil)
+	if i := bytes.IndexByte(arg, ' '); i >= 0 {
+		sub, rest = arg[:i], bytes.TrimSpace(arg[i+1:])
+	}
+
+	switch string(sub) {
+	case "load":
+		p, args, err := parseScript(rest)
+		if err != nil {
+			return result{err: err}
+		}
+		if args != nil {
+			return resultInvalidFormat
+		}
+
+		sum := sha1.Sum(rest)
+		sha := hex.EncodeToString(sum[:])
+
+		d.scriptsMu.Lock()
+		d.scripts[sha] = p
+		d.scriptsMu.Unlock()
+
+		return result{value: []byte(sha)}
+
+	case "exists":
+		d.scriptsMu.Lock()
+		_, ok := d.scripts[string(rest)]
+		d.scriptsMu.Unlock()
+		return result{reply: boolReply(ok)}
+
+	case "flush":
+		if len(rest) != 0 {
+			return resultInvalidFormat
+		}
+		d.scriptsMu.Lock()
+		d.scripts = make(map[string]*script)
+		d.scriptsMu.Unlock()
+		return resultOk
+	}
+
+	return resultInvalidFormat
+}
+
+// scriptArgs returns arguments passed to script by eval or evalsha command
+func scriptArgs(cmd Command, arg []byte) [][]byte {
+	if cmd == CommandEvalSHA {
+		return parseArg(arg)[1:]
+	}
+
+	_, rest, err := parseScript(arg)
+	if err != nil || rest == nil {
+		return nil
+	}
+	return parseArg(rest)
+}
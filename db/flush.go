@@ -0,0 +1,91 @@
+package db
+
+// A keyspace holds maps of shard detached by flush
+type keyspace struct {
+	m map[key]value
+	t map[key]*expiry
+	u map[key]*usage
+}
+
+// dbsize returns number of keys in database
+func (d *Database) dbsize(arg []byte) result {
+	if len(arg) != 0 {
+		return resultInvalidFormat
+	}
+
+	var r result
+	if err := d.atomic(func() { r = d.size() }); err != nil {
+		return result{err: err}
+	}
+	return r
+}
+
+// size returns number of keys of all shards, engine loops must be parked
+func (d *Database) size() result {
+	n := 0
+	for _, s := range d.shards {
+		n += len(s.m)
+	}
+	return result{reply: IntegerReply(int64(n))}
+}
+
+// flush removes all keys of database. With "async" argument maps of shards
+// are only detached while engine loops are parked, and their TTL timers are
+// stopped in background. Timers of detached keys never remove new keys of the
+// same name, as timer callback checks its timer is still current.
+func (d *Database) flush(arg []byte) result {
+	var async bool
+	switch string(arg) {
+	case "", "sync":
+	case "async":
+		async = true
+	default:
+		return resultInvalidFormat
+	}
+
+	var detached []keyspace
+	err := d.atomic(func() {
+		for _, s := range d.shards {
+			if async {
+				detached = append(detached, s.detach())
+			} else {
+				s.clear()
+			}
+		}
+		if d.feed != nil {
+			d.feed(CommandFlush, arg)
+		}
+	})
+	if err != nil {
+		return result{err: err}
+	}
+
+	if async {
+		go func() {
+			for _, k := range detached {
+				k.free()
+			}
+		}()
+	}
+	return resultOk
+}
+
+// detach replaces maps of shard with empty ones and returns the old maps
+func (s *shard) detach() keyspace {
+	k := keyspace{s.m, s.t, s.u}
+
+	s.m = make(map[key]value, 1024)
+	s.t = make(map[key]*expiry, 1024)
+	s.u = make(map[key]*usage, 1024)
+	s.used = 0
+
+	return k
+}
+
+// free stops TTL timers of detached keys, maps are released to garbage
+// collector after that
+func (k keyspace) free() {
+	for _, e := range k.t {
+		e.Stop()
+	}
+}
@@ -0,0 +1,61 @@
+package db
+
+import (
+	"strconv"
+)
+
+// InfoSections lists info sections provided by database
+var InfoSections = []string{"keyspace", "memory", "config"}
+
+// Info returns "field:value" lines of database info section, see InfoSections
+func (d *Database) Info(section string) ([]byte, error) {
+	var b []byte
+	field := func(name string, value string) {
+		b = append(append(append(append(b, name...), ':'), value...), '\n')
+	}
+
+	switch section {
+	case "keyspace":
+		s, err := d.Stats()
+		if err != nil {
+			return nil, err
+		}
+		field("str_keys", strconv.Itoa(s.Strings))
+		field("dict_keys", strconv.Itoa(s.Dicts))
+		field("list_keys", strconv.Itoa(s.Lists))
+		field("expiring_keys", strconv.Itoa(s.Expiring))
+		field("expired_keys", strconv.FormatUint(s.Expired, 10))
+		field("evicted_keys", strconv.FormatUint(s.Evicted, 10))
+
+	case "memory":
+		s, err := d.Stats()
+		if err != nil {
+			return nil, err
+		}
+		var (
+			limit  int
+			policy EvictionPolicy
+		)
+		err = d.atomic(func() {
+			for _, s := range d.shards {
+				limit += s.maxMemory
+			}
+			policy = d.eviction
+		})
+		if err != nil {
+			return nil, err
+		}
+		field("used_memory", strconv.Itoa(s.Memory))
+		field("maxmemory", strconv.Itoa(limit))
+		field("maxmemory_policy", policy.String())
+
+	case "config":
+		field("shards", strconv.Itoa(len(d.shards)))
+		field("queue_length", strconv.Itoa(cap(d.shards[0].queue)))
+
+	default:
+		return nil, ErrInvalidFormat
+	}
+
+	return b, nil
+}
@@ -0,0 +1,48 @@
+package db
+
+import "strings"
+
+var (
+	lineEncoder = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r")
+	lineDecoder = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r")
+)
+
+// EncodeLine converts s to single protocol line, backslash is escaped with
+// backslash, CR and LF are converted to \r and \n
+func EncodeLine(s string) string {
+	return lineEncoder.Replace(s)
+}
+
+// DecodeLine converts line encoded by EncodeLine back, other backslash
+// sequences are kept as is
+func DecodeLine(s string) string {
+	return lineDecoder.Replace(s)
+}
+
+var argEscaper = strings.NewReplacer("\\", "\\\\", ",", "\\,")
+
+// EscapeArg escapes backslash and comma in s so it is passed as single
+// argument of command
+func EscapeArg(s string) string {
+	return argEscaper.Replace(s)
+}
+
+// JoinArgs escapes args and joins them with commas into argument of command
+func JoinArgs(args ...string) string {
+	e := make([]string, len(args))
+	for i, a := range args {
+		e[i] = EscapeArg(a)
+	}
+	return strings.Join(e, ",")
+}
+
+// appendArg appends a to b escaping backslash and comma
+func appendArg(b, a []byte) []byte {
+	for _, c := range a {
+		if c == '\\' || c == ',' {
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return b
+}
@@ -1,24 +1,32 @@
 package db
 
-import "strconv"
+import (
+	"math"
+	"strconv"
+)
 
 type list struct {
 	v [][]byte
+	n int
 }
 
 func (v *list) get() result {
-	return result{strconv.AppendInt(nil, int64(len(v.v)), 10), nil}
+	return result{reply: IntegerReply(int64(len(v.v)))}
 }
 
 func (v *list) set(k []byte) result {
-	i, err := strconv.ParseUint(string(k), 10, 64)
+	i, err := listSize(k)
 	if err != nil {
-		return result{nil, err}
+		return result{err: err}
 	}
 
-	if i < uint64(len(v.v)) {
+	if i < len(v.v) {
+		for _, e := range v.v[i:] {
+			v.n -= sizeOverhead + len(e)
+		}
 		v.v = v.v[:i]
 	} else {
+		v.n += sizeOverhead * (i - len(v.v))
 		var n = make([][]byte, i)
 		copy(n, v.v)
 		v.v = n
@@ -27,22 +35,45 @@ func (v *list) set(k []byte) result {
 	return resultOk
 }
 
+// growth returns memory growth of resizing list to size k
+func (v *list) growth(k []byte) (int, error) {
+	i, err := listSize(k)
+	if err != nil || i <= len(v.v) {
+		return 0, err
+	}
+	return sizeOverhead * (i - len(v.v)), nil
+}
+
+// listSize parses list size k, size which memory estimate overflows int is
+// invalid
+func listSize(k []byte) (int, error) {
+	i, err := strconv.ParseUint(string(k), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if i > math.MaxInt/sizeOverhead {
+		return 0, ErrInvalidIndex
+	}
+	return int(i), nil
+}
+
 func (v *list) getKey(k []byte) result {
 	if i, err := strconv.ParseUint(string(k), 10, 64); err != nil {
-		return result{nil, err}
+		return result{err: err}
 	} else if int(i) >= len(v.v) {
 		return resultInvalidIndex
 	} else {
-		return result{v.v[i], nil}
+		return result{value: v.v[i]}
 	}
 }
 
 func (v *list) setKey(k []byte, nv []byte) result {
 	if i, err := strconv.ParseUint(string(k), 10, 64); err != nil {
-		return result{nil, err}
+		return result{err: err}
 	} else if int(i) >= len(v.v) {
 		return resultInvalidIndex
 	} else {
+		v.n += len(nv) - len(v.v[i])
 		v.v[i] = nv
 		return resultOk
 	}
@@ -53,12 +84,28 @@ func (v *list) empty() bool {
 }
 
 func (v *list) pop() result {
-	r := result{v.v[len(v.v)-1], nil}
+	r := result{value: v.v[len(v.v)-1]}
 	v.v = v.v[:len(v.v)-1]
+	v.n -= sizeOverhead + len(r.value)
 	return r
 }
 
 func (v *list) push(k []byte) result {
 	v.v = append(v.v, k)
+	v.n += sizeOverhead + len(k)
 	return resultOk
 }
+
+func (v *list) size() int {
+	return v.n
+}
+
+func (v *list) clone() value {
+	c := &list{v: make([][]byte, len(v.v)), n: v.n}
+	for i, e := range v.v {
+		if e != nil {
+			c.v[i] = append([]byte{}, e...)
+		}
+	}
+	return c
+}
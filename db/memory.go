@@ -0,0 +1,179 @@
+package db
+
+import "time"
+
+// Approximate memory overhead of internal structures, in bytes. Values are
+// not measured precisely, they only give the eviction logic a stable estimate.
+const (
+	sizeOverhead = 24 // slice header of single element
+	keyOverhead  = 96 // map entries, key header and usage record
+)
+
+// evictionSamples is the number of keys inspected to choose eviction victim
+const evictionSamples = 5
+
+// A usage tracks approximate size and access statistics of single key
+type usage struct {
+	size   int
+	atime  uint64    // logical clock value of the last access
+	hits   uint64    // number of accesses
+	expire time.Time // TTL deadline, zero if key has no TTL
+}
+
+// access updates access statistics of the key k
+func (s *shard) access(k key) {
+	if u, ok := s.u[k]; ok {
+		s.clock++
+		u.atime = s.clock
+		u.hits++
+	}
+}
+
+// update recalculates size of the key k after modification and updates its
+// access statistics
+func (s *shard) update(k key) {
+	v, ok := s.m[k]
+	if !ok {
+		return
+	}
+
+	u, ok := s.u[k]
+	if !ok {
+		u = &usage{}
+		s.u[k] = u
+	}
+
+	size := keyOverhead + len(k) + v.size()
+	s.used += size - u.size
+	u.size = size
+
+	s.access(k)
+}
+
+// drop removes the key k with its TTL timer and usage statistics
+func (s *shard) drop(k key) {
+	delete(s.m, k)
+	if t, ok := s.t[k]; ok {
+		t.Stop()
+		delete(s.t, k)
+	}
+	if u, ok := s.u[k]; ok {
+		s.used -= u.size
+		delete(s.u, k)
+	}
+}
+
+// growth returns approximate number of bytes key k grows by when n bytes
+// are written to it, string value is replaced, new key adds its overhead
+func (s *shard) growth(k key, n int) int {
+	switch v := s.m[k].(type) {
+	case nil:
+		return keyOverhead + len(k) + n
+	case str:
+		return n - len(v)
+	}
+	return n
+}
+
+// reclaim evicts keys according to eviction policy until write of size
+// bytes fits the configured limit. It returns ErrOutOfMemory if no more keys
+// can be evicted.
+func (s *shard) reclaim(size int) error {
+	for s.maxMemory > 0 && s.used+size > s.maxMemory {
+		k, ok := s.victim()
+		if !ok {
+			return ErrOutOfMemory
+		}
+
+		s.drop(k)
+		s.evicted++
+		s.db.log.Debug("key evicted", "key", string(k), "policy", s.db.eviction.String())
+
+		if s.db.feed != nil {
+			s.db.feed(CommandRemove, appendArg(nil, []byte(k)))
+		}
+
+		if s.db.e != nil {
+			s.db.e(EventEvicted, []byte(k))
+		}
+	}
+	return nil
+}
+
+// victim selects key to evict. Candidates are sampled from randomized map
+// iteration like Redis does, so LRU and LFU policies are approximate.
+func (s *shard) victim() (k key, ok bool) {
+	var best *usage
+
+	consider := func(c key) {
+		u, found := s.u[c]
+		if !found {
+			return
+		}
+
+		switch s.db.eviction {
+		case EvictionAllKeysLFU:
+			if best == nil || u.hits < best.hits ||
+				(u.hits == best.hits && u.atime < best.atime) {
+				k, best, ok = c, u, true
+			}
+		default:
+			if best == nil || u.atime < best.atime {
+				k, best, ok = c, u, true
+			}
+		}
+	}
+
+	n := 0
+	switch s.db.eviction {
+	case EvictionAllKeysLRU, EvictionAllKeysLFU:
+		for c := range s.m {
+			consider(c)
+			if n++; n == evictionSamples {
+				break
+			}
+		}
+	case EvictionVolatileLRU:
+		for c := range s.t {
+			consider(c)
+			if n++; n == evictionSamples {
+				break
+			}
+		}
+	case EvictionRandom:
+		for c := range s.m {
+			return c, true
+		}
+	}
+
+	return
+}
+
+// SetMaxMemory changes approximate memory limit in bytes, 0 - unlimited.
+// Keys above the new limit are evicted by the next mutating commands.
+func (d *Database) SetMaxMemory(limit uint64) error {
+	return d.atomic(func() {
+		for _, s := range d.shards {
+			s.maxMemory = shardMemory(limit, len(d.shards))
+		}
+	})
+}
+
+// shardMemory returns memory limit of single shard of n, non zero limit
+// gives every shard at least one byte, zero limit means unlimited
+func shardMemory(limit uint64, n int) int {
+	if limit == 0 {
+		return 0
+	}
+	if share := limit / uint64(n); share > 0 {
+		return int(share)
+	}
+	return 1
+}
+
+// SetEviction changes policy applied when memory limit is reached
+func (d *Database) SetEviction(policy EvictionPolicy) error {
+	return d.atomic(func() {
+		d.eviction = policy
+	})
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// created counts databases created by New, it gives every database its order
+var created uint64
+
+// Move moves key name with its TTL from database src to database dst. It
+// fails with ErrKeyExists if dst has the key and with ErrInvalidFormat if
+// src and dst are the same database. Engine loops of both databases are
+// parked, so key is never seen in both or none of them. Feed of src receives
+// remove command, Feed of dst commands recreating the key.
+//
+// Databases are parked in order of their creation by New, code parking
+// several databases at once, like nested Dump calls, must follow the same
+// order to not deadlock with Move.
+func Move(ctx context.Context, src *Database, dst *Database, name []byte) error {
+	if src == dst || len(name) == 0 {
+		return ErrInvalidFormat
+	}
+
+	first, second := src, dst
+	if dst.id < src.id {
+		first, second = dst, src
+	}
+
+	var r result
+	err := first.atomicContext(ctx, func() {
+		if err := second.atomicContext(ctx, func() { r = move(src, dst, key(name)) }); err != nil {
+			r.err = err
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return r.err
+}
+
+// move moves key k from src to dst, engine loops of both databases must be
+// parked
+func move(src *Database, dst *Database, k key) result {
+	ss, ds := src.shard([]byte(k)), dst.shard([]byte(k))
+
+	v, ok := ss.m[k]
+	if !ok {
+		return resultNotFound
+	}
+	if _, ok := ds.m[k]; ok {
+		return result{err: ErrKeyExists}
+	}
+	if err := ds.reclaim(keyOverhead + len(k) + v.size()); err != nil {
+		return result{err: err}
+	}
+
+	ttl := ss.remaining(k)
+	ss.drop(k)
+	ds.replace(k, v, ttl)
+
+	if src.feed != nil {
+		src.feed(CommandRemove, appendArg(nil, []byte(k)))
+	}
+	if dst.feed != nil {
+		ds.dumpKey(nil, time.Now(), k, v, dst.feed)
+	}
+	return resultOk
+}
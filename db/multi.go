@@ -0,0 +1,255 @@
+package db
+
+import (
+	"bytes"
+	"context"
+)
+
+// Keys returns names of all keys command is applied to
+func Keys(cmd Command, arg []byte) [][]byte {
+	switch cmd {
+	case CommandMGet, CommandMRemove, CommandRename, CommandRenameNX, CommandCopy:
+		return parseArg(arg)
+	case CommandMSet:
+		var names [][]byte
+		for i, a := range parseArg(arg) {
+			if i%2 == 0 {
+				names = append(names, a)
+			}
+		}
+		return names
+	case CommandEval, CommandEvalSHA:
+		return scriptArgs(cmd, arg)
+	}
+
+	if name := Key(cmd, arg); name != nil {
+		return [][]byte{name}
+	}
+	return nil
+}
+
+// multi executes command on several keys. If all keys belong to single shard
+// command is executed by its engine loop, otherwise all loops are parked.
+func (d *Database) multi(ctx context.Context, cmd Command, arg []byte) result {
+	args, ok := parseMulti(cmd, arg)
+	if !ok {
+		return resultInvalidFormat
+	}
+
+	var r result
+	exec := func() {
+		r = d.execMulti(cmd, arg, args)
+	}
+
+	s := d.shard(args[0])
+	for _, name := range Keys(cmd, arg)[1:] {
+		if d.shard(name) != s {
+			s = nil
+			break
+		}
+	}
+
+	if s == nil {
+		if err := d.atomicContext(ctx, exec); err != nil {
+			return result{err: err}
+		}
+		return r
+	}
+
+	done := make(chan struct{}, 1)
+	err := d.send(ctx, s, task{fn: func() {
+		if r.err = ctx.Err(); r.err == nil {
+			exec()
+		}
+		done <- struct{}{}
+	}})
+	if err != nil {
+		return result{err: err}
+	}
+
+	select {
+	case <-done:
+		return r
+	case <-ctx.Done():
+		select {
+		case <-done:
+			return r
+		default:
+			return result{err: ctx.Err()}
+		}
+	}
+}
+
+// parseMulti parses arguments of multi key command, ok is false if they are
+// invalid
+func parseMulti(cmd Command, arg []byte) (args [][]byte, ok bool) {
+	if len(bytes.TrimSpace(arg)) == 0 {
+		return nil, false
+	}
+
+	args = parseArg(arg)
+	switch cmd {
+	case CommandMSet:
+		if len(args)%2 != 0 {
+			return nil, false
+		}
+	case CommandRename, CommandRenameNX, CommandCopy:
+		if len(args) != 2 || len(args[0]) == 0 || len(args[1]) == 0 {
+			return nil, false
+		}
+	}
+	return args, true
+}
+
+// execMulti executes multi key command with parsed arguments args, shards of
+// all keys must be owned by caller. Mutating command is passed to Feed if it
+// succeeds.
+func (d *Database) execMulti(cmd Command, arg []byte, args [][]byte) result {
+	var r result
+	switch cmd {
+	case CommandMGet:
+		r = d.mget(args)
+	case CommandMSet:
+		r = d.mset(args)
+	case CommandMRemove:
+		r = d.mremove(args)
+	case CommandRename, CommandRenameNX:
+		r = d.rename(args[0], args[1], cmd == CommandRenameNX)
+	case CommandCopy:
+		r = d.copyKey(args[0], args[1])
+	default:
+		r = result{err: ErrInvalidCommand}
+	}
+	if r.err == nil && d.feed != nil && cmd.Mutating() {
+		d.feed(cmd, arg)
+	}
+	return r
+}
+
+// mget returns values of string keys, other keys are returned as nil
+func (d *Database) mget(names [][]byte) result {
+	values := make([]Reply, len(names))
+	for i, name := range names {
+		s, k := d.shard(name), key(name)
+		if v, ok := s.m[k].(str); ok {
+			s.access(k)
+			values[i] = StringReply(v)
+		} else {
+			values[i] = NilReply()
+		}
+	}
+	return result{reply: ArrayReply(values...)}
+}
+
+// mset sets values of string keys, nothing is set if any key has other type
+// or memory can not be reclaimed
+func (d *Database) mset(args [][]byte) result {
+	grow := make(map[*shard]int)
+	for i := 0; i < len(args); i += 2 {
+		s, k := d.shard(args[i]), key(args[i])
+		if v, ok := s.m[k]; ok {
+			if _, ok := v.(str); !ok {
+				return resultInvalidType
+			}
+		}
+		grow[s] += s.growth(k, len(args[i+1]))
+	}
+
+	// keys are evicted only after every key is checked
+	for _, s := range d.shards {
+		if size, ok := grow[s]; ok {
+			if err := s.reclaim(size); err != nil {
+				return result{err: err}
+			}
+		}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		s, k := d.shard(args[i]), key(args[i])
+		s.m[k] = str(args[i+1])
+		s.update(k)
+	}
+	return resultOk
+}
+
+// mremove removes keys and returns number of removed keys
+func (d *Database) mremove(names [][]byte) result {
+	n := 0
+	for _, name := range names {
+		s, k := d.shard(name), key(name)
+		if _, ok := s.m[k]; ok {
+			s.drop(k)
+			n++
+		}
+	}
+	return result{reply: IntegerReply(int64(n))}
+}
+
+// mhget returns values of dict fields, missing fields are returned as nil
+func (s *shard) mhget(arg []byte) result {
+	args := parseArg(arg)
+	if len(args) < 2 || len(args[0]) == 0 {
+		return resultInvalidFormat
+	}
+
+	k := key(args[0])
+	v, ok := s.m[k]
+	if !ok {
+		return resultNotFound
+	}
+
+	dv, ok := v.(*dict)
+	if !ok {
+		return resultInvalidType
+	}
+	s.access(k)
+
+	values := make([]Reply, len(args)-1)
+	for i, f := range args[1:] {
+		if v, ok := dv.m[key(f)]; ok {
+			values[i] = StringReply(v)
+		} else {
+			values[i] = NilReply()
+		}
+	}
+	return result{reply: ArrayReply(values...)}
+}
+
+// mhset sets values of dict fields, dict is created if key does not exist
+func (s *shard) mhset(arg []byte) result {
+	args := parseArg(arg)
+	if len(args) < 3 || len(args)%2 != 1 || len(args[0]) == 0 {
+		return resultInvalidFormat
+	}
+
+	k := key(args[0])
+	n := 0
+	for _, a := range args[1:] {
+		n += len(a)
+	}
+	if err := s.reclaim(s.growth(k, n+sizeOverhead*(len(args)-1)/2)); err != nil {
+		return result{err: err}
+	}
+
+	v, ok := s.m[k]
+	if !ok {
+		v = newDict()
+	}
+
+	dv, ok := v.(*dict)
+	if !ok {
+		return resultInvalidType
+	}
+
+	for i := 1; i < len(args); i += 2 {
+		v := args[i+1]
+		if v == nil {
+			v = []byte{} // nil value removes field
+		}
+		dv.setKey(args[i], v)
+	}
+	s.m[k] = dv
+	s.update(k)
+
+	return resultOk
+}
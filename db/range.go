@@ -0,0 +1,100 @@
+package db
+
+import "strconv"
+
+// hgetall returns fields and values of dict as array of field, value pairs
+func (s *shard) hgetall(arg []byte) result {
+	args := parseArg(arg)
+	if len(args) != 1 || len(args[0]) == 0 {
+		return resultInvalidFormat
+	}
+
+	k := key(args[0])
+	v, ok := s.m[k]
+	if !ok {
+		return resultNotFound
+	}
+
+	dv, ok := v.(*dict)
+	if !ok {
+		return resultInvalidType
+	}
+	s.access(k)
+
+	return result{reply: dv.all(false)}
+}
+
+// lrange returns elements of list from start to stop index inclusive, whole
+// list is returned if indexes are omitted
+func (s *shard) lrange(arg []byte) result {
+	args := parseArg(arg)
+	if (len(args) != 1 && len(args) != 3) || len(args[0]) == 0 {
+		return resultInvalidFormat
+	}
+
+	start, stop := 0, -1
+	if len(args) == 3 {
+		var err1, err2 error
+		start, err1 = strconv.Atoi(string(args[1]))
+		stop, err2 = strconv.Atoi(string(args[2]))
+		if err1 != nil || err2 != nil {
+			return resultInvalidIndex
+		}
+	}
+
+	k := key(args[0])
+	v, ok := s.m[k]
+	if !ok {
+		return resultNotFound
+	}
+
+	lv, ok := v.(*list)
+	if !ok {
+		return resultInvalidType
+	}
+	s.access(k)
+
+	return result{reply: lv.slice(start, stop, false)}
+}
+
+// all returns array of field, value pairs of dict, values are copied if clone
+// is set
+func (v *dict) all(clone bool) Reply {
+	items := make([]Reply, 0, 2*len(v.m))
+	for f, val := range v.m {
+		if clone {
+			val = append([]byte(nil), val...)
+		}
+		items = append(items, StringReply([]byte(f)), StringReply(val))
+	}
+	return ArrayReply(items...)
+}
+
+// slice returns array of list elements from start to stop index inclusive,
+// negative index counts from the end of list, -1 is the last element.
+// Indexes out of list are clamped. Elements are copied if clone is set.
+func (v *list) slice(start int, stop int, clone bool) Reply {
+	n := len(v.v)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+
+	items := []Reply{}
+	for i := start; i <= stop; i++ {
+		e := v.v[i]
+		if clone {
+			e = append([]byte(nil), e...)
+		}
+		items = append(items, StringReply(e))
+	}
+	return ArrayReply(items...)
+}
@@ -0,0 +1,90 @@
+package db
+
+import "time"
+
+// rename renames key src to dst with its TTL, existing dst is replaced
+// unless nx is set
+func (d *Database) rename(src []byte, dst []byte, nx bool) result {
+	ss, sk := d.shard(src), key(src)
+	ds, dk := d.shard(dst), key(dst)
+
+	v, ok := ss.m[sk]
+	if !ok {
+		return resultNotFound
+	}
+	if _, ok := ds.m[dk]; ok && nx {
+		return result{err: ErrKeyExists}
+	}
+	if sk == dk {
+		return resultOk
+	}
+
+	// value moved to other shard is reclaimed there before src is dropped,
+	// failure leaves src intact
+	if ss != ds {
+		size := keyOverhead + len(dk) + v.size()
+		if u, ok := ds.u[dk]; ok {
+			size -= u.size
+		}
+		if err := ds.reclaim(size); err != nil {
+			return result{err: err}
+		}
+	}
+
+	ttl := ss.remaining(sk)
+	ss.drop(sk)
+	ds.replace(dk, v, ttl)
+
+	return resultOk
+}
+
+// copyKey copies value of key src with its TTL to dst, existing dst is
+// replaced
+func (d *Database) copyKey(src []byte, dst []byte) result {
+	ss, sk := d.shard(src), key(src)
+	ds, dk := d.shard(dst), key(dst)
+
+	v, ok := ss.m[sk]
+	if !ok {
+		return resultNotFound
+	}
+	if sk == dk {
+		return resultOk
+	}
+
+	ss.access(sk)
+	ttl := ss.remaining(sk)
+	size := keyOverhead + len(dk) + v.size()
+	if u, ok := ds.u[dk]; ok {
+		size -= u.size
+	}
+	if err := ds.reclaim(size); err != nil {
+		return result{err: err}
+	}
+	ds.replace(dk, v.clone(), ttl)
+
+	return resultOk
+}
+
+// remaining returns time left until key k expires, 0 if key has no TTL
+func (s *shard) remaining(k key) time.Duration {
+	u, ok := s.u[k]
+	if !ok || u.expire.IsZero() {
+		return 0
+	}
+	if ttl := time.Until(u.expire); ttl > 0 {
+		return ttl
+	}
+	return time.Nanosecond
+}
+
+// replace sets value of key k dropping its previous value and TTL, key
+// expires after ttl unless it is 0
+func (s *shard) replace(k key, v value, ttl time.Duration) {
+	s.drop(k)
+	s.m[k] = v
+	s.update(k)
+	if ttl > 0 {
+		s.expire(k, ttl)
+	}
+}
@@ -0,0 +1,230 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+)
+
+// A ReplyType is type of command reply, it is also prefix of encoded reply
+type ReplyType byte
+
+// Types of replies
+const (
+	ReplyString  ReplyType = '$'
+	ReplyInteger ReplyType = ':'
+	ReplyArray   ReplyType = '*'
+	ReplyNil     ReplyType = '_'
+	ReplyError   ReplyType = '!'
+)
+
+// A Reply represents typed reply of command. Str holds value of string
+// reply or message of error reply, Int value of integer reply and Array
+// items of array reply.
+type Reply struct {
+	Type  ReplyType
+	Str   []byte
+	Int   int64
+	Array []Reply
+}
+
+// StringReply returns string reply with value v
+func StringReply(v []byte) Reply {
+	return Reply{Type: ReplyString, Str: v}
+}
+
+// IntegerReply returns integer reply with value n
+func IntegerReply(n int64) Reply {
+	return Reply{Type: ReplyInteger, Int: n}
+}
+
+// ArrayReply returns array reply of items
+func ArrayReply(items ...Reply) Reply {
+	if items == nil {
+		items = []Reply{}
+	}
+	return Reply{Type: ReplyArray, Array: items}
+}
+
+// NilReply returns reply of missing value
+func NilReply() Reply {
+	return Reply{Type: ReplyNil}
+}
+
+// ErrorReply returns error reply with message of err, it is used for items
+// of array replies, failed commands return error
+func ErrorReply(err error) Reply {
+	return Reply{Type: ReplyError, Str: []byte(err.Error())}
+}
+
+// Text returns reply in text protocol: string as is, integer in decimal,
+// nil as empty string and items of array separated by commas. Text does not
+// distinguish missing values from empty ones.
+func (r Reply) Text() []byte {
+	switch r.Type {
+	case ReplyString, ReplyError:
+		return r.Str
+	case ReplyInteger:
+		return strconv.AppendInt(nil, r.Int, 10)
+	case ReplyArray:
+		var b []byte
+		for i, item := range r.Array {
+			if i > 0 {
+				b = append(b, ',')
+			}
+			b = append(b, item.Text()...)
+		}
+		return b
+	}
+	return nil
+}
+
+// Typed returns reply in typed protocol. Every value starts with its type
+// prefix, array prefix is followed by number of items and the items, all
+// separated by commas. Commas and backslashes inside strings are escaped
+// with backslash, CR and LF are encoded as \r and \n, so reply fits single
+// line.
+//
+//	"value"             $value
+//	42                  :42
+//	nil                 _
+//	["a", nil, "b,c"]   *3,$a,_,$b\,c
+func (r Reply) Typed() []byte {
+	return r.appendTyped(nil)
+}
+
+// appendTyped appends typed encoding of reply to b, zero Reply is encoded
+// as empty string
+func (r Reply) appendTyped(b []byte) []byte {
+	if r.Type == 0 {
+		r.Type = ReplyString
+	}
+	b = append(b, byte(r.Type))
+	switch r.Type {
+	case ReplyString, ReplyError:
+		for _, c := range r.Str {
+			switch c {
+			case ',', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			default:
+				b = append(b, c)
+			}
+		}
+	case ReplyInteger:
+		b = strconv.AppendInt(b, r.Int, 10)
+	case ReplyArray:
+		b = strconv.AppendInt(b, int64(len(r.Array)), 10)
+		for _, item := range r.Array {
+			b = item.appendTyped(append(b, ','))
+		}
+	}
+	return b
+}
+
+// ParseReply decodes reply encoded by Typed
+func ParseReply(b []byte) (Reply, error) {
+	r, rest, err := parseReply(b)
+	if err != nil {
+		return Reply{}, err
+	}
+	if len(rest) > 0 {
+		return Reply{}, ErrInvalidFormat
+	}
+	return r, nil
+}
+
+// parseReply decodes single value and returns the rest of b
+func parseReply(b []byte) (Reply, []byte, error) {
+	if len(b) == 0 {
+		return Reply{}, nil, ErrInvalidFormat
+	}
+
+	t, b := ReplyType(b[0]), b[1:]
+	switch t {
+	case ReplyString, ReplyError:
+		v := []byte{}
+		for len(b) > 0 && b[0] != ',' {
+			c := b[0]
+			if c == '\\' {
+				if len(b) == 1 {
+					return Reply{}, nil, ErrInvalidFormat
+				}
+				switch b[1] {
+				case 'n':
+					c = '\n'
+				case 'r':
+					c = '\r'
+				default:
+					c = b[1]
+				}
+				b = b[1:]
+			}
+			v = append(v, c)
+			b = b[1:]
+		}
+		return Reply{Type: t, Str: v}, b, nil
+
+	case ReplyInteger:
+		n, rest := number(b)
+		i, err := strconv.ParseInt(string(n), 10, 64)
+		if err != nil {
+			return Reply{}, nil, ErrInvalidFormat
+		}
+		return IntegerReply(i), rest, nil
+
+	case ReplyNil:
+		return NilReply(), b, nil
+
+	case ReplyArray:
+		n, rest := number(b)
+		count, err := strconv.Atoi(string(n))
+		if err != nil || count < 0 || count > len(rest) {
+			return Reply{}, nil, ErrInvalidFormat
+		}
+
+		items := make([]Reply, count)
+		for i := range items {
+			if len(rest) == 0 || rest[0] != ',' {
+				return Reply{}, nil, ErrInvalidFormat
+			}
+			if items[i], rest, err = parseReply(rest[1:]); err != nil {
+				return Reply{}, nil, err
+			}
+		}
+		return ArrayReply(items...), rest, nil
+	}
+
+	return Reply{}, nil, ErrInvalidFormat
+}
+
+// number splits b into leading number and the rest
+func number(b []byte) ([]byte, []byte) {
+	i := 0
+	for i < len(b) && b[i] != ',' {
+		i++
+	}
+	return b[:i], b[i:]
+}
+
+// Value returns reply as Go value: string reply as string, integer as int64,
+// nil as nil, array as []interface{} of item values and error as error
+func (r Reply) Value() interface{} {
+	switch r.Type {
+	case ReplyString:
+		return string(r.Str)
+	case ReplyInteger:
+		return r.Int
+	case ReplyArray:
+		values := make([]interface{}, len(r.Array))
+		for i, item := range r.Array {
+			values[i] = item.Value()
+		}
+		return values
+	case ReplyError:
+		return errors.New(string(r.Str))
+	}
+	return nil
+}
@@ -0,0 +1,691 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Script is a sequence of expressions, reply of script is value of the last
+// one. Values are replies: strings, integers, nil and arrays.
+//
+//	42, -1                 integer
+//	"text"                 string, \", \\, \n and \r are escaped
+//	nil                    nil
+//	name                   variable
+//	$1, $2...              script arguments, nil if missing
+//	(function arg...)      call
+//
+// Special forms evaluate their arguments on demand:
+//
+//	(var name value)       assign variable, value is returned
+//	(if cond then [else])  nil, 0, empty string and empty array are false
+//	(while cond body...)   loop, value of the last body expression is returned
+//	(do expr...)           sequence, value of the last expression is returned
+//	(and expr...)          the first false value or the last one
+//	(or expr...)           the first true value or the last one
+//
+// Functions:
+//
+//	(= a b)                1 if values are equal in text form, 0 otherwise
+//	(< a b), (> a b)       integer comparison, 1 or 0
+//	(not a)                1 if value is false, 0 otherwise
+//	(+ a...), (* a...)     integer sum and product, strings are converted
+//	(- a [b]), (/ a b), (% a b)
+//	(concat a...)          string of values in text form
+//	(len a)                length of string or array
+//	(list a...)            array of values
+//	(nth array i)          item of array, negative index counts from the end
+//	(error message)        fail script with message
+//
+// Database commands are called by name, arguments are joined by commas like
+// on command line and array arguments add all their items:
+//
+//	(if (get "C" "f") (do (var v (pop "A")) (if v (push "B" v))))
+//
+// Command failing with ErrNotFound or ErrKeyNotFound returns nil, other
+// errors fail the script. Changes made before failure are kept.
+
+// Script limits used when Config leaves them zero
+const (
+	DefaultScriptSteps   = 100000
+	DefaultScriptTimeout = 100 * time.Millisecond
+)
+
+// maxScriptDepth limits nesting of script expressions
+const maxScriptDepth = 64
+
+// maxScriptValue limits size in bytes of string or array value built by
+// script, array is measured in its text form
+const maxScriptValue = 1 << 20
+
+type nodeKind int
+
+const (
+	nodeLiteral nodeKind = iota
+	nodeVar
+	nodeArg
+	nodeCall
+)
+
+// A node is parsed expression of script
+type node struct {
+	kind  nodeKind
+	value Reply   // literal value
+	name  string  // name of variable or function
+	arg   int     // index of script argument
+	list  []*node // arguments of call
+}
+
+// A script is parsed script
+type script struct {
+	body []*node
+}
+
+// parseScript parses script at the beginning of b up to top level comma or
+// end of b. It returns the rest of b after comma, nil if there is no comma.
+func parseScript(b []byte) (*script, []byte, error) {
+	p := &parser{b: b}
+
+	var body []*node
+	for {
+		p.skipSpace()
+		if p.pos == len(p.b) {
+			break
+		}
+		if p.b[p.pos] == ',' {
+			p.pos++
+			if body == nil {
+				return nil, nil, ErrScriptSyntax
+			}
+			return &script{body}, p.b[p.pos:], nil
+		}
+
+		n, err := p.expr()
+		if err != nil {
+			return nil, nil, err
+		}
+		body = append(body, n)
+	}
+
+	if body == nil {
+		return nil, nil, ErrScriptSyntax
+	}
+	return &script{body}, nil, nil
+}
+
+// A parser reads expressions of script
+type parser struct {
+	b     []byte
+	pos   int
+	depth int
+}
+
+// skipSpace skips white space, line breaks escaped on command line as \n and
+// \r are white space too
+func (p *parser) skipSpace() {
+	for p.pos < len(p.b) {
+		switch p.b[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		case '\\':
+			if p.pos+1 == len(p.b) || (p.b[p.pos+1] != 'n' && p.b[p.pos+1] != 'r') {
+				return
+			}
+			p.pos += 2
+		default:
+			return
+		}
+	}
+}
+
+// expr parses single expression
+func (p *parser) expr() (*node, error) {
+	p.skipSpace()
+	if p.pos == len(p.b) {
+		return nil, ErrScriptSyntax
+	}
+
+	switch p.b[p.pos] {
+	case '(':
+		return p.call()
+	case '"':
+		return p.str()
+	case ')', ',':
+		return nil, ErrScriptSyntax
+	}
+	return p.atom()
+}
+
+// call parses "(name arg...)"
+func (p *parser) call() (*node, error) {
+	if p.depth++; p.depth > maxScriptDepth {
+		return nil, ErrScriptSyntax
+	}
+	defer func() { p.depth-- }()
+
+	p.pos++
+	var list []*node
+	for {
+		p.skipSpace()
+		if p.pos == len(p.b) {
+			return nil, ErrScriptSyntax
+		}
+		if p.b[p.pos] == ')' {
+			p.pos++
+			break
+		}
+
+		n, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+
+	if len(list) == 0 || list[0].kind != nodeVar {
+		return nil, ErrScriptSyntax
+	}
+	return &node{kind: nodeCall, name: list[0].name, list: list[1:]}, nil
+}
+
+// str parses string literal
+func (p *parser) str() (*node, error) {
+	p.pos++
+	v := []byte{}
+	for p.pos < len(p.b) {
+		c := p.b[p.pos]
+		p.pos++
+
+		switch c {
+		case '"':
+			return &node{kind: nodeLiteral, value: StringReply(v)}, nil
+		case '\\':
+			if p.pos == len(p.b) {
+				return nil, ErrScriptSyntax
+			}
+			c = p.b[p.pos]
+			p.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			}
+		}
+		v = append(v, c)
+	}
+	return nil, ErrScriptSyntax
+}
+
+// atom parses integer, nil, argument or name
+func (p *parser) atom() (*node, error) {
+	start := p.pos
+	for p.pos < len(p.b) && bytes.IndexByte([]byte(" \t\r\n()\",\\"), p.b[p.pos]) < 0 {
+		p.pos++
+	}
+	word := string(p.b[start:p.pos])
+	if word == "" {
+		return nil, ErrScriptSyntax
+	}
+
+	if n, err := strconv.ParseInt(word, 10, 64); err == nil {
+		return &node{kind: nodeLiteral, value: IntegerReply(n)}, nil
+	}
+
+	switch {
+	case word == "nil":
+		return &node{kind: nodeLiteral, value: NilReply()}, nil
+	case word[0] == '$':
+		i, err := strconv.Atoi(word[1:])
+		if err != nil || i < 1 {
+			return nil, ErrScriptSyntax
+		}
+		return &node{kind: nodeArg, arg: i - 1}, nil
+	case word[0] >= '0' && word[0] <= '9', word[0] == '-' && len(word) > 1 && word[1] >= '0' && word[1] <= '9':
+		return nil, ErrScriptSyntax
+	}
+	return &node{kind: nodeVar, name: word}, nil
+}
+
+// A vm executes script with engine loops parked
+type vm struct {
+	d        *Database
+	ctx      context.Context
+	args     [][]byte
+	vars     map[string]Reply
+	steps    int
+	deadline time.Time
+}
+
+// execScript executes script with arguments args, engine loops must be parked
+func (d *Database) execScript(ctx context.Context, p *script, args [][]byte) result {
+	m := &vm{
+		d:        d,
+		ctx:      ctx,
+		args:     args,
+		vars:     make(map[string]Reply),
+		deadline: time.Now().Add(d.scriptTimeout),
+	}
+
+	r := NilReply()
+	for _, n := range p.body {
+		var err error
+		if r, err = m.eval(n); err != nil {
+			return result{err: err}
+		}
+	}
+	return result{reply: r}
+}
+
+// eval evaluates expression
+func (m *vm) eval(n *node) (Reply, error) {
+	if m.steps++; m.steps > m.d.scriptSteps {
+		return Reply{}, ErrScriptSteps
+	}
+	if err := m.check(); err != nil {
+		return Reply{}, err
+	}
+
+	switch n.kind {
+	case nodeLiteral:
+		return n.value, nil
+	case nodeArg:
+		if n.arg < len(m.args) {
+			return StringReply(m.args[n.arg]), nil
+		}
+		return NilReply(), nil
+	case nodeVar:
+		v, ok := m.vars[n.name]
+		if !ok {
+			return Reply{}, scriptError("undefined variable " + n.name)
+		}
+		return v, nil
+	}
+
+	switch n.name {
+	case "var":
+		if len(n.list) != 2 || n.list[0].kind != nodeVar {
+			return Reply{}, arity(n)
+		}
+		v, err := m.eval(n.list[1])
+		if err != nil {
+			return Reply{}, err
+		}
+		m.vars[n.list[0].name] = v
+		return v, nil
+
+	case "if":
+		if len(n.list) != 2 && len(n.list) != 3 {
+			return Reply{}, arity(n)
+		}
+		cond, err := m.eval(n.list[0])
+		if err != nil {
+			return Reply{}, err
+		}
+		if truth(cond) {
+			return m.eval(n.list[1])
+		}
+		if len(n.list) == 3 {
+			return m.eval(n.list[2])
+		}
+		return NilReply(), nil
+
+	case "while":
+		if len(n.list) == 0 {
+			return Reply{}, arity(n)
+		}
+		r := NilReply()
+		for {
+			if err := m.check(); err != nil {
+				return Reply{}, err
+			}
+			cond, err := m.eval(n.list[0])
+			if err != nil {
+				return Reply{}, err
+			}
+			if !truth(cond) {
+				return r, nil
+			}
+			if r, err = m.seq(n.list[1:]); err != nil {
+				return Reply{}, err
+			}
+		}
+
+	case "do":
+		return m.seq(n.list)
+
+	case "and", "or":
+		r := NilReply()
+		for _, e := range n.list {
+			var err error
+			if r, err = m.eval(e); err != nil {
+				return Reply{}, err
+			}
+			if truth(r) != (n.name == "and") {
+				break
+			}
+		}
+		return r, nil
+	}
+
+	args := make([]Reply, len(n.list))
+	for i, e := range n.list {
+		var err error
+		if args[i], err = m.eval(e); err != nil {
+			return Reply{}, err
+		}
+	}
+
+	if fn, ok := scriptFunctions[n.name]; ok {
+		if len(args) < fn.min || (fn.max >= 0 && len(args) > fn.max) {
+			return Reply{}, arity(n)
+		}
+		if err := m.check(); err != nil {
+			return Reply{}, err
+		}
+		return fn.call(args)
+	}
+
+	cmd, err := ParseCommand([]byte(n.name))
+	if err != nil {
+		return Reply{}, scriptError("unknown function " + n.name)
+	}
+	return m.command(cmd, args)
+}
+
+// check checks time limit and context of script
+func (m *vm) check() error {
+	if time.Now().After(m.deadline) {
+		return ErrScriptTimeout
+	}
+	return m.ctx.Err()
+}
+
+// seq evaluates expressions and returns value of the last one
+func (m *vm) seq(list []*node) (Reply, error) {
+	r := NilReply()
+	for _, e := range list {
+		var err error
+		if r, err = m.eval(e); err != nil {
+			return Reply{}, err
+		}
+	}
+	return r, nil
+}
+
+// command executes database command called by script
+func (m *vm) command(cmd Command, args []Reply) (Reply, error) {
+	if err := checkSize(args...); err != nil {
+		return Reply{}, err
+	}
+	if err := m.check(); err != nil {
+		return Reply{}, err
+	}
+
+	// every value is single argument, commas and backslashes are escaped
+	var arg []byte
+	for i, a := range args {
+		if i > 0 {
+			arg = append(arg, ',')
+		}
+		arg = appendArg(arg, a.Text())
+	}
+
+	d := m.d
+	var r result
+	switch cmd {
+	case CommandGet, CommandSet, CommandPush, CommandPop, CommandRemove, CommandTTL,
+		CommandMHGet, CommandMHSet, CommandHGetAll, CommandLRange:
+		r = d.shard(FirstArg(arg)).exec(cmd, arg)
+	case CommandKeys:
+		if len(arg) == 0 {
+			r = d.allKeys()
+		} else {
+			r = d.shard(FirstArg(arg)).exec(cmd, arg)
+		}
+	case CommandMGet, CommandMSet, CommandMRemove, CommandRename, CommandRenameNX, CommandCopy:
+		if margs, ok := parseMulti(cmd, arg); ok {
+			r = d.execMulti(cmd, arg, margs)
+		} else {
+			r = resultInvalidFormat
+		}
+	case CommandDBSize:
+		r = d.size()
+	default:
+		return Reply{}, ErrScriptCommand
+	}
+
+	switch r.err {
+	case nil:
+		reply := r.typed()
+		if err := checkSize(reply); err != nil {
+			return Reply{}, err
+		}
+		return cloneReply(reply), nil
+	case ErrNotFound, ErrKeyNotFound:
+		return NilReply(), nil
+	}
+	return Reply{}, r.err
+}
+
+// cloneReply returns copy of reply not sharing memory with database values
+func cloneReply(r Reply) Reply {
+	if r.Str != nil {
+		r.Str = append([]byte{}, r.Str...)
+	}
+	if r.Array != nil {
+		items := make([]Reply, len(r.Array))
+		for i, item := range r.Array {
+			items[i] = cloneReply(item)
+		}
+		r.Array = items
+	}
+	return r
+}
+
+// checkSize returns ErrScriptValue if text form of values together exceeds
+// maxScriptValue
+func checkSize(values ...Reply) error {
+	n := 0
+	for _, r := range values {
+		if n += replySize(r, maxScriptValue-n+1); n > maxScriptValue {
+			return ErrScriptValue
+		}
+	}
+	return nil
+}
+
+// replySize returns length of value in text form, counting stops once it
+// exceeds limit
+func replySize(r Reply, limit int) int {
+	switch r.Type {
+	case ReplyArray:
+		n := len(r.Array)
+		for _, item := range r.Array {
+			if n > limit {
+				break
+			}
+			n += replySize(item, limit-n)
+		}
+		return n
+	case ReplyInteger:
+		return len(strconv.AppendInt(nil, r.Int, 10))
+	}
+	return len(r.Str)
+}
+
+// truth reports whether value is true: not nil, 0, empty string or array
+func truth(r Reply) bool {
+	switch r.Type {
+	case ReplyNil:
+		return false
+	case ReplyInteger:
+		return r.Int != 0
+	case ReplyArray:
+		return len(r.Array) != 0
+	}
+	return len(r.Str) != 0
+}
+
+// A scriptFunction is function of script language, max < 0 means any number
+// of arguments
+type scriptFunction struct {
+	min, max int
+	call     func(args []Reply) (Reply, error)
+}
+
+var scriptFunctions map[string]scriptFunction
+
+func init() {
+	scriptFunctions = map[string]scriptFunction{
+		"=": {2, 2, func(a []Reply) (Reply, error) {
+			eq := bytes.Equal(a[0].Text(), a[1].Text()) && (a[0].Type == ReplyNil) == (a[1].Type == ReplyNil)
+			return boolReply(eq), nil
+		}},
+		"<": {2, 2, func(a []Reply) (Reply, error) {
+			return compare(a, func(x, y int64) bool { return x < y })
+		}},
+		">": {2, 2, func(a []Reply) (Reply, error) {
+			return compare(a, func(x, y int64) bool { return x > y })
+		}},
+		"not": {1, 1, func(a []Reply) (Reply, error) {
+			return boolReply(!truth(a[0])), nil
+		}},
+		"+": {1, -1, func(a []Reply) (Reply, error) {
+			return arith(a, func(x, y int64) (int64, error) { return x + y, nil })
+		}},
+		"*": {1, -1, func(a []Reply) (Reply, error) {
+			return arith(a, func(x, y int64) (int64, error) { return x * y, nil })
+		}},
+		"-": {1, 2, func(a []Reply) (Reply, error) {
+			if len(a) == 1 {
+				a = []Reply{IntegerReply(0), a[0]}
+			}
+			return arith(a, func(x, y int64) (int64, error) { return x - y, nil })
+		}},
+		"/": {2, 2, func(a []Reply) (Reply, error) {
+			return arith(a, func(x, y int64) (int64, error) {
+				if y == 0 {
+					return 0, scriptError("division by zero")
+				}
+				return x / y, nil
+			})
+		}},
+		"%": {2, 2, func(a []Reply) (Reply, error) {
+			return arith(a, func(x, y int64) (int64, error) {
+				if y == 0 {
+					return 0, scriptError("division by zero")
+				}
+				return x % y, nil
+			})
+		}},
+		"concat": {0, -1, func(a []Reply) (Reply, error) {
+			if err := checkSize(a...); err != nil {
+				return Reply{}, err
+			}
+			b := []byte{}
+			for _, r := range a {
+				b = append(b, r.Text()...)
+			}
+			return StringReply(b), nil
+		}},
+		"len": {1, 1, func(a []Reply) (Reply, error) {
+			switch a[0].Type {
+			case ReplyArray:
+				return IntegerReply(int64(len(a[0].Array))), nil
+			case ReplyNil:
+				return IntegerReply(0), nil
+			}
+			return IntegerReply(int64(len(a[0].Text()))), nil
+		}},
+		"list": {0, -1, func(a []Reply) (Reply, error) {
+			if err := checkSize(a...); err != nil {
+				return Reply{}, err
+			}
+			return ArrayReply(a...), nil
+		}},
+		"nth": {2, 2, func(a []Reply) (Reply, error) {
+			if a[0].Type != ReplyArray {
+				return Reply{}, scriptError("nth of not an array")
+			}
+			i, err := integer(a[1])
+			if err != nil {
+				return Reply{}, err
+			}
+			if i < 0 {
+				i += int64(len(a[0].Array))
+			}
+			if i < 0 || i >= int64(len(a[0].Array)) {
+				return NilReply(), nil
+			}
+			return a[0].Array[i], nil
+		}},
+		"error": {1, 1, func(a []Reply) (Reply, error) {
+			return Reply{}, errors.New(string(a[0].Text()))
+		}},
+	}
+}
+
+// integer converts value to integer, strings are parsed
+func integer(r Reply) (int64, error) {
+	switch r.Type {
+	case ReplyInteger:
+		return r.Int, nil
+	case ReplyString:
+		if n, err := strconv.ParseInt(string(r.Str), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	return 0, scriptError("not an integer: " + string(r.Text()))
+}
+
+// arith folds integer values with op
+func arith(a []Reply, op func(x, y int64) (int64, error)) (Reply, error) {
+	n, err := integer(a[0])
+	if err != nil {
+		return Reply{}, err
+	}
+	for _, r := range a[1:] {
+		v, err := integer(r)
+		if err != nil {
+			return Reply{}, err
+		}
+		if n, err = op(n, v); err != nil {
+			return Reply{}, err
+		}
+	}
+	return IntegerReply(n), nil
+}
+
+// compare compares two integer values with less
+func compare(a []Reply, less func(x, y int64) bool) (Reply, error) {
+	x, err := integer(a[0])
+	if err != nil {
+		return Reply{}, err
+	}
+	y, err := integer(a[1])
+	if err != nil {
+		return Reply{}, err
+	}
+	return boolReply(less(x, y)), nil
+}
+
+func boolReply(b bool) Reply {
+	if b {
+		return IntegerReply(1)
+	}
+	return IntegerReply(0)
+}
+
+// scriptError returns error of script execution
+func scriptError(msg string) error {
+	return errors.New("script: " + msg)
+}
+
+// arity returns error of call with wrong number of arguments
+func arity(n *node) error {
+	return scriptError("wrong number of arguments of " + n.name)
+}
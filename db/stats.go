@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// A Stats contains database statistics
+type Stats struct {
+	Strings  int    // number of string keys
+	Dicts    int    // number of dict keys
+	Lists    int    // number of list keys
+	Expiring int    // number of keys with TTL
+	Memory   int    // approximate memory usage in bytes
+	Queue    int    // number of commands waiting in engine queues
+	Expired  uint64 // number of keys removed by TTL since start
+	Evicted  uint64 // number of keys evicted since start
+}
+
+// Stats collects database statistics. Shards are inspected one by one, so
+// statistics are not atomic snapshot of the whole database.
+func (d *Database) Stats() (Stats, error) {
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		stats = Stats{Expired: atomic.LoadUint64(&d.expired)}
+	)
+
+	err := d.broadcast(context.Background(), func(s *shard) {
+		defer wg.Done()
+
+		var r Stats
+		for _, v := range s.m {
+			switch v.(type) {
+			case str:
+				r.Strings++
+			case *dict:
+				r.Dicts++
+			case *list:
+				r.Lists++
+			}
+		}
+
+		mu.Lock()
+		stats.Strings += r.Strings
+		stats.Dicts += r.Dicts
+		stats.Lists += r.Lists
+		stats.Expiring += len(s.t)
+		stats.Memory += s.used
+		stats.Evicted += s.evicted
+		stats.Queue += len(s.queue)
+		mu.Unlock()
+	}, &wg)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	wg.Wait()
+
+	return stats, nil
+}
@@ -3,7 +3,7 @@ package db
 type str []byte
 
 func (v str) get() result {
-	return result{v, nil}
+	return result{value: v}
 }
 
 func (v str) set(k []byte) result {
@@ -30,3 +30,11 @@ func (v str) pop() result {
 func (v str) push(k []byte) result {
 	return resultInvalidType
 }
+
+func (v str) size() int {
+	return len(v)
+}
+
+func (v str) clone() value {
+	return str(append([]byte{}, v...))
+}
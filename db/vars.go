@@ -2,8 +2,9 @@ package db
 
 import (
 	"errors"
-	"log"
+	"log/slog"
 	"strconv"
+	"time"
 )
 
 // A Command represents engine command code passed into Database.Exec function
@@ -11,16 +12,58 @@ type Command uint
 
 // Command constants
 const (
-	CommandNop    Command = iota
-	CommandGet    Command = iota
-	CommandSet    Command = iota
-	CommandPush   Command = iota
-	CommandPop    Command = iota
-	CommandRemove Command = iota
-	CommandTTL    Command = iota
-	CommandKeys   Command = iota
+	CommandNop      Command = iota
+	CommandGet      Command = iota
+	CommandSet      Command = iota
+	CommandPush     Command = iota
+	CommandPop      Command = iota
+	CommandRemove   Command = iota
+	CommandTTL      Command = iota
+	CommandKeys     Command = iota
+	CommandMGet     Command = iota
+	CommandMSet     Command = iota
+	CommandMRemove  Command = iota
+	CommandMHGet    Command = iota
+	CommandMHSet    Command = iota
+	CommandHGetAll  Command = iota
+	CommandLRange   Command = iota
+	CommandRename   Command = iota
+	CommandRenameNX Command = iota
+	CommandCopy     Command = iota
+	CommandDBSize   Command = iota
+	CommandFlush    Command = iota
+	CommandEval     Command = iota
+	CommandEvalSHA  Command = iota
+	CommandScript   Command = iota
 )
 
+// Commands lists all engine commands
+var Commands = []Command{
+	CommandNop,
+	CommandGet,
+	CommandSet,
+	CommandPush,
+	CommandPop,
+	CommandRemove,
+	CommandTTL,
+	CommandKeys,
+	CommandMGet,
+	CommandMSet,
+	CommandMRemove,
+	CommandMHGet,
+	CommandMHSet,
+	CommandHGetAll,
+	CommandLRange,
+	CommandRename,
+	CommandRenameNX,
+	CommandCopy,
+	CommandDBSize,
+	CommandFlush,
+	CommandEval,
+	CommandEvalSHA,
+	CommandScript,
+}
+
 // ParseCommand resolves command name to Command constant
 func ParseCommand(cmd []byte) (Command, error) {
 	switch string(cmd) {
@@ -40,6 +83,36 @@ func ParseCommand(cmd []byte) (Command, error) {
 		return CommandTTL, nil
 	case "keys":
 		return CommandKeys, nil
+	case "mget":
+		return CommandMGet, nil
+	case "mset":
+		return CommandMSet, nil
+	case "mremove":
+		return CommandMRemove, nil
+	case "mhget":
+		return CommandMHGet, nil
+	case "mhset":
+		return CommandMHSet, nil
+	case "hgetall":
+		return CommandHGetAll, nil
+	case "lrange":
+		return CommandLRange, nil
+	case "rename":
+		return CommandRename, nil
+	case "renamenx":
+		return CommandRenameNX, nil
+	case "copy":
+		return CommandCopy, nil
+	case "dbsize":
+		return CommandDBSize, nil
+	case "flush":
+		return CommandFlush, nil
+	case "eval":
+		return CommandEval, nil
+	case "evalsha":
+		return CommandEvalSHA, nil
+	case "script":
+		return CommandScript, nil
 	default:
 		return CommandNop, ErrInvalidCommand
 	}
@@ -64,21 +137,73 @@ func (c Command) String() string {
 		return "ttl"
 	case CommandKeys:
 		return "keys"
+	case CommandMGet:
+		return "mget"
+	case CommandMSet:
+		return "mset"
+	case CommandMRemove:
+		return "mremove"
+	case CommandMHGet:
+		return "mhget"
+	case CommandMHSet:
+		return "mhset"
+	case CommandHGetAll:
+		return "hgetall"
+	case CommandLRange:
+		return "lrange"
+	case CommandRename:
+		return "rename"
+	case CommandRenameNX:
+		return "renamenx"
+	case CommandCopy:
+		return "copy"
+	case CommandDBSize:
+		return "dbsize"
+	case CommandFlush:
+		return "flush"
+	case CommandEval:
+		return "eval"
+	case CommandEvalSHA:
+		return "evalsha"
+	case CommandScript:
+		return "script"
 	default:
 		return strconv.Itoa(int(c))
 	}
 }
 
+// Mutating reports whether command modifies database state. Scripts may
+// modify it, Feed receives commands they execute instead of scripts.
+func (c Command) Mutating() bool {
+	switch c {
+	case CommandSet, CommandPush, CommandPop, CommandRemove, CommandTTL,
+		CommandMSet, CommandMRemove, CommandMHSet, CommandRename, CommandRenameNX, CommandCopy,
+		CommandFlush, CommandEval, CommandEvalSHA:
+		return true
+	default:
+		return false
+	}
+}
+
 // Errors returned by database
 var (
 	ErrInvalidCommand = errors.New("invalid command name")
 	ErrAlreadyClosed  = errors.New("database already closed")
-	ErrNotStarted     = errors.New("database is not started")
+	ErrNotStarted     = errors.New("database is not started") // Database is not created by New
 	ErrInvalidFormat  = errors.New("invalid command format")
 	ErrNotFound       = errors.New("not found")
 	ErrInvalidIndex   = errors.New("invalid index")
 	ErrInvalidType    = errors.New("invalid type")
 	ErrKeyNotFound    = errors.New("key not found")
+	ErrKeyExists      = errors.New("key already exists")
+	ErrOutOfMemory    = errors.New("out of memory")
+	ErrInvalidPolicy  = errors.New("invalid eviction policy")
+	ErrScriptSyntax   = errors.New("script syntax error")
+	ErrScriptSteps    = errors.New("script step limit exceeded")
+	ErrScriptTimeout  = errors.New("script time limit exceeded")
+	ErrScriptCommand  = errors.New("command is not allowed in script")
+	ErrScriptNotFound = errors.New("script not found")
+	ErrScriptValue    = errors.New("script value size limit exceeded")
 )
 
 // An Event represents event code passed into user-defined event handler
@@ -87,14 +212,76 @@ type Event uint
 // Event constants
 const (
 	EventExpired = iota
+	EventEvicted
 )
 
-// EventHandler declares type of user-defined event handler for database engine events
+// EventHandler declares type of user-defined event handler for database engine events.
+// EventEvicted is raised from the engine loop, so handler must not call Database.Exec.
 type EventHandler func(e Event, name []byte)
 
+// A Feed receives every successfully executed mutating command, including
+// removes caused by expiration and eviction. Feed is called from engine loops,
+// concurrently if database has several shards, and must not retain arg.
+type Feed func(cmd Command, arg []byte)
+
+// An EvictionPolicy represents the way keys are evicted when memory limit is reached
+type EvictionPolicy uint
+
+// EvictionPolicy constants
+const (
+	EvictionNone        EvictionPolicy = iota // return ErrOutOfMemory on write
+	EvictionAllKeysLRU  EvictionPolicy = iota // evict least recently used keys
+	EvictionAllKeysLFU  EvictionPolicy = iota // evict least frequently used keys
+	EvictionVolatileLRU EvictionPolicy = iota // evict least recently used keys with TTL
+	EvictionRandom      EvictionPolicy = iota // evict random keys
+)
+
+// ParseEvictionPolicy resolves eviction policy name to EvictionPolicy constant
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "noeviction":
+		return EvictionNone, nil
+	case "allkeys-lru":
+		return EvictionAllKeysLRU, nil
+	case "allkeys-lfu":
+		return EvictionAllKeysLFU, nil
+	case "volatile-lru":
+		return EvictionVolatileLRU, nil
+	case "allkeys-random":
+		return EvictionRandom, nil
+	default:
+		return EvictionNone, ErrInvalidPolicy
+	}
+}
+
+// String implements fmt.Stringer interface
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictionNone:
+		return "noeviction"
+	case EvictionAllKeysLRU:
+		return "allkeys-lru"
+	case EvictionAllKeysLFU:
+		return "allkeys-lfu"
+	case EvictionVolatileLRU:
+		return "volatile-lru"
+	case EvictionRandom:
+		return "allkeys-random"
+	default:
+		return strconv.Itoa(int(p))
+	}
+}
+
 // Config contains user-defined parameters to initialize engine
 type Config struct {
-	Log         *log.Logger
+	Log         *slog.Logger
 	QueueLength uint
 	Handler     EventHandler
+	Shards      uint           // number of engine loops, 0 - single loop
+	MaxMemory   uint64         // approximate memory limit in bytes, 0 - unlimited
+	Eviction    EvictionPolicy // policy applied when MaxMemory is reached
+
+	// limits of single script, all engine loops are parked while it runs
+	ScriptSteps   int           // evaluated expressions, 0 - DefaultScriptSteps
+	ScriptTimeout time.Duration // run time, 0 - DefaultScriptTimeout
 }
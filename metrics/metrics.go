@@ -0,0 +1,282 @@
+// Package metrics implements minimal metrics registry exposed in Prometheus
+// text format, and instrumentation of stash server and database.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// A collector writes its samples in Prometheus text format
+type collector interface {
+	collect(w *bufio.Writer)
+}
+
+// A Registry keeps metrics and writes them in Prometheus text format
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates empty metrics registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// WriteTo implements io.WriterTo interface, writes all metrics in Prometheus
+// text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.collect(bw)
+	}
+	err := bw.Flush()
+
+	return cw.n, err
+}
+
+// ServeHTTP implements http.Handler interface, serves metrics scrape request
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// A countingWriter counts bytes written to underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// A Counter represents monotonically increasing value
+type Counter struct {
+	v uint64 // accessed atomically
+}
+
+// Add increases counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Inc increases counter by 1
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Value returns current counter value
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// A CounterVec represents counters partitioned by single label
+type CounterVec struct {
+	name, help, label string
+
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// CounterVec registers new counter vector
+func (r *Registry) CounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{name: name, help: help, label: label, counters: make(map[string]*Counter)}
+	r.register(v)
+	return v
+}
+
+// With returns counter for label value
+func (v *CounterVec) With(value string) *Counter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	c, ok := v.counters[value]
+	if !ok {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+func (v *CounterVec) collect(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+
+	v.mu.Lock()
+	values := make([]string, 0, len(v.counters))
+	for value := range v.counters {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	counters := make([]*Counter, len(values))
+	for i, value := range values {
+		counters[i] = v.counters[value]
+	}
+	v.mu.Unlock()
+
+	for i, value := range values {
+		writeSample(w, v.name, label(v.label, value), float64(counters[i].Value()))
+	}
+}
+
+// A funcMetric represents metric which value is obtained on collection
+type funcMetric struct {
+	name, help, kind string
+	fn               func() float64
+}
+
+// GaugeFunc registers gauge which value is returned by fn
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{name, help, "gauge", fn})
+}
+
+// CounterFunc registers counter which value is returned by fn
+func (r *Registry) CounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{name, help, "counter", fn})
+}
+
+func (m *funcMetric) collect(w *bufio.Writer) {
+	writeHeader(w, m.name, m.help, m.kind)
+	writeSample(w, m.name, "", m.fn())
+}
+
+// A Histogram counts observed values in configured buckets
+type Histogram struct {
+	count   uint64 // accessed atomically
+	sum     uint64 // float64 bits, accessed atomically
+	buckets []float64
+	counts  []uint64 // per bucket, accessed atomically
+}
+
+// Observe adds single observation to histogram
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sum, old, sum) {
+			return
+		}
+	}
+}
+
+// A HistogramVec represents histograms partitioned by single label
+type HistogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu         sync.Mutex
+	histograms map[string]*Histogram
+}
+
+// HistogramVec registers new histogram vector with given upper bounds of
+// buckets, bounds must be sorted
+func (r *Registry) HistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	v := &HistogramVec{name: name, help: help, label: label, buckets: buckets,
+		histograms: make(map[string]*Histogram)}
+	r.register(v)
+	return v
+}
+
+// With returns histogram for label value
+func (v *HistogramVec) With(value string) *Histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	h, ok := v.histograms[value]
+	if !ok {
+		h = &Histogram{buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+		v.histograms[value] = h
+	}
+	return h
+}
+
+func (v *HistogramVec) collect(w *bufio.Writer) {
+	writeHeader(w, v.name, v.help, "histogram")
+
+	v.mu.Lock()
+	values := make([]string, 0, len(v.histograms))
+	for value := range v.histograms {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	histograms := make([]*Histogram, len(values))
+	for i, value := range values {
+		histograms[i] = v.histograms[value]
+	}
+	v.mu.Unlock()
+
+	for i, value := range values {
+		h := histograms[i]
+		l := label(v.label, value)
+
+		var cumulative uint64
+		for j, b := range h.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[j])
+			writeSample(w, v.name+"_bucket", l+","+label("le", formatFloat(b)), float64(cumulative))
+		}
+
+		count := atomic.LoadUint64(&h.count)
+		writeSample(w, v.name+"_bucket", l+","+label("le", "+Inf"), float64(count))
+		writeSample(w, v.name+"_sum", l, math.Float64frombits(atomic.LoadUint64(&h.sum)))
+		writeSample(w, v.name+"_count", l, float64(count))
+	}
+}
+
+// writeHeader writes HELP and TYPE lines of metric
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// writeSample writes single sample line, labels are comma separated
+// name="value" pairs
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// label formats single label pair
+func label(name, value string) string {
+	return name + "=\"" + labelEscaper.Replace(value) + "\""
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
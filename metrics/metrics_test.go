@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/server"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.CounterVec("test_total", "Test counter.", "name")
+	c.With("b").Add(2)
+	c.With("a").Inc()
+
+	h := r.HistogramVec("test_seconds", "Test histogram.", "name", []float64{0.1, 1})
+	h.With("x").Observe(0.05)
+	h.With("x").Observe(0.5)
+	h.With("x").Observe(5)
+
+	r.GaugeFunc("test_gauge", "Test gauge.", func() float64 { return 1.5 })
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	wants := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{name="a"} 1
+test_total{name="b"} 2
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{name="x",le="0.1"} 1
+test_seconds_bucket{name="x",le="1"} 2
+test_seconds_bucket{name="x",le="+Inf"} 3
+test_seconds_sum{name="x"} 5.55
+test_seconds_count{name="x"} 3
+# HELP test_gauge Test gauge.
+# TYPE test_gauge gauge
+test_gauge 1.5
+`
+	if buf.String() != wants {
+		t.Errorf("registry output:\n%s\nexpected:\n%s", buf.String(), wants)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	d, err := db.New(db.Config{QueueLength: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	time.Sleep(time.Millisecond)
+
+	m := New()
+	m.Database(d)
+	m.Server(&server.Stats{Connected: 3, BytesIn: 10})
+
+	handler := m.Handler(func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		c, err := db.ParseCommand(cmd)
+		if err != nil {
+			return db.Reply{}, errors.New("custom error")
+		}
+		return d.ExecReply(ctx, c, arg)
+	})
+
+	handler(context.Background(), []byte("set"), []byte("str,value"))
+	handler(context.Background(), []byte("set"), []byte("dict,key,value"))
+	handler(context.Background(), []byte("ttl"), []byte("dict,100000"))
+	handler(context.Background(), []byte("get"), []byte("none"))
+	handler(context.Background(), []byte("renamenx"), []byte("str,dict"))
+	handler(context.Background(), []byte("evalsha"), []byte("none"))
+	handler(context.Background(), []byte("unknown"), nil)
+
+	var buf bytes.Buffer
+	m.registry.WriteTo(&buf)
+	out := buf.String()
+
+	for _, line := range []string{
+		`stash_commands_total{command="set"} 2`,
+		`stash_commands_total{command="get"} 1`,
+		`stash_commands_total{command="other"} 1`,
+		`stash_errors_total{error="not found"} 1`,
+		`stash_errors_total{error="key already exists"} 1`,
+		`stash_errors_total{error="script not found"} 1`,
+		`stash_errors_total{error="other"} 1`,
+		`stash_command_duration_seconds_count{command="set"} 2`,
+		`stash_keys{type="str"} 1`,
+		`stash_keys{type="dict"} 1`,
+		`stash_keys{type="list"} 0`,
+		`stash_expiring_keys 1`,
+		`stash_queue_length 0`,
+		`stash_connected_clients 3`,
+		`stash_received_bytes_total 10`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics do not contain '%s'", line)
+		}
+	}
+}
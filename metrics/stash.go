@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/server"
+)
+
+// LatencyBuckets are upper bounds of command latency histogram buckets, in seconds
+var LatencyBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+
+// dbErrors are errors counted by name, other errors are counted as "other"
+var dbErrors = []error{
+	db.ErrInvalidCommand,
+	db.ErrAlreadyClosed,
+	db.ErrNotStarted,
+	db.ErrInvalidFormat,
+	db.ErrNotFound,
+	db.ErrInvalidIndex,
+	db.ErrInvalidType,
+	db.ErrKeyNotFound,
+	db.ErrKeyExists,
+	db.ErrOutOfMemory,
+	db.ErrScriptSyntax,
+	db.ErrScriptSteps,
+	db.ErrScriptTimeout,
+	db.ErrScriptCommand,
+	db.ErrScriptNotFound,
+	db.ErrScriptValue,
+}
+
+// A Metrics collects metrics of stash server and database
+type Metrics struct {
+	registry *Registry
+	commands *CounterVec
+	errors   *CounterVec
+	latency  *HistogramVec
+}
+
+// New creates metrics of stash server
+func New() *Metrics {
+	r := NewRegistry()
+	return &Metrics{
+		registry: r,
+		commands: r.CounterVec("stash_commands_total",
+			"Commands processed by command name.", "command"),
+		errors: r.CounterVec("stash_errors_total",
+			"Command errors by error.", "error"),
+		latency: r.HistogramVec("stash_command_duration_seconds",
+			"Command latency by command name.", "command", LatencyBuckets),
+	}
+}
+
+// ServeHTTP implements http.Handler interface, serves metrics scrape request
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m.registry.ServeHTTP(w, req)
+}
+
+// Handler wraps handler to count commands, errors and latency
+func (m *Metrics) Handler(next server.Handler) server.Handler {
+	return func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		start := time.Now()
+		reply, err := next(ctx, cmd, arg)
+		elapsed := time.Since(start)
+
+		name := "other"
+		if c, e := db.ParseCommand(cmd); e == nil {
+			name = c.String()
+		}
+
+		m.commands.With(name).Inc()
+		m.latency.With(name).Observe(elapsed.Seconds())
+		if err != nil {
+			m.errors.With(errorName(err)).Inc()
+		}
+
+		return reply, err
+	}
+}
+
+// errorName returns error label value
+func errorName(err error) string {
+	for _, e := range dbErrors {
+		if err == e {
+			return e.Error()
+		}
+	}
+	if _, ok := err.(*server.Redirect); ok {
+		return "moved"
+	}
+	return "other"
+}
+
+// Server registers metrics of server statistics
+func (m *Metrics) Server(s *server.Stats) {
+	m.registry.GaugeFunc("stash_connected_clients", "Currently connected clients.", func() float64 {
+		return float64(atomic.LoadInt64(&s.Connected))
+	})
+	m.registry.CounterFunc("stash_connections_total", "Accepted connections.", func() float64 {
+		return float64(atomic.LoadUint64(&s.Accepted))
+	})
+	m.registry.CounterFunc("stash_received_bytes_total", "Bytes received from clients.", func() float64 {
+		return float64(atomic.LoadUint64(&s.BytesIn))
+	})
+	m.registry.CounterFunc("stash_sent_bytes_total", "Bytes sent to clients.", func() float64 {
+		return float64(atomic.LoadUint64(&s.BytesOut))
+	})
+}
+
+// Database registers metrics of database statistics, statistics of several
+// logical databases are summed
+func (m *Metrics) Database(dbs ...*db.Database) {
+	m.registry.register(&dbCollector{dbs})
+}
+
+// A dbCollector collects database statistics once per scrape
+type dbCollector struct {
+	dbs []*db.Database
+}
+
+func (c *dbCollector) collect(w *bufio.Writer) {
+	var s db.Stats
+	for _, d := range c.dbs {
+		ds, err := d.Stats()
+		if err != nil {
+			return
+		}
+		s.Strings += ds.Strings
+		s.Dicts += ds.Dicts
+		s.Lists += ds.Lists
+		s.Expiring += ds.Expiring
+		s.Memory += ds.Memory
+		s.Queue += ds.Queue
+		s.Expired += ds.Expired
+		s.Evicted += ds.Evicted
+	}
+
+	writeHeader(w, "stash_queue_length", "Commands waiting in database queues.", "gauge")
+	writeSample(w, "stash_queue_length", "", float64(s.Queue))
+
+	writeHeader(w, "stash_keys", "Keys by type.", "gauge")
+	writeSample(w, "stash_keys", label("type", "str"), float64(s.Strings))
+	writeSample(w, "stash_keys", label("type", "dict"), float64(s.Dicts))
+	writeSample(w, "stash_keys", label("type", "list"), float64(s.Lists))
+
+	writeHeader(w, "stash_expiring_keys", "Keys with TTL.", "gauge")
+	writeSample(w, "stash_expiring_keys", "", float64(s.Expiring))
+
+	writeHeader(w, "stash_memory_bytes", "Approximate memory used by keys.", "gauge")
+	writeSample(w, "stash_memory_bytes", "", float64(s.Memory))
+
+	writeHeader(w, "stash_expired_keys_total", "Keys removed by TTL.", "counter")
+	writeSample(w, "stash_expired_keys_total", "", float64(s.Expired))
+
+	writeHeader(w, "stash_evicted_keys_total", "Keys evicted by memory limit.", "counter")
+	writeSample(w, "stash_evicted_keys_total", "", float64(s.Evicted))
+}
@@ -0,0 +1,204 @@
+package replication
+
+import (
+	"bufio"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/server"
+)
+
+// A link represents connection to single replica
+type link struct {
+	addr   net.Addr
+	sent   int64 // stream offset sent to replica
+	ack    int64 // stream offset acknowledged by replica
+	closed bool
+}
+
+// Sync serves "psync id, offset" command of replica, it must be registered
+// as server stream handler. Sync returns when replica disconnects.
+func (n *Node) Sync(conn *textproto.Conn, addr net.Addr, arg []byte) error {
+	id, offset, err := parseSync(arg)
+	if err != nil {
+		conn.PrintfLine("%d %s", server.ServerOperationError, err)
+		return err
+	}
+
+	l := &link{addr: addr}
+
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		conn.PrintfLine("%d %s", server.ServerOperationError, ErrClosed)
+		return ErrClosed
+	}
+	partial := id == n.id && offset >= n.start && offset <= n.offset
+	if partial {
+		n.partial++
+		l.sent = offset
+	}
+	n.mu.Unlock()
+
+	if partial {
+		n.log.Info("partial resync", "replica", addr.String(), "offset", offset)
+		if err := conn.PrintfLine("%d continue %s", server.ServerOperationOk, id); err != nil {
+			return err
+		}
+	} else if err := n.fullSync(conn, l); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	l.ack = l.sent
+	n.links[l] = struct{}{}
+	n.mu.Unlock()
+
+	defer func() {
+		n.mu.Lock()
+		delete(n.links, l)
+		n.mu.Unlock()
+	}()
+
+	go n.readAcks(conn, l)
+
+	return n.stream(conn.W, l)
+}
+
+// fullSync sends snapshot of databases to replica
+func (n *Node) fullSync(conn *textproto.Conn, l *link) error {
+	var id string
+
+	lines, err := n.snapshot(func() {
+		n.mu.Lock()
+		id, l.sent = n.id, n.offset
+		n.full++
+		n.mu.Unlock()
+	})
+	if err != nil {
+		conn.PrintfLine("%d %s", server.ServerOperationError, err)
+		return err
+	}
+
+	n.log.Info("full resync", "replica", l.addr.String(), "commands", len(lines), "offset", l.sent)
+
+	if err := conn.PrintfLine("%d fullresync %s,%d", server.ServerOperationOk, id, l.sent); err != nil {
+		return err
+	}
+
+	w := conn.DotWriter()
+	for _, line := range lines {
+		if _, err := w.Write([]byte(line + "\n")); err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// snapshot returns commands recreating all databases, mark is called when
+// all of them are parked. Several databases are separated by select lines
+// and the last line selects database of the last command of backlog.
+func (n *Node) snapshot(mark func()) ([]string, error) {
+	var (
+		dumps    = make([][]string, len(n.dbs))
+		selected int
+	)
+
+	// every database is dumped while databases after it are parked too,
+	// they are parked in order of creation as db.Move does
+	var dump func(i int) error
+	dump = func(i int) error {
+		if i == len(n.dbs) {
+			mark()
+			n.mu.Lock()
+			selected = n.db
+			n.mu.Unlock()
+			return nil
+		}
+
+		var err error
+		derr := n.dbs[i].Dump(func() {
+			err = dump(i + 1)
+		}, func(cmd db.Command, arg []byte) {
+			dumps[i] = append(dumps[i], encodeLine(cmd, arg))
+		})
+		if derr != nil {
+			return derr
+		}
+		return err
+	}
+	if err := dump(0); err != nil {
+		return nil, err
+	}
+
+	if len(n.dbs) == 1 {
+		return dumps[0], nil
+	}
+
+	var lines []string
+	for i, d := range dumps {
+		lines = append(append(lines, selectLine(i)), d...)
+	}
+	return append(lines, selectLine(selected)), nil
+}
+
+// stream sends backlog to replica as soon as new commands are executed
+func (n *Node) stream(w *bufio.Writer, l *link) error {
+	for {
+		n.mu.Lock()
+		for l.sent == n.offset && !l.closed && !n.closed {
+			n.cond.Wait()
+		}
+		if l.closed || n.closed {
+			n.mu.Unlock()
+			return nil
+		}
+		if l.sent < n.start {
+			n.mu.Unlock()
+			return ErrBacklogOverrun
+		}
+		data := append([]byte(nil), n.backlog[l.sent-n.start:]...)
+		n.mu.Unlock()
+
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		l.sent += int64(len(data))
+		n.mu.Unlock()
+	}
+}
+
+// readAcks receives offsets acknowledged by replica
+func (n *Node) readAcks(conn *textproto.Conn, l *link) {
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			break
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "ack" {
+			continue
+		}
+
+		if offset, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			n.mu.Lock()
+			l.ack = offset
+			n.mu.Unlock()
+		}
+	}
+
+	n.mu.Lock()
+	l.closed = true
+	n.cond.Broadcast()
+	n.mu.Unlock()
+}
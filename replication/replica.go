@@ -0,0 +1,217 @@
+package replication
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/server"
+)
+
+// Replica timing parameters
+var (
+	ackInterval   = 100 * time.Millisecond
+	retryInterval = time.Second
+)
+
+// A replica replicates database from remote primary
+type replica struct {
+	n      *Node
+	addr   string
+	id     string
+	offset int64 // applied stream offset, accessed atomically
+	db     int   // database selected by stream
+
+	mu   sync.Mutex
+	conn *textproto.Conn
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newReplica(n *Node, addr string) *replica {
+	r := &replica{
+		n:      n,
+		addr:   addr,
+		id:     "?",
+		offset: -1,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	go r.run()
+
+	return r
+}
+
+// close stops replication and waits for replication loop exit
+func (r *replica) close() {
+	close(r.stop)
+
+	r.mu.Lock()
+	if r.conn != nil {
+		r.conn.Close()
+	}
+	r.mu.Unlock()
+
+	<-r.done
+}
+
+// applied returns stream offset applied to local database
+func (r *replica) applied() int64 {
+	return atomic.LoadInt64(&r.offset)
+}
+
+// run keeps replica connected to primary
+func (r *replica) run() {
+	defer close(r.done)
+
+	for {
+		if err := r.sync(); err != nil {
+			r.n.log.Warn("replication failed", "primary", r.addr, "err", err)
+		}
+
+		select {
+		case <-r.stop:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// sync connects to primary, requests resync and applies replication stream
+// until connection is broken
+func (r *replica) sync() error {
+	conn, err := textproto.Dial("tcp", r.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	r.mu.Lock()
+	select {
+	case <-r.stop:
+		r.mu.Unlock()
+		return nil
+	default:
+		r.conn = conn
+	}
+	r.mu.Unlock()
+
+	if r.n.auth != "" {
+		if _, err := conn.Cmd("auth %s", r.n.auth); err != nil {
+			return err
+		}
+		if _, _, err := conn.ReadCodeLine(server.ServerOperationOk); err != nil {
+			return err
+		}
+	}
+
+	if _, err := conn.Cmd("psync %s,%d", r.id, r.applied()); err != nil {
+		return err
+	}
+
+	_, line, err := conn.ReadCodeLine(server.ServerOperationOk)
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && fields[0] == "fullresync":
+		id, offset, err := parseSync([]byte(fields[1]))
+		if err != nil {
+			return ErrInvalidResponse
+		}
+		if err := r.load(conn); err != nil {
+			return err
+		}
+		r.id = id
+		atomic.StoreInt64(&r.offset, offset)
+		r.n.reset(id, offset, r.db)
+		r.n.log.Info("full resync", "primary", r.addr, "offset", offset)
+
+	case len(fields) == 2 && fields[0] == "continue" && fields[1] == r.id:
+		r.n.log.Info("partial resync", "primary", r.addr, "offset", r.applied())
+
+	default:
+		return ErrInvalidResponse
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.ack(conn, done)
+
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return err
+		}
+
+		r.apply(line)
+		atomic.AddInt64(&r.offset, int64(len(line)+1))
+	}
+}
+
+// load replaces local databases with snapshot received from primary
+func (r *replica) load(conn *textproto.Conn) error {
+	for _, d := range r.n.dbs {
+		if err := d.Clear(); err != nil {
+			return err
+		}
+	}
+	r.db = 0
+
+	snapshot := textproto.NewReader(bufio.NewReader(conn.DotReader()))
+	for {
+		line, err := snapshot.ReadLine()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		r.apply(line)
+	}
+}
+
+// apply executes single line of replication stream
+func (r *replica) apply(line string) {
+	if i, ok := parseSelect(line); ok {
+		r.db = i
+		return
+	}
+
+	cmd, arg, err := decodeLine(line)
+	if err == nil {
+		if r.db < len(r.n.dbs) {
+			_, err = r.n.dbs[r.db].Exec(cmd, arg)
+		} else {
+			err = server.ErrInvalidDatabase
+		}
+	}
+	if err != nil && err != db.ErrNotFound {
+		r.n.log.Warn("replicated command failed", "primary", r.addr, "cmd", line, "err", err)
+	}
+}
+
+// ack periodically reports applied offset to primary
+func (r *replica) ack(conn *textproto.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.PrintfLine("ack %d", r.applied()); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,354 @@
+// Package replication implements primary-replica replication of stash database.
+//
+// Replica connects to primary and sends "psync id, offset" command. Primary
+// replies with "fullresync id, offset" followed by dot-encoded snapshot of its
+// database, or with "continue id" if replica can continue from its offset
+// using replication backlog. After that primary streams every mutating command
+// line by line and replica periodically reports applied offset with
+// "ack offset" lines.
+//
+// Node replicating several logical databases inserts "select n" line into
+// snapshot and stream before commands of database other than the previous
+// one, replica applies following commands to database n.
+package replication
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/server"
+)
+
+// Errors returned by replication
+var (
+	ErrReadOnly        = errors.New("read only replica")
+	ErrBacklogOverrun  = errors.New("replica is behind replication backlog")
+	ErrInvalidResponse = errors.New("invalid primary response")
+	ErrClosed          = errors.New("replication closed")
+)
+
+// A Config contains replication parameters
+type Config struct {
+	Log     *slog.Logger
+	Backlog int    // size of replication backlog in bytes, 1MB by default
+	Primary string // address of primary to replicate from, empty - act as primary
+	Auth    string // password sent to primary with auth command, optional
+
+	// Databases are logical databases 1, 2... replicated along with database
+	// 0 passed to New, optional. Snapshot parks databases in index order, it
+	// must be order of their creation by db.New, see db.Move.
+	Databases []*db.Database
+}
+
+// A Replica describes replica connected to primary
+type Replica struct {
+	Addr   string
+	Offset int64 // last offset acknowledged by replica
+}
+
+// A Node manages replication of local database. Node always keeps backlog of
+// executed commands to serve its replicas, and optionally replicates database
+// from remote primary.
+type Node struct {
+	dbs  []*db.Database // logical databases by number
+	log  *slog.Logger
+	auth string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	id      string
+	backlog []byte
+	start   int64 // stream offset of backlog[0]
+	offset  int64 // stream offset of backlog end
+	db      int   // database of the last command of backlog
+	size    int
+	links   map[*link]struct{}
+	replica *replica
+	closed  bool
+
+	full    int // number of full resyncs served
+	partial int // number of partial resyncs served
+}
+
+// New attaches replication node to database d and databases of cfg
+func New(d *db.Database, cfg Config) (*Node, error) {
+	n := &Node{
+		dbs:   append([]*db.Database{d}, cfg.Databases...),
+		log:   cfg.Log,
+		auth:  cfg.Auth,
+		id:    newID(),
+		size:  cfg.Backlog,
+		links: make(map[*link]struct{}),
+	}
+	n.cond = sync.NewCond(&n.mu)
+
+	if n.log == nil {
+		n.log = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	}
+
+	if n.size <= 0 {
+		n.size = 1 << 20
+	}
+
+	for i, d := range n.dbs {
+		i := i
+		if err := d.SetFeed(func(cmd db.Command, arg []byte) { n.feed(i, cmd, arg) }); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Primary != "" {
+		if err := n.ReplicaOf(cfg.Primary); err != nil {
+			return nil, err
+		}
+	}
+
+	return n, nil
+}
+
+// Close stops replication and disconnects replicas
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	n.closed = true
+	r := n.replica
+	n.replica = nil
+	n.cond.Broadcast()
+	n.mu.Unlock()
+
+	if r != nil {
+		r.close()
+	}
+
+	var err error
+	for _, d := range n.dbs {
+		if e := d.SetFeed(nil); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ReplicaOf starts replication from primary at addr, empty addr stops
+// replication and turns node into primary
+func (n *Node) ReplicaOf(addr string) error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return ErrClosed
+	}
+	r := n.replica
+	n.replica = nil
+	if addr != "" {
+		n.replica = newReplica(n, addr)
+	}
+	n.mu.Unlock()
+
+	if r != nil {
+		r.close()
+		n.log.Info("replication stopped", "primary", r.addr)
+	}
+
+	return nil
+}
+
+// Replicating reports whether node replicates remote primary
+func (n *Node) Replicating() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.replica != nil
+}
+
+// Offset returns current offset of replication stream
+func (n *Node) Offset() int64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.offset
+}
+
+// Replicas returns replicas connected to node
+func (n *Node) Replicas() []Replica {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	r := make([]Replica, 0, len(n.links))
+	for l := range n.links {
+		r = append(r, Replica{l.addr.String(), l.ack})
+	}
+	return r
+}
+
+// Info returns "field:value" lines of replication info section
+func (n *Node) Info() ([]byte, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if r := n.replica; r != nil {
+		b := []byte("role:replica\nprimary:" + r.addr + "\noffset:")
+		return append(strconv.AppendInt(b, r.applied(), 10), '\n'), nil
+	}
+
+	b := strconv.AppendInt([]byte("role:primary\noffset:"), n.offset, 10)
+	b = strconv.AppendInt(append(b, "\nconnected_replicas:"...), int64(len(n.links)), 10)
+	return append(b, '\n'), nil
+}
+
+// Handler wraps database handler: it serves replication commands and rejects
+// mutating commands while node replicates remote primary.
+//
+//	replicaof host:port - replicate primary at host:port
+//	replicaof no one    - stop replication
+//	role                - replication role and offsets
+func (n *Node) Handler(next server.Handler) server.Handler {
+	return func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		switch string(cmd) {
+		case "replicaof":
+			addr := strings.TrimSpace(string(arg))
+			if addr == "" {
+				return db.Reply{}, db.ErrInvalidFormat
+			}
+			if addr == "no one" {
+				addr = ""
+			}
+			if err := n.ReplicaOf(addr); err != nil {
+				return db.Reply{}, err
+			}
+			return db.StringReply([]byte("Ok")), nil
+
+		case "role":
+			return db.StringReply(n.role()), nil
+		}
+
+		if c, err := db.ParseCommand(cmd); err == nil && c.Mutating() && n.Replicating() {
+			return db.Reply{}, ErrReadOnly
+		}
+
+		return next(ctx, cmd, arg)
+	}
+}
+
+// role returns "primary,offset[,replica:offset...]" or "replica,addr,offset"
+func (n *Node) role() []byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if r := n.replica; r != nil {
+		return strconv.AppendInt([]byte("replica,"+r.addr+","), r.applied(), 10)
+	}
+
+	b := strconv.AppendInt([]byte("primary,"), n.offset, 10)
+	for l := range n.links {
+		b = append(append(b, ','), l.addr.String()...)
+		b = strconv.AppendInt(append(b, ':'), l.ack, 10)
+	}
+	return b
+}
+
+// feed appends command executed by database i to replication backlog, select
+// line precedes it if the previous command is executed by other database
+func (n *Node) feed(i int, cmd db.Command, arg []byte) {
+	line := encodeLine(cmd, arg)
+
+	n.mu.Lock()
+	if i != n.db {
+		n.append(selectLine(i))
+		n.db = i
+	}
+	n.append(line)
+	if len(n.backlog) > 2*n.size {
+		drop := len(n.backlog) - n.size
+		n.backlog = append([]byte(nil), n.backlog[drop:]...)
+		n.start += int64(drop)
+	}
+	n.cond.Broadcast()
+	n.mu.Unlock()
+}
+
+// append appends line to backlog, n.mu must be held
+func (n *Node) append(line string) {
+	n.backlog = append(append(n.backlog, line...), '\n')
+	n.offset += int64(len(line) + 1)
+}
+
+// reset starts new replication history, used after full resync from primary,
+// selected is database of the last command of primary stream
+func (n *Node) reset(id string, offset int64, selected int) {
+	n.mu.Lock()
+	n.id = id
+	n.backlog = nil
+	n.start = offset
+	n.offset = offset
+	n.db = selected
+	for l := range n.links {
+		l.closed = true
+	}
+	n.cond.Broadcast()
+	n.mu.Unlock()
+}
+
+// encodeLine converts command to single line of replication stream
+func encodeLine(cmd db.Command, arg []byte) string {
+	return cmd.String() + " " + db.EncodeLine(string(arg))
+}
+
+// decodeLine parses line of replication stream
+func decodeLine(line string) (db.Command, []byte, error) {
+	name := line
+	arg := ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		name, arg = line[:i], line[i+1:]
+	}
+
+	cmd, err := db.ParseCommand([]byte(name))
+	if err != nil {
+		return cmd, nil, err
+	}
+
+	return cmd, []byte(db.DecodeLine(arg)), nil
+}
+
+// selectLine returns line switching stream to database i
+func selectLine(i int) string {
+	return "select " + strconv.Itoa(i)
+}
+
+// parseSelect parses select line of stream, ok is false for other lines
+func parseSelect(line string) (i int, ok bool) {
+	if !strings.HasPrefix(line, "select ") {
+		return 0, false
+	}
+	i, err := strconv.Atoi(line[len("select "):])
+	return i, err == nil
+}
+
+// newID generates random replication history identifier
+func newID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// parseSync parses "id, offset" argument
+func parseSync(arg []byte) (id string, offset int64, err error) {
+	fields := strings.Split(string(arg), ",")
+	if len(fields) != 2 {
+		return "", 0, db.ErrInvalidFormat
+	}
+
+	id = strings.TrimSpace(fields[0])
+	offset, err = strconv.ParseInt(strings.TrimSpace(fields[1]), 10, 64)
+	return
+}
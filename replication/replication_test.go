@@ -0,0 +1,383 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/maximp/stash/db"
+	"github.com/maximp/stash/server"
+)
+
+type testLog struct {
+	*testing.T
+}
+
+func (t *testLog) Write(p []byte) (n int, err error) {
+	t.Log(string(bytes.TrimSpace(p)))
+	return len(p), nil
+}
+
+func createNode(t *testing.T, primary string) (*db.Database, *Node) {
+	d, err := db.New(db.Config{
+		QueueLength: 10,
+		Shards:      2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Millisecond)
+
+	n, err := New(d, Config{
+		Log:     slog.New(slog.NewTextHandler(&testLog{t}, nil)),
+		Backlog: 1024,
+		Primary: primary,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d, n
+}
+
+func dbHandler(d *db.Database) server.Handler {
+	return func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		c, err := db.ParseCommand(cmd)
+		if err != nil {
+			return db.Reply{}, err
+		}
+		return d.ExecReply(ctx, c, arg)
+	}
+}
+
+// waitFor polls cond until it returns true or timeout expires
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestReplication(t *testing.T) {
+	ackInterval = 10 * time.Millisecond
+	retryInterval = 10 * time.Millisecond
+
+	pd, pn := createNode(t, "")
+	defer pd.Close()
+	defer pn.Close()
+
+	s, err := server.NewServer("127.0.0.1:7790", pn.Handler(dbHandler(pd)), &server.Config{
+		Streams: map[string]server.StreamHandler{"psync": pn.Sync},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		close(stopped)
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-stopped
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	primary := pn.Handler(dbHandler(pd))
+	var setup = []struct {
+		cmd string
+		arg string
+	}{
+		{"set", "str,value"},
+		{"set", "dict,key1,value1"},
+		{"set", "dict,key2,value2"},
+		{"push", "list,1"},
+		{"push", "list,2"},
+		{"ttl", "str,100000"},
+		{"set", "path,C:\\new\r\n\\r\\"},
+	}
+	for i, test := range setup {
+		if _, err := primary(context.Background(), []byte(test.cmd), []byte(test.arg)); err != nil {
+			t.Fatalf("[%d] - '%s %s' failed with %v", i, test.cmd, test.arg, err)
+		}
+	}
+	if err := pd.Set("api,str", []byte("a,b\\,c\\")); err != nil {
+		t.Fatal(err)
+	}
+	if err := pd.HSet("api,dict", "f,1", []byte{}); err != nil {
+		t.Fatal(err)
+	}
+
+	rd, rn := createNode(t, "127.0.0.1:7790")
+	defer rd.Close()
+	defer rn.Close()
+
+	replica := rn.Handler(dbHandler(rd))
+	get := func(arg string) string {
+		r, _ := replica(context.Background(), []byte("get"), []byte(arg))
+		return string(r.Text())
+	}
+
+	if !waitFor(func() bool { return get("list,1") == "2" }) {
+		t.Fatal("snapshot is not replicated")
+	}
+
+	var tests = []struct {
+		arg    string
+		result string
+	}{
+		{"str", "value"},
+		{"dict,key1", "value1"},
+		{"dict,key2", "value2"},
+		{"list", "2"},
+		{"path", "C:\\new\r\n\\r\\"},
+		{"api\\,str", "a,b\\,c\\"},
+		{"api\\,dict,f\\,1", ""},
+		{"api\\,dict", "1"},
+	}
+	for i, test := range tests {
+		if r := get(test.arg); r != test.result {
+			t.Errorf("[%d] - replica 'get %s' = '%s', expected: '%s'", i, test.arg, r, test.result)
+		}
+	}
+
+	if _, err := replica(context.Background(), []byte("set"), []byte("str,new")); err != ErrReadOnly {
+		t.Errorf("replica write returned %v, expected %v", err, ErrReadOnly)
+	}
+
+	// streaming
+	primary(context.Background(), []byte("set"), []byte("dict,key3,value3"))
+	primary(context.Background(), []byte("pop"), []byte("list"))
+	primary(context.Background(), []byte("remove"), []byte("str"))
+	primary(context.Background(), []byte("set"), []byte("path2,\\n\n\\\\r"))
+	pd.Push("api,list", []byte("x,y"))
+
+	if !waitFor(func() bool { return get("path2") == "\\n\n\\r" }) || get("api\\,list,0") != "x,y" ||
+		get("str") != "" || get("dict,key3") != "value3" || get("list") != "1" {
+		t.Error("commands are not replicated")
+	}
+
+	if !waitFor(func() bool {
+		r := pn.Replicas()
+		return len(r) == 1 && r[0].Offset == pn.Offset()
+	}) {
+		t.Errorf("replica offset is not acknowledged: %v, primary offset %d", pn.Replicas(), pn.Offset())
+	}
+
+	// short disconnect, partial resync
+	rn.mu.Lock()
+	rn.replica.mu.Lock()
+	rn.replica.conn.Close()
+	rn.replica.mu.Unlock()
+	rn.mu.Unlock()
+
+	primary(context.Background(), []byte("set"), []byte("str,again"))
+
+	if !waitFor(func() bool { return get("str") == "again" }) {
+		t.Error("commands are not replicated after reconnect")
+	}
+
+	pn.mu.Lock()
+	full, partial := pn.full, pn.partial
+	pn.mu.Unlock()
+	if full != 1 || partial != 1 {
+		t.Errorf("full resyncs = %d, partial resyncs = %d, expected 1, 1", full, partial)
+	}
+
+	// promotion
+	if r, err := replica(context.Background(), []byte("replicaof"), []byte("no one")); err != nil || string(r.Text()) != "Ok" {
+		t.Errorf("replicaof no one failed with '%s' (%v)", r.Text(), err)
+	}
+
+	if _, err := replica(context.Background(), []byte("set"), []byte("str,new")); err != nil {
+		t.Errorf("write after promotion failed with %v", err)
+	}
+
+	if r, _ := replica(context.Background(), []byte("role"), nil); !bytes.HasPrefix(r.Text(), []byte("primary,")) {
+		t.Errorf("role after promotion = '%s'", r.Text())
+	}
+}
+
+func TestReplicationDatabases(t *testing.T) {
+	ackInterval = 10 * time.Millisecond
+	retryInterval = 10 * time.Millisecond
+
+	create := func(primary string) ([]*db.Database, *Node) {
+		dbs := make([]*db.Database, 2)
+		for i := range dbs {
+			d, err := db.New(db.Config{QueueLength: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dbs[i] = d
+		}
+
+		n, err := New(dbs[0], Config{
+			Log:       slog.New(slog.NewTextHandler(&testLog{t}, nil)),
+			Primary:   primary,
+			Databases: dbs[1:],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dbs, n
+	}
+
+	pdbs, pn := create("")
+	defer pdbs[1].Close()
+	defer pdbs[0].Close()
+	defer pn.Close()
+
+	s, err := server.NewServer("127.0.0.1:7788", pn.Handler(dbHandler(pdbs[0])), &server.Config{
+		Streams: map[string]server.StreamHandler{"psync": pn.Sync},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		close(stopped)
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-stopped
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	// snapshot
+	pdbs[0].Exec(db.CommandSet, []byte("name,value0"))
+	pdbs[1].Exec(db.CommandSet, []byte("name,value1"))
+
+	rdbs, rn := create("127.0.0.1:7788")
+	defer rdbs[1].Close()
+	defer rdbs[0].Close()
+	defer rn.Close()
+
+	get := func(i int, name string) string {
+		r, _ := rdbs[i].Exec(db.CommandGet, []byte(name))
+		return string(r)
+	}
+
+	if !waitFor(func() bool { return get(1, "name") == "value1" }) || get(0, "name") != "value0" {
+		t.Fatal("snapshot is not replicated to its databases")
+	}
+
+	// stream
+	pdbs[1].Exec(db.CommandSet, []byte("other,1"))
+	pdbs[0].Exec(db.CommandSet, []byte("other,0"))
+	pdbs[1].Exec(db.CommandRemove, []byte("name"))
+
+	if !waitFor(func() bool { return get(1, "name") == "" }) ||
+		get(0, "other") != "0" || get(1, "other") != "1" || get(0, "name") != "value0" {
+		t.Error("commands are not replicated to their databases")
+	}
+
+	// replica backlog repeats primary stream, so its replicas can continue
+	if !waitFor(func() bool { return rn.replica.applied() == pn.Offset() }) {
+		t.Errorf("replica offset %d, primary offset %d", rn.replica.applied(), pn.Offset())
+	}
+	if rn.Offset() != pn.Offset() {
+		t.Errorf("replica backlog offset %d, primary offset %d", rn.Offset(), pn.Offset())
+	}
+}
+
+func TestBacklogTrim(t *testing.T) {
+	d, n := createNode(t, "")
+	defer d.Close()
+	defer n.Close()
+
+	for i := 0; i < 1000; i++ {
+		d.Exec(db.CommandSet, []byte("name,value"))
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.backlog) > 2*n.size || n.offset-n.start != int64(len(n.backlog)) {
+		t.Errorf("backlog size = %d, start = %d, offset = %d", len(n.backlog), n.start, n.offset)
+	}
+
+	if n.start == 0 {
+		t.Error("backlog is not trimmed")
+	}
+}
+
+func TestSnapshotMove(t *testing.T) {
+	dbs := make([]*db.Database, 2)
+	for i := range dbs {
+		d, err := db.New(db.Config{QueueLength: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		dbs[i] = d
+	}
+
+	n, err := New(dbs[0], Config{
+		Log:       slog.New(slog.NewTextHandler(&testLog{t}, nil)),
+		Databases: dbs[1:],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	dbs[0].Set("a", []byte("1"))
+	dbs[1].Set("b", []byte("2"))
+
+	// keys are moved back and forth in both directions during snapshots
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, m := range []struct {
+		src, dst *db.Database
+		name     string
+	}{
+		{dbs[0], dbs[1], "a"},
+		{dbs[1], dbs[0], "a"},
+		{dbs[1], dbs[0], "b"},
+		{dbs[0], dbs[1], "b"},
+	} {
+		wg.Add(1)
+		go func(src, dst *db.Database, name string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				db.Move(context.Background(), src, dst, []byte(name))
+			}
+		}(m.src, m.dst, m.name)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := n.snapshot(func() {}); err != nil {
+				t.Error(err)
+			}
+		}
+		close(stop)
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("snapshot and move deadlocked")
+	}
+}
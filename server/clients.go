@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maximp/stash/db"
+)
+
+// ErrClientNotFound is returned by client kill command for unknown address
+var ErrClientNotFound = errors.New("client not found")
+
+// A clients keeps registry of connected clients and serves client commands
+type clients struct {
+	mu       sync.Mutex
+	conns    map[*connection]struct{}
+	pause    time.Time   // commands are not executed until pause deadline
+	shutdown func() bool // reports whether server is shutting down
+	password string      // required by auth command, empty - no authentication
+}
+
+func newClients(shutdown func() bool) *clients {
+	return &clients{conns: make(map[*connection]struct{}), shutdown: shutdown}
+}
+
+func (r *clients) add(c *connection) {
+	r.mu.Lock()
+	r.conns[c] = struct{}{}
+	r.mu.Unlock()
+}
+
+func (r *clients) remove(c *connection) {
+	r.mu.Lock()
+	delete(r.conns, c)
+	r.mu.Unlock()
+}
+
+// closeIdle closes connections not executing command, it reports whether
+// all connections are closed
+func (r *clients) closeIdle() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for c := range r.conns {
+		c.mu.Lock()
+		if !c.busy {
+			c.Close()
+		}
+		c.mu.Unlock()
+	}
+	return len(r.conns) == 0
+}
+
+// closeAll closes all connections
+func (r *clients) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for c := range r.conns {
+		c.Close()
+	}
+}
+
+// authRequired reports whether clients must authenticate
+func (r *clients) authRequired() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.password != ""
+}
+
+// auth checks password of auth command
+func (r *clients) auth(arg []byte) error {
+	r.mu.Lock()
+	password := r.password
+	r.mu.Unlock()
+
+	if subtle.ConstantTimeCompare(bytes.TrimSpace(arg), []byte(password)) != 1 {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+// wait blocks while clients are paused
+func (r *clients) wait() {
+	for {
+		r.mu.Lock()
+		d := time.Until(r.pause)
+		r.mu.Unlock()
+
+		if d <= 0 {
+			return
+		}
+		time.Sleep(d)
+	}
+}
+
+// command serves client commands issued by connection c:
+//
+//	client list         - array of connected clients
+//	client setname name - set name of current connection
+//	client kill addr    - close connection of client at addr
+//	client pause ms     - suspend commands of all clients for ms milliseconds
+func (r *clients) command(c *connection, arg []byte) (db.Reply, error) {
+	fields := strings.Fields(string(arg))
+	if len(fields) == 0 {
+		return db.Reply{}, ErrInvalidArgument
+	}
+
+	switch fields[0] {
+	case "list":
+		if len(fields) != 1 {
+			return db.Reply{}, ErrInvalidArgument
+		}
+		return r.list(), nil
+
+	case "setname":
+		if len(fields) != 2 {
+			return db.Reply{}, ErrInvalidArgument
+		}
+		c.mu.Lock()
+		c.name = fields[1]
+		c.mu.Unlock()
+		return db.StringReply([]byte("Ok")), nil
+
+	case "kill":
+		if len(fields) != 2 {
+			return db.Reply{}, ErrInvalidArgument
+		}
+		if !r.kill(fields[1]) {
+			return db.Reply{}, ErrClientNotFound
+		}
+		return db.StringReply([]byte("Ok")), nil
+
+	case "pause":
+		if len(fields) != 2 {
+			return db.Reply{}, ErrInvalidArgument
+		}
+		ms, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return db.Reply{}, ErrInvalidArgument
+		}
+		r.mu.Lock()
+		r.pause = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		r.mu.Unlock()
+		return db.StringReply([]byte("Ok")), nil
+
+	default:
+		return db.Reply{}, ErrInvalidArgument
+	}
+}
+
+// list returns "addr=... name=... age=... idle=... db=... cmd=..." item per
+// client, age and idle time are in seconds
+func (r *clients) list() db.Reply {
+	r.mu.Lock()
+	conns := make([]*connection, 0, len(r.conns))
+	for c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].created.Before(conns[j].created) })
+
+	now := time.Now()
+	items := make([]db.Reply, 0, len(conns))
+	for _, c := range conns {
+		c.mu.Lock()
+		name, cmd, created, active, n := c.name, c.cmd, c.created, c.active, c.db
+		c.mu.Unlock()
+
+		b := []byte("addr=" + c.addr.String() + " name=" + name)
+		b = strconv.AppendInt(append(b, " age="...), int64(now.Sub(created)/time.Second), 10)
+		b = strconv.AppendInt(append(b, " idle="...), int64(now.Sub(active)/time.Second), 10)
+		b = strconv.AppendInt(append(b, " db="...), int64(n), 10)
+		b = append(b, " cmd="+cmd...)
+		items = append(items, db.StringReply(b))
+	}
+	return db.ArrayReply(items...)
+}
+
+// kill closes connection of client at addr
+func (r *clients) kill(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for c := range r.conns {
+		if c.addr.String() == addr {
+			c.logger.Info("client killed")
+			c.Close()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"context"
+	"sort"
+
+	"github.com/maximp/stash/db"
+)
+
+// builtinCommands are commands served by connection itself
+var builtinCommands = []string{"auth", "client", "hello", "quit", "select"}
+
+// Commands wraps handler to serve "command" command, it replies with sorted
+// array of names of commands served by handler, including "command" itself,
+// and by server. Clients use it for completion and help.
+func Commands(next Handler, names ...string) Handler {
+	all := append(append([]string{"command"}, builtinCommands...), names...)
+	sort.Strings(all)
+
+	list := make([]db.Reply, 0, len(all))
+	for i, name := range all {
+		if i == 0 || name != all[i-1] {
+			list = append(list, db.StringReply([]byte(name)))
+		}
+	}
+	reply := db.ArrayReply(list...)
+
+	return func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		if string(cmd) != "command" {
+			return next(ctx, cmd, arg)
+		}
+		if len(arg) != 0 {
+			return db.Reply{}, ErrInvalidArgument
+		}
+		return reply, nil
+	}
+}
@@ -1,18 +1,110 @@
 package server
 
-import "log"
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/maximp/stash/db"
+)
 
 // Constants for codes returned by network server
 const (
-	ServerOperationOk    = 200
-	ServerOperationError = 300
+	ServerOperationOk       = 200
+	ServerOperationError    = 300
+	ServerOperationRedirect = 301
+)
+
+// Protocol versions selected by client with hello command. Errors are sent
+// as error message in both protocols.
+const (
+	ProtocolText  = 1 // replies are encoded by db.Reply.Text, default
+	ProtocolTyped = 2 // replies are encoded by db.Reply.Typed
 )
 
+// Errors returned by server commands
+var (
+	ErrInvalidArgument = errors.New("invalid argument")
+	ErrInvalidSection  = errors.New("invalid info section")
+	ErrMaxClients      = errors.New("max number of clients reached")
+	ErrLineTooLong     = errors.New("command line too long")
+	ErrValueTooLong    = errors.New("argument too long")
+	ErrIdleTimeout     = errors.New("idle timeout")
+	ErrReadTimeout     = errors.New("read timeout")
+	ErrAuthRequired    = errors.New("authentication required")
+	ErrInvalidPassword = errors.New("invalid password")
+	ErrInvalidProtocol = errors.New("unsupported protocol version")
+	ErrInvalidDatabase = errors.New("invalid database index")
+)
+
+// A Redirect error returned by handler makes server reply with
+// ServerOperationRedirect code, client should repeat command at Addr
+type Redirect struct {
+	Slot int
+	Addr string
+}
+
+// Error implements error interface, returns "moved slot addr"
+func (r *Redirect) Error() string {
+	return "moved " + strconv.Itoa(r.Slot) + " " + r.Addr
+}
+
 // A Handler type represents server command handler
-type Handler func(cmd []byte, arg []byte) (result []byte, err error)
+type Handler func(ctx context.Context, cmd []byte, arg []byte) (reply db.Reply, err error)
+
+// databaseKey is context key of logical database selected by connection
+type databaseKey struct{}
+
+// Database returns index of logical database selected with select command by
+// connection executing command of ctx, handlers serving several databases
+// route command by it. Index is 0 if nothing is selected.
+func Database(ctx context.Context) int {
+	n, _ := ctx.Value(databaseKey{}).(int)
+	return n
+}
+
+// A StreamHandler takes over client connection after command registered in
+// Config.Streams. Connection is closed when handler returns.
+type StreamHandler func(conn *textproto.Conn, addr net.Addr, arg []byte) error
+
+// A Stats contains server statistics, fields are updated atomically
+type Stats struct {
+	BytesIn   uint64 // bytes received from clients
+	BytesOut  uint64 // bytes sent to clients
+	Accepted  uint64 // connections accepted since start
+	Commands  uint64 // commands processed since start
+	Connected int64  // currently connected clients
+}
+
+// A Limits represents limits protecting server from misbehaving clients,
+// zero value of any field means no limit
+type Limits struct {
+	MaxClients     int           // number of connected clients
+	IdleTimeout    time.Duration // time to wait for the next command
+	ReadTimeout    time.Duration // time to read command line after its first byte
+	WriteTimeout   time.Duration // time to send reply
+	CommandTimeout time.Duration // deadline of context passed to handler
+	MaxLineBytes   int           // length of command line
+	MaxValueBytes  int           // length of single comma separated argument
+}
 
 // A Config represents optional server parameters
 type Config struct {
-	Logger *log.Logger
-	Stop   <-chan struct{}
+	Logger  *slog.Logger
+	Streams map[string]StreamHandler // commands switching connection to stream mode
+	Stats   *Stats                   // statistics updated by server, optional
+	SlowLog *SlowLog                 // log of slow commands, optional
+	Limits
+
+	// Password required by auth command before any other command, empty
+	// password disables authentication
+	Password string
+
+	// Databases is number of logical databases clients choose from with
+	// select command, 1 by default
+	Databases int
 }
@@ -1,75 +1,354 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
-	"fmt"
+	"context"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/textproto"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/maximp/stash/db"
 )
 
 // A connection represents single TCP connection to database server
 type connection struct {
 	*textproto.Conn
-	addr   net.Addr
-	logger *log.Logger
-}
+	conn    net.Conn // underlying connection to set deadlines
+	limits  Limits
+	addr    net.Addr
+	logger  *slog.Logger // with client address attribute
+	streams map[string]StreamHandler
+	stats   *Stats
+	slowlog *SlowLog
+	clients *clients
+	ctx     context.Context // cancelled on server Close
+	created time.Time
+	proto   int // protocol version selected by hello command
+	dbs     int // number of logical databases
 
-// log prints message to attached or global log interface
-func (c *connection) log(v ...interface{}) {
-	c.logger.Println(c.addr, ": ", fmt.Sprint(v...))
+	mu     sync.Mutex
+	name   string    // set by client setname command
+	cmd    string    // last command
+	active time.Time // last command time
+	busy   bool      // command is in progress
+	db     int       // logical database selected by select command
+
+	authenticated bool // auth command succeeded
 }
 
 // serve handles client connection
 func (c *connection) serve(handler Handler) {
+	defer atomic.AddInt64(&c.stats.Connected, -1)
+	defer c.clients.remove(c)
 	defer c.Close()
 
-	send := func(code int, result string) {
+	// send returns false if reply is not sent and connection must be closed
+	send := func(code int, result string) bool {
+		if c.limits.WriteTimeout > 0 {
+			c.conn.SetWriteDeadline(time.Now().Add(c.limits.WriteTimeout))
+		}
 		if err := c.PrintfLine("%d %s", code, result); err != nil {
-			c.log(err)
+			c.logger.Warn("send failed", "err", err)
+			return false
 		}
+		return true
 	}
 
 	for {
-		line, err := c.ReadLine()
+		line, err := c.readLine()
+		if err == ErrLineTooLong {
+			c.logger.Warn("command rejected", "err", err)
+			if !send(ServerOperationError, err.Error()) {
+				break
+			}
+			continue
+		}
 		if err != nil {
-			if err == io.EOF {
-				c.log("connection closed")
-			} else {
-				c.log(err)
+			switch err {
+			case io.EOF:
+				c.logger.Debug("connection closed")
+			case ErrIdleTimeout, ErrReadTimeout:
+				c.logger.Info("connection closed", "err", err)
+				send(ServerOperationError, err.Error())
+			default:
+				c.logger.Warn("connection closed", "err", err)
 			}
 			break
 		}
 
 		start := time.Now()
 
-		name, arg := parseCommand(line)
+		name, arg := parseCommand(db.DecodeLine(line))
+		if !c.begin(name, start) {
+			c.logger.Debug("connection closed", "reason", "shutdown")
+			break
+		}
+
 		if bytes.Equal(name, []byte("quit")) {
-			c.log("quit, connection closed")
+			c.logger.Debug("connection closed", "reason", "quit")
 			break
 		}
 
-		result, err := handler(name, arg)
-		if err != nil {
-			elapsed := time.Since(start)
-			c.log(elapsed, ", ", line, ", ", err)
-			send(ServerOperationError, err.Error())
+		if bytes.Equal(name, []byte("auth")) {
+			var sent bool
+			if err := c.clients.auth(arg); err != nil {
+				c.logger.Warn("authentication failed", "err", err)
+				sent = send(ServerOperationError, err.Error())
+			} else {
+				c.authenticated = true
+				c.logger.Debug("authenticated")
+				sent = send(ServerOperationOk, "Ok")
+			}
+			if !sent || !c.end() {
+				break
+			}
+			continue
+		}
+
+		if bytes.Equal(name, []byte("hello")) {
+			var sent bool
+			if proto, err := parseProtocol(arg); err != nil {
+				sent = send(ServerOperationError, err.Error())
+			} else {
+				c.proto = proto
+				c.logger.Debug("protocol selected", "proto", proto)
+				sent = send(ServerOperationOk, string(c.encode(db.StringReply([]byte("Ok")))))
+			}
+			if !sent || !c.end() {
+				break
+			}
 			continue
 		}
 
-		if result == nil {
-			result = []byte("")
+		if !c.authenticated && c.clients.authRequired() {
+			c.logger.Debug("command rejected", "cmd", string(name), "err", ErrAuthRequired)
+			if !send(ServerOperationError, ErrAuthRequired.Error()) || !c.end() {
+				break
+			}
+			continue
 		}
 
+		if bytes.Equal(name, []byte("select")) {
+			var sent bool
+			if n, err := parseDatabase(arg, c.dbs); err != nil {
+				sent = send(ServerOperationError, err.Error())
+			} else {
+				c.mu.Lock()
+				c.db = n
+				c.mu.Unlock()
+				c.logger.Debug("database selected", "db", n)
+				sent = send(ServerOperationOk, string(c.encode(db.StringReply([]byte("Ok")))))
+			}
+			if !sent || !c.end() {
+				break
+			}
+			continue
+		}
+
+		if stream, ok := c.streams[string(name)]; ok {
+			// stream is not a command in progress, Shutdown closes it
+			c.end()
+			c.logger.Info("stream started", "cmd", string(name))
+			if err := stream(c.Conn, c.addr, arg); err != nil {
+				c.logger.Warn("stream failed", "cmd", string(name), "err", err)
+			}
+			c.logger.Info("stream finished, connection closed", "cmd", string(name))
+			break
+		}
+
+		var reply db.Reply
+		if c.limits.MaxValueBytes > 0 && longestArg(arg) > c.limits.MaxValueBytes {
+			err = ErrValueTooLong
+		} else if bytes.Equal(name, []byte("client")) {
+			reply, err = c.clients.command(c, arg)
+		} else {
+			c.clients.wait()
+			start = time.Now()
+			ctx, cancel := c.commandContext()
+			reply, err = handler(ctx, name, arg)
+			cancel()
+		}
+		atomic.AddUint64(&c.stats.Commands, 1)
+
 		elapsed := time.Since(start)
-		c.log(elapsed, ", ", line)
+		if c.slowlog != nil {
+			c.slowlog.Add(start, elapsed, c.addr.String(), name, arg)
+		}
+
+		// key is unescaped only when debug log is written
+		var sent bool
+		debug := c.logger.Enabled(context.Background(), slog.LevelDebug)
+		if err != nil {
+			if debug {
+				c.logger.Debug("command failed", "cmd", string(name), "key", string(db.FirstArg(arg)),
+					"duration", elapsed, "err", err)
+			}
+			if _, ok := err.(*Redirect); ok {
+				sent = send(ServerOperationRedirect, err.Error())
+			} else {
+				sent = send(ServerOperationError, db.EncodeLine(err.Error()))
+			}
+		} else {
+			if debug {
+				c.logger.Debug("command", "cmd", string(name), "key", string(db.FirstArg(arg)), "duration", elapsed)
+			}
+
+			sent = send(ServerOperationOk, string(c.encode(reply)))
+		}
+
+		if !c.end() {
+			c.logger.Debug("connection closed", "reason", "shutdown")
+			break
+		}
 
-		send(ServerOperationOk, string(result))
+		if !sent {
+			break
+		}
 	}
 }
 
+// readLine reads command line. It waits for the first byte of line up to
+// IdleTimeout, then reads the rest of line up to ReadTimeout. Line longer
+// than MaxLineBytes is skipped and ErrLineTooLong is returned.
+func (c *connection) readLine() (string, error) {
+	var deadline time.Time
+	if c.limits.IdleTimeout > 0 {
+		deadline = time.Now().Add(c.limits.IdleTimeout)
+	}
+	c.conn.SetReadDeadline(deadline)
+
+	if _, err := c.R.Peek(1); err != nil {
+		if isTimeout(err) {
+			return "", ErrIdleTimeout
+		}
+		return "", err
+	}
+
+	deadline = time.Time{}
+	if c.limits.ReadTimeout > 0 {
+		deadline = time.Now().Add(c.limits.ReadTimeout)
+	}
+	c.conn.SetReadDeadline(deadline)
+
+	var (
+		line    []byte
+		tooLong bool
+	)
+	for {
+		b, err := c.R.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull {
+			if isTimeout(err) {
+				return "", ErrReadTimeout
+			}
+			return "", err
+		}
+
+		if !tooLong {
+			line = append(line, b...)
+			if max := c.limits.MaxLineBytes; max > 0 && len(bytes.TrimRight(line, "\r\n")) > max {
+				line, tooLong = nil, true
+			}
+		}
+
+		if err == nil {
+			break
+		}
+	}
+
+	if tooLong {
+		return "", ErrLineTooLong
+	}
+
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
+
+// encode returns reply encoded by protocol of connection, text reply is
+// converted to single line by db.EncodeLine
+func (c *connection) encode(r db.Reply) []byte {
+	if c.proto == ProtocolTyped {
+		return r.Typed()
+	}
+	return []byte(db.EncodeLine(string(r.Text())))
+}
+
+// parseProtocol parses argument of hello command, protocol version
+func parseProtocol(arg []byte) (int, error) {
+	switch string(arg) {
+	case "1":
+		return ProtocolText, nil
+	case "2":
+		return ProtocolTyped, nil
+	}
+	return 0, ErrInvalidProtocol
+}
+
+// parseDatabase parses argument of select command, index of one of n
+// logical databases
+func parseDatabase(arg []byte, n int) (int, error) {
+	i, err := strconv.Atoi(string(arg))
+	if err != nil || i < 0 || i >= n {
+		return 0, ErrInvalidDatabase
+	}
+	return i, nil
+}
+
+// commandContext returns context passed to handler, it carries selected
+// database and expires after CommandTimeout
+func (c *connection) commandContext() (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(c.ctx, databaseKey{}, c.db)
+	if c.limits.CommandTimeout > 0 {
+		return context.WithTimeout(ctx, c.limits.CommandTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// isTimeout reports whether err is network timeout
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// longestArg returns length of the longest argument of command
+func longestArg(arg []byte) int {
+	longest := 0
+	for _, a := range db.SplitArg(arg) {
+		if len(a) > longest {
+			longest = len(a)
+		}
+	}
+	return longest
+}
+
+// begin marks connection busy with command name, it reports false if server
+// is shutting down and command must not be started
+func (c *connection) begin(name []byte, start time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.clients.shutdown() {
+		return false
+	}
+
+	c.busy = true
+	c.cmd, c.active = string(name), start
+	return true
+}
+
+// end marks connection idle, it reports false if server is shutting down
+func (c *connection) end() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.busy = false
+	return !c.clients.shutdown()
+}
+
 // parseCommand parses string and returns name of command and its arg
 func parseCommand(str string) (cmd []byte, arg []byte) {
 	bb := bytes.TrimSpace([]byte(str))
@@ -1,6 +1,11 @@
 package server
 
-import "testing"
+import (
+	"context"
+	"testing"
+
+	"github.com/maximp/stash/db"
+)
 
 func TestParseCommand(t *testing.T) {
 	var parseCmdTests = []struct {
@@ -22,3 +27,42 @@ func TestParseCommand(t *testing.T) {
 		}
 	}
 }
+
+func TestLongestArg(t *testing.T) {
+	var longestArgTests = []struct {
+		input string
+		wants int
+	}{
+		{"", 0},
+		{"name", 4},
+		{"name,value", 5},
+		{"a,bb,ccc", 3},
+		{"a\\,bb,c", 4},
+		{"a,", 1},
+	}
+
+	for i, test := range longestArgTests {
+		if n := longestArg([]byte(test.input)); n != test.wants {
+			t.Errorf("[%d] longestArg('%s') == %d, expected: %d", i, test.input, n, test.wants)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	handler := Commands(func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		return db.StringReply([]byte("next")), nil
+	}, "get", "set", "get")
+
+	if r, err := handler(context.Background(), []byte("command"), nil); err != nil || r.Type != db.ReplyArray ||
+		string(r.Text()) != "auth,client,command,get,hello,quit,select,set" {
+		t.Errorf("command failed with '%s' (%v)", r.Text(), err)
+	}
+
+	if _, err := handler(context.Background(), []byte("command"), []byte("x")); err != ErrInvalidArgument {
+		t.Errorf("command x failed with %v, expected: %v", err, ErrInvalidArgument)
+	}
+
+	if r, err := handler(context.Background(), []byte("get"), []byte("name")); err != nil || string(r.Text()) != "next" {
+		t.Errorf("get failed with '%s' (%v)", r.Text(), err)
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/maximp/stash/db"
+)
+
+// Version of stash server reported by info command
+const Version = "0.2.0"
+
+// An InfoSection returns "field:value" lines of single info section
+type InfoSection func() ([]byte, error)
+
+// An Info serves "info [section]" command. Sections "server", "clients" and
+// "stats" are built from server statistics, other sections are registered by
+// packages serving the rest of commands.
+type Info struct {
+	start time.Time
+	stats *Stats
+
+	mu       sync.RWMutex
+	names    []string
+	sections map[string]InfoSection
+}
+
+// NewInfo creates info command reporting server statistics s, s must be
+// passed to server in Config.Stats
+func NewInfo(s *Stats) *Info {
+	i := &Info{
+		start:    time.Now(),
+		stats:    s,
+		sections: make(map[string]InfoSection),
+	}
+
+	i.Section("server", i.server)
+	i.Section("clients", i.clients)
+	i.Section("stats", i.counters)
+
+	return i
+}
+
+// Section registers info section, sections are reported in order of registration
+func (i *Info) Section(name string, fn InfoSection) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.sections[name]; !ok {
+		i.names = append(i.names, name)
+	}
+	i.sections[name] = fn
+}
+
+// Handler wraps handler to serve info command
+func (i *Info) Handler(next Handler) Handler {
+	return func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		if string(cmd) != "info" {
+			return next(ctx, cmd, arg)
+		}
+
+		r, err := i.Reply(strings.TrimSpace(string(arg)))
+		if err != nil {
+			return db.Reply{}, err
+		}
+		return db.StringReply(r), nil
+	}
+}
+
+// Reply returns text of info section, or of all sections if section is
+// empty. Every section starts with "# name" line followed by "field:value"
+// lines, sections are separated by empty line.
+func (i *Info) Reply(section string) ([]byte, error) {
+	i.mu.RLock()
+	names := i.names
+	sections := i.sections
+	if section != "" {
+		if _, ok := sections[section]; !ok {
+			i.mu.RUnlock()
+			return nil, ErrInvalidSection
+		}
+		names = []string{section}
+	}
+	i.mu.RUnlock()
+
+	var b []byte
+	for _, name := range names {
+		r, err := sections[name]()
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > 0 {
+			b = append(b, '\n')
+		}
+		b = append(append(append(b, "# "...), name...), '\n')
+		b = append(b, r...)
+	}
+
+	return bytes.TrimSuffix(b, []byte("\n")), nil
+}
+
+func (i *Info) server() ([]byte, error) {
+	return fields(
+		"version", Version,
+		"go_version", runtime.Version(),
+		"os", runtime.GOOS+"/"+runtime.GOARCH,
+		"process_id", strconv.Itoa(os.Getpid()),
+		"uptime_in_seconds", strconv.FormatInt(int64(time.Since(i.start)/time.Second), 10),
+	), nil
+}
+
+func (i *Info) clients() ([]byte, error) {
+	return fields(
+		"connected_clients", strconv.FormatInt(atomic.LoadInt64(&i.stats.Connected), 10),
+		"total_connections", strconv.FormatUint(atomic.LoadUint64(&i.stats.Accepted), 10),
+	), nil
+}
+
+func (i *Info) counters() ([]byte, error) {
+	return fields(
+		"total_commands_processed", strconv.FormatUint(atomic.LoadUint64(&i.stats.Commands), 10),
+		"total_net_input_bytes", strconv.FormatUint(atomic.LoadUint64(&i.stats.BytesIn), 10),
+		"total_net_output_bytes", strconv.FormatUint(atomic.LoadUint64(&i.stats.BytesOut), 10),
+	), nil
+}
+
+// fields formats name, value pairs as "name:value" lines
+func fields(kv ...string) []byte {
+	var b []byte
+	for i := 0; i+1 < len(kv); i += 2 {
+		b = append(append(append(append(b, kv[i]...), ':'), kv[i+1]...), '\n')
+	}
+	return b
+}
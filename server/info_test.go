@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/maximp/stash/db"
+)
+
+func TestInfo(t *testing.T) {
+	stats := &Stats{Connected: 2, Commands: 10}
+	info := NewInfo(stats)
+	info.Section("keyspace", func() ([]byte, error) {
+		return []byte("str_keys:1\n"), nil
+	})
+
+	handler := info.Handler(func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		return db.StringReply([]byte("next")), nil
+	})
+
+	if r, err := handler(context.Background(), []byte("get"), []byte("name")); err != nil || string(r.Text()) != "next" {
+		t.Errorf("get failed with '%s' (%v)", r.Text(), err)
+	}
+
+	r, err := handler(context.Background(), []byte("info"), nil)
+	if err != nil {
+		t.Fatalf("info failed with %v", err)
+	}
+	text := string(r.Text())
+	for _, line := range []string{"# server", "version:" + Version, "# clients",
+		"connected_clients:2", "# stats", "total_commands_processed:10", "# keyspace", "str_keys:1"} {
+		if !strings.Contains(text, line+"\n") && !strings.HasSuffix(text, line) {
+			t.Errorf("info does not contain '%s'", line)
+		}
+	}
+
+	if r, err := handler(context.Background(), []byte("info"), []byte("keyspace")); err != nil || string(r.Text()) != "# keyspace\nstr_keys:1" {
+		t.Errorf("info keyspace failed with '%s' (%v)", r.Text(), err)
+	}
+
+	if _, err := handler(context.Background(), []byte("info"), []byte("unknown")); err != ErrInvalidSection {
+		t.Errorf("info unknown failed with %v, expected: %v", err, ErrInvalidSection)
+	}
+}
@@ -1,21 +1,50 @@
 package server
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/textproto"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// ListenAndServe announces addr on the local network and accepts incoming connections.
-// All incoming data, line by line, are passed to user-defined handler. Data returned
-// from handler is transfered back to connected client.
-func ListenAndServe(addr string, handler Handler, cfg *Config) error {
+// ErrServerClosed is returned by Server.ListenAndServe after Shutdown or Close
+var ErrServerClosed = errors.New("server closed")
+
+// shutdownPollInterval is how often Shutdown checks for connections to finish
+const shutdownPollInterval = 10 * time.Millisecond
+
+// A Server accepts client connections and passes incoming commands to handler
+type Server struct {
+	addr    string
+	handler Handler
+	logger  *slog.Logger
+	streams map[string]StreamHandler
+	stats   *Stats
+	slowlog *SlowLog
+	clients *clients
+	limits  Limits
+	dbs     int // number of logical databases
+
+	mu       sync.Mutex
+	listener net.Listener
+	closing  int32 // accessed atomically, 1 after Shutdown or Close
+
+	ctx    context.Context // parent of command contexts, cancelled on Close
+	cancel context.CancelFunc
+}
+
+// NewServer creates server listening at addr, ":7777" if addr is empty.
+// cfg is optional.
+func NewServer(addr string, handler Handler, cfg *Config) (*Server, error) {
 
 	// check handler is defined
 	if handler == nil {
-		return errors.New("invalid server handler")
+		return nil, errors.New("invalid server handler")
 	}
 
 	// default address
@@ -23,48 +52,212 @@ func ListenAndServe(addr string, handler Handler, cfg *Config) error {
 		addr = ":7777"
 	}
 
+	s := &Server{
+		addr:    addr,
+		handler: handler,
+		stats:   &Stats{},
+		dbs:     1,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
 	// setup log
-	var logger *log.Logger
 	if cfg == nil || cfg.Logger == nil {
-		logger = log.New(ioutil.Discard, "", 0)
+		s.logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
 	} else {
-		logger = cfg.Logger
+		s.logger = cfg.Logger
+	}
+
+	// stream commands, statistics and slow log
+	if cfg != nil {
+		s.streams = cfg.Streams
+		s.slowlog = cfg.SlowLog
+		s.limits = cfg.Limits
+		if cfg.Stats != nil {
+			s.stats = cfg.Stats
+		}
+		if cfg.Databases > 1 {
+			s.dbs = cfg.Databases
+		}
+	}
+
+	// registry of connected clients
+	s.clients = newClients(s.shuttingDown)
+	if cfg != nil {
+		s.clients.password = cfg.Password
 	}
 
+	return s, nil
+}
+
+// ListenAndServe announces addr on the local network and accepts incoming connections.
+// All incoming data, line by line, are passed to user-defined handler. Data returned
+// from handler is transfered back to connected client. It returns
+// ErrServerClosed after Shutdown or Close.
+func (s *Server) ListenAndServe() error {
+
 	// start listening server socket
-	listener, err := net.Listen("tcp", addr)
+	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
 		return err
 	}
 
-	logger.Println("listening ", listener.Addr())
-
-	stopped := false
-	if cfg != nil && cfg.Stop != nil {
-		// running stop monitor
-		go func() {
-			<-cfg.Stop
-			stopped = true
-			logger.Println("received stop signal...")
-			listener.Close()
-		}()
+	s.mu.Lock()
+	if s.shuttingDown() {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
 	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	s.logger.Info("listening", "addr", listener.Addr().String())
 
 	for {
 		netconn, err := listener.Accept()
 		if err != nil {
-			if stopped {
-				return nil
+			if s.shuttingDown() {
+				return ErrServerClosed
 			}
 			return err
 		}
 
-		conn := &connection{textproto.NewConn(netconn),
-			netconn.RemoteAddr(),
-			logger,
+		atomic.AddUint64(&s.stats.Accepted, 1)
+
+		if s.limits.MaxClients > 0 && atomic.LoadInt64(&s.stats.Connected) >= int64(s.limits.MaxClients) {
+			go s.reject(netconn, ErrMaxClients)
+			continue
+		}
+
+		atomic.AddInt64(&s.stats.Connected, 1)
+
+		counting := &countingConn{netconn, s.stats}
+		conn := &connection{
+			Conn:    textproto.NewConn(counting),
+			conn:    counting,
+			limits:  s.limits,
+			addr:    netconn.RemoteAddr(),
+			logger:  s.logger.With("addr", netconn.RemoteAddr().String()),
+			streams: s.streams,
+			stats:   s.stats,
+			slowlog: s.slowlog,
+			clients: s.clients,
+			ctx:     s.ctx,
+			created: time.Now(),
+			proto:   ProtocolText,
+			dbs:     s.dbs,
+		}
+		conn.logger.Debug("connected")
+
+		s.clients.add(conn)
+		go conn.serve(s.handler)
+	}
+}
+
+// rejectTimeout limits time to send error reply to rejected connection
+const rejectTimeout = time.Second
+
+// reject sends error reply to connection and closes it
+func (s *Server) reject(conn net.Conn, err error) {
+	s.logger.Warn("connection rejected", "addr", conn.RemoteAddr().String(), "err", err)
+
+	conn.SetWriteDeadline(time.Now().Add(rejectTimeout))
+	textproto.NewConn(conn).PrintfLine("%d %s", ServerOperationError, err)
+	conn.Close()
+}
+
+// SetPassword changes password required by auth command, empty password
+// disables authentication. Already authenticated clients stay authenticated.
+func (s *Server) SetPassword(password string) {
+	s.clients.mu.Lock()
+	s.clients.password = password
+	s.clients.mu.Unlock()
+}
+
+// Addr returns address server is listening at, or nil if server is not listening
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Shutdown gracefully shuts down the server: it stops accepting connections,
+// closes idle connections and waits for connections to finish commands in
+// progress. If ctx expires first, commands in progress are cancelled,
+// remaining connections are closed and ctx error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stop()
+	s.logger.Info("shutting down")
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.clients.closeIdle() {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			s.cancel()
+			s.clients.closeAll()
+			return ctx.Err()
+		case <-ticker.C:
 		}
-		conn.log("connected")
+	}
+}
 
-		go conn.serve(handler)
+// Close immediately closes listener and all connections, commands in
+// progress are cancelled
+func (s *Server) Close() error {
+	s.stop()
+	s.cancel()
+	s.clients.closeAll()
+	return nil
+}
+
+// stop marks server closing and closes its listener
+func (s *Server) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	atomic.StoreInt32(&s.closing, 1)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	return atomic.LoadInt32(&s.closing) != 0
+}
+
+// ListenAndServe creates server with given parameters and runs it, see
+// Server.ListenAndServe
+func ListenAndServe(addr string, handler Handler, cfg *Config) error {
+	s, err := NewServer(addr, handler, cfg)
+	if err != nil {
+		return err
 	}
+	return s.ListenAndServe()
+}
+
+// A countingConn counts bytes transferred over connection
+type countingConn struct {
+	net.Conn
+	stats *Stats
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.stats.BytesIn, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.stats.BytesOut, uint64(n))
+	return n, err
 }
@@ -2,13 +2,71 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/maximp/stash/db"
 )
 
+// newTestLogger creates logger writing messages without time to w
+func newTestLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}))
+}
+
+// A syncBuffer is bytes.Buffer safe for logger writing from server goroutines
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (b *syncBuffer) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf.Reset()
+}
+
+// waitFor polls cond until it returns true or timeout expires
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
+
 func TestServerCreateError(t *testing.T) {
 	if err := ListenAndServe("", nil, nil); err.Error() != "invalid server handler" {
 		t.Error(err)
@@ -16,78 +74,78 @@ func TestServerCreateError(t *testing.T) {
 }
 
 func TestServerListen(t *testing.T) {
-	stop := make(chan struct{})
-
-	var buf bytes.Buffer
+	var buf syncBuffer
 	cfg := Config{
-		Logger: log.New(&buf, "", 0),
-		Stop:   stop,
+		Logger: newTestLogger(&buf),
 	}
 
-	handler := func(cmd []byte, arg []byte) ([]byte, error) {
-		return nil, nil
+	handler := func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		return db.Reply{}, nil
+	}
+
+	s, err := NewServer("", handler, &cfg)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	var err error
 	stopped := make(chan struct{})
 	go func() {
-		err = ListenAndServe("", handler, &cfg)
+		err = s.ListenAndServe()
 		stopped <- struct{}{}
 	}()
 
 	time.Sleep(10 * time.Millisecond)
 
-	if str := buf.String(); str != "listening  [::]:7777\n" {
+	if str := buf.String(); str != "level=INFO msg=listening addr=[::]:7777\n" {
 		t.Errorf("listening: %s", str)
 	}
 	buf.Reset()
 
-	if err != nil {
+	if err := s.Shutdown(context.Background()); err != nil {
 		t.Fatal(err)
-	} else {
-		stop <- struct{}{}
 	}
 
 	<-stopped
 
-	if str := buf.String(); str != "received stop signal...\n" {
+	if err != ErrServerClosed {
+		t.Errorf("server finished with %v, expected: %v", err, ErrServerClosed)
+	}
+
+	if str := buf.String(); str != "level=INFO msg=\"shutting down\"\n" {
 		t.Errorf("stop: %s", str)
 	}
 }
 
 func TestServerComm(t *testing.T) {
-	stop := make(chan struct{})
-
-	var buf bytes.Buffer
+	var buf syncBuffer
 	cfg := Config{
-		Logger: log.New(&buf, "", 0),
-		Stop:   stop,
+		Logger: newTestLogger(&buf),
 	}
 
 	var cmd string
 	var arg string
-	handler := func(c []byte, a []byte) ([]byte, error) {
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
 		cmd = string(c)
 		arg = string(a)
 		if cmd == "error" {
-			return nil, errors.New("error")
+			return db.Reply{}, errors.New("error")
 		}
-		return []byte("ok"), nil
+		return db.StringReply([]byte("ok")), nil
+	}
+
+	s, err := NewServer("", handler, &cfg)
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	var err error
 	stopped := make(chan struct{})
 	go func() {
-		err = ListenAndServe("", handler, &cfg)
+		s.ListenAndServe()
 		stopped <- struct{}{}
 	}()
 
 	time.Sleep(10 * time.Millisecond)
 
-	if err != nil {
-		t.Fatal(err)
-	}
-
 	if conn, err := textproto.Dial("tcp", "127.0.0.1:7777"); err != nil {
 		t.Error(err)
 	} else {
@@ -114,6 +172,596 @@ func TestServerComm(t *testing.T) {
 		}
 	}
 
-	stop <- struct{}{}
+	s.Shutdown(context.Background())
+	<-stopped
+}
+
+func TestServerStream(t *testing.T) {
+	var arg string
+	cfg := Config{
+		Streams: map[string]StreamHandler{
+			"stream": func(conn *textproto.Conn, addr net.Addr, a []byte) error {
+				arg = string(a)
+				for i := 0; i < 3; i++ {
+					conn.PrintfLine("line %d", i)
+				}
+				return nil
+			},
+		},
+	}
+
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
+		return db.StringReply([]byte("ok")), nil
+	}
+
+	s, err := NewServer("127.0.0.1:7778", handler, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	if conn, err := textproto.Dial("tcp", "127.0.0.1:7778"); err != nil {
+		t.Error(err)
+	} else {
+		defer conn.Close()
+
+		if _, err := conn.Cmd("stream a, b"); err != nil {
+			t.Error(err)
+		}
+
+		for i := 0; i < 3; i++ {
+			if line, err := conn.ReadLine(); err != nil || line != "line "+strconv.Itoa(i) {
+				t.Errorf("stream line %d = '%s' (%v)", i, line, err)
+			}
+		}
+
+		if _, err := conn.ReadLine(); err != io.EOF {
+			t.Errorf("connection is not closed after stream, err = %v", err)
+		}
+
+		if arg != "a, b" {
+			t.Errorf("stream arg = '%s'", arg)
+		}
+	}
+
+	s.Shutdown(context.Background())
 	<-stopped
 }
+
+func TestServerClients(t *testing.T) {
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
+		return db.StringReply([]byte("ok")), nil
+	}
+
+	s, err := NewServer("127.0.0.1:7779", handler, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-stopped
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	cmd := func(conn *textproto.Conn, str string) (int, string) {
+		if _, err := conn.Cmd("%s", str); err != nil {
+			t.Fatal(err)
+		}
+		code, line, err := conn.ReadCodeLine(0)
+		if err != nil && code == 0 {
+			t.Fatal(err)
+		}
+		return code, line
+	}
+
+	admin, err := textproto.Dial("tcp", "127.0.0.1:7779")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+
+	other, err := net.Dial("tcp", "127.0.0.1:7779")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConn := textproto.NewConn(other)
+	defer otherConn.Close()
+
+	if code, line := cmd(admin, "client setname admin"); code != ServerOperationOk || line != "Ok" {
+		t.Errorf("client setname failed with %d %s", code, line)
+	}
+	cmd(otherConn, "get name")
+
+	code, line := cmd(admin, "client list")
+	clients := strings.Split(line, ",")
+	if code != ServerOperationOk || len(clients) != 2 ||
+		!strings.Contains(clients[0], "name=admin ") || !strings.HasSuffix(clients[0], "cmd=client") ||
+		!strings.Contains(clients[1], "addr="+other.LocalAddr().String()+" ") ||
+		!strings.HasSuffix(clients[1], "cmd=get") {
+		t.Errorf("client list failed with %d %s", code, line)
+	}
+
+	if code, line := cmd(admin, "client kill 127.0.0.1:1"); code != ServerOperationError || line != ErrClientNotFound.Error() {
+		t.Errorf("client kill unknown failed with %d %s", code, line)
+	}
+
+	if code, line := cmd(admin, "client kill "+other.LocalAddr().String()); code != ServerOperationOk || line != "Ok" {
+		t.Errorf("client kill failed with %d %s", code, line)
+	}
+	if _, err := otherConn.ReadLine(); err == nil {
+		t.Error("killed connection is not closed")
+	}
+
+	if code, line := cmd(admin, "client pause 50"); code != ServerOperationOk || line != "Ok" {
+		t.Errorf("client pause failed with %d %s", code, line)
+	}
+	start := time.Now()
+	if code, line := cmd(admin, "get name"); code != ServerOperationOk || line != "ok" {
+		t.Errorf("get failed with %d %s", code, line)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("command executed after %v during pause", elapsed)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
+		if d, err := time.ParseDuration(string(a)); err == nil {
+			time.Sleep(d)
+		}
+		return db.StringReply([]byte("ok")), nil
+	}
+
+	var shutdownTests = []struct {
+		sleep   string
+		timeout time.Duration
+		err     error
+		reply   bool
+	}{
+		{"50ms", time.Second, nil, true},
+		{"500ms", 50 * time.Millisecond, context.DeadlineExceeded, false},
+	}
+
+	for _, test := range shutdownTests {
+		s, err := NewServer("127.0.0.1:7780", handler, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stopped := make(chan error)
+		go func() {
+			stopped <- s.ListenAndServe()
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+
+		idle, err := textproto.Dial("tcp", "127.0.0.1:7780")
+		if err != nil {
+			t.Fatal(err)
+		}
+		busy, err := textproto.Dial("tcp", "127.0.0.1:7780")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := busy.Cmd("sleep %s", test.sleep); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+		if err := s.Shutdown(ctx); err != test.err {
+			t.Errorf("shutdown finished with %v, expected: %v", err, test.err)
+		}
+		cancel()
+
+		if err := <-stopped; err != ErrServerClosed {
+			t.Errorf("server finished with %v, expected: %v", err, ErrServerClosed)
+		}
+
+		if _, err := idle.ReadLine(); err == nil {
+			t.Error("idle connection is not closed")
+		}
+
+		code, line, err := busy.ReadCodeLine(0)
+		if test.reply && (err != nil || code != ServerOperationOk || line != "ok") {
+			t.Errorf("command in progress failed with %d %s (%v)", code, line, err)
+		}
+		if !test.reply && err == nil {
+			t.Errorf("command in progress is not interrupted: %d %s", code, line)
+		}
+
+		if _, err := busy.ReadLine(); err == nil {
+			t.Error("busy connection is not closed after reply")
+		}
+
+		idle.Close()
+		busy.Close()
+	}
+}
+
+func TestServerLimits(t *testing.T) {
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
+		if string(c) == "big" {
+			return db.StringReply(bytes.Repeat([]byte("a"), 16<<20)), nil
+		}
+		return db.StringReply([]byte("ok")), nil
+	}
+
+	stats := &Stats{}
+	s, err := NewServer("127.0.0.1:7781", handler, &Config{
+		Stats: stats,
+		Limits: Limits{
+			MaxClients:    2,
+			IdleTimeout:   200 * time.Millisecond,
+			ReadTimeout:   50 * time.Millisecond,
+			WriteTimeout:  50 * time.Millisecond,
+			MaxLineBytes:  64,
+			MaxValueBytes: 16,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-stopped
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	dial := func() *textproto.Conn {
+		conn, err := textproto.Dial("tcp", "127.0.0.1:7781")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	expect := func(conn *textproto.Conn, code int, line string) {
+		c, l, err := conn.ReadCodeLine(0)
+		if c != code || l != line {
+			t.Errorf("reply %d %s (%v), expected: %d %s", c, l, err, code, line)
+		}
+	}
+
+	c1 := dial()
+	defer c1.Close()
+
+	// MaxValueBytes and MaxLineBytes
+	c1.PrintfLine("set name,%s", strings.Repeat("a", 17))
+	expect(c1, ServerOperationError, ErrValueTooLong.Error())
+	c1.PrintfLine("set %s", strings.Repeat("a,", 40))
+	expect(c1, ServerOperationError, ErrLineTooLong.Error())
+	c1.PrintfLine("set name,%s", strings.Repeat("a", 16))
+	expect(c1, ServerOperationOk, "ok")
+
+	// MaxClients
+	c2 := dial()
+	defer c2.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	c3 := dial()
+	defer c3.Close()
+	expect(c3, ServerOperationError, ErrMaxClients.Error())
+
+	// ReadTimeout
+	c2.W.WriteString("get")
+	c2.W.Flush()
+	time.Sleep(100 * time.Millisecond)
+	expect(c2, ServerOperationError, ErrReadTimeout.Error())
+
+	// IdleTimeout
+	time.Sleep(200 * time.Millisecond)
+	expect(c1, ServerOperationError, ErrIdleTimeout.Error())
+	if _, err := c1.ReadLine(); err == nil {
+		t.Error("connection is not closed after idle timeout")
+	}
+
+	// WriteTimeout
+	c4 := dial()
+	defer c4.Close()
+	c4.PrintfLine("big")
+	if !waitFor(2*time.Second, func() bool { return atomic.LoadInt64(&stats.Connected) == 0 }) {
+		t.Errorf("%d clients connected after write timeout", atomic.LoadInt64(&stats.Connected))
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
+		return db.StringReply([]byte("ok")), nil
+	}
+
+	s, err := NewServer("127.0.0.1:7782", handler, &Config{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-stopped
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := textproto.Dial("tcp", "127.0.0.1:7782")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var authTests = []struct {
+		cmd   string
+		code  int
+		wants string
+	}{
+		{"get name", ServerOperationError, ErrAuthRequired.Error()},
+		{"auth wrong", ServerOperationError, ErrInvalidPassword.Error()},
+		{"get name", ServerOperationError, ErrAuthRequired.Error()},
+		{"auth secret", ServerOperationOk, "Ok"},
+		{"get name", ServerOperationOk, "ok"},
+	}
+
+	for _, test := range authTests {
+		if _, err := conn.Cmd("%s", test.cmd); err != nil {
+			t.Fatal(err)
+		}
+		if code, line, _ := conn.ReadCodeLine(0); code != test.code || line != test.wants {
+			t.Errorf("%s replied %d %s, expected: %d %s", test.cmd, code, line, test.code, test.wants)
+		}
+	}
+
+	s.SetPassword("")
+
+	other, err := textproto.Dial("tcp", "127.0.0.1:7782")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if _, err := other.Cmd("get name"); err != nil {
+		t.Fatal(err)
+	}
+	if code, line, _ := other.ReadCodeLine(0); code != ServerOperationOk || line != "ok" {
+		t.Errorf("get without password replied %d %s", code, line)
+	}
+}
+
+func TestServerLog(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		buf bytes.Buffer
+	)
+	logger := slog.New(slog.NewJSONHandler(writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	}), &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
+		if string(c) == "error" {
+			return db.Reply{}, errors.New("failed")
+		}
+		return db.StringReply([]byte("ok")), nil
+	}
+
+	s, err := NewServer("127.0.0.1:7783", handler, &Config{Logger: logger})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := textproto.Dial("tcp", "127.0.0.1:7783")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"set name, value", "error key"} {
+		conn.PrintfLine("%s", cmd)
+		conn.ReadCodeLine(0)
+	}
+	conn.Close()
+
+	s.Shutdown(context.Background())
+	<-stopped
+
+	type entry struct {
+		Level    string
+		Msg      string
+		Addr     string
+		Cmd      string
+		Key      string
+		Duration int64
+		Err      string
+	}
+
+	var entries []entry
+	mu.Lock()
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e entry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid log line '%s': %v", line, err)
+		}
+		if e.Cmd != "" {
+			entries = append(entries, e)
+		}
+	}
+	mu.Unlock()
+
+	if len(entries) != 2 {
+		t.Fatalf("%d command log entries, expected 2", len(entries))
+	}
+
+	for i, wants := range []entry{
+		{Level: "DEBUG", Msg: "command", Cmd: "set", Key: "name"},
+		{Level: "DEBUG", Msg: "command failed", Cmd: "error", Key: "key", Err: "failed"},
+	} {
+		e := entries[i]
+		if e.Level != wants.Level || e.Msg != wants.Msg || e.Cmd != wants.Cmd || e.Key != wants.Key ||
+			e.Err != wants.Err || e.Addr == "" || e.Duration <= 0 {
+			t.Errorf("log entry %+v, expected %+v", e, wants)
+		}
+	}
+}
+
+// A writerFunc implements io.Writer interface by function
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestServerProtocol(t *testing.T) {
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
+		switch string(c) {
+		case "keys":
+			return db.ArrayReply(db.StringReply([]byte("a,b")), db.NilReply(), db.IntegerReply(1)), nil
+		case "error":
+			return db.Reply{}, errors.New("failed")
+		}
+		return db.StringReply([]byte("line1\nline2")), nil
+	}
+
+	s, err := NewServer("127.0.0.1:7786", handler, &Config{Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-stopped
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := textproto.Dial("tcp", "127.0.0.1:7786")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var protocolTests = []struct {
+		cmd   string
+		code  int
+		wants string
+	}{
+		{"hello 2", ServerOperationOk, "$Ok"},
+		{"keys", ServerOperationError, ErrAuthRequired.Error()},
+		{"auth secret", ServerOperationOk, "Ok"},
+		{"keys", ServerOperationOk, "*3,$a\\,b,_,:1"},
+		{"get", ServerOperationOk, "$line1\\nline2"},
+		{"error", ServerOperationError, "failed"},
+		{"hello 3", ServerOperationError, ErrInvalidProtocol.Error()},
+		{"hello 1", ServerOperationOk, "Ok"},
+		{"keys", ServerOperationOk, "a,b,,1"},
+	}
+
+	for _, test := range protocolTests {
+		if _, err := conn.Cmd("%s", test.cmd); err != nil {
+			t.Fatal(err)
+		}
+		if code, line, _ := conn.ReadCodeLine(0); code != test.code || line != test.wants {
+			t.Errorf("%s replied %d %s, expected: %d %s", test.cmd, code, line, test.code, test.wants)
+		}
+	}
+}
+
+func TestServerSelect(t *testing.T) {
+	handler := func(ctx context.Context, c []byte, a []byte) (db.Reply, error) {
+		return db.IntegerReply(int64(Database(ctx))), nil
+	}
+
+	s, err := NewServer("127.0.0.1:7789", handler, &Config{Password: "secret", Databases: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.ListenAndServe()
+		stopped <- struct{}{}
+	}()
+	defer func() {
+		s.Shutdown(context.Background())
+		<-stopped
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+
+	conn, err := textproto.Dial("tcp", "127.0.0.1:7789")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var selectTests = []struct {
+		cmd   string
+		code  int
+		wants string
+	}{
+		{"select 1", ServerOperationError, ErrAuthRequired.Error()},
+		{"auth secret", ServerOperationOk, "Ok"},
+		{"db", ServerOperationOk, "0"},
+		{"select 2", ServerOperationOk, "Ok"},
+		{"db", ServerOperationOk, "2"},
+		{"select 3", ServerOperationError, ErrInvalidDatabase.Error()},
+		{"select -1", ServerOperationError, ErrInvalidDatabase.Error()},
+		{"select x", ServerOperationError, ErrInvalidDatabase.Error()},
+		{"db", ServerOperationOk, "2"},
+		{"select 0", ServerOperationOk, "Ok"},
+		{"db", ServerOperationOk, "0"},
+	}
+
+	for _, test := range selectTests {
+		if _, err := conn.Cmd("%s", test.cmd); err != nil {
+			t.Fatal(err)
+		}
+		if code, line, _ := conn.ReadCodeLine(0); code != test.code || line != test.wants {
+			t.Errorf("%s replied %d %s, expected: %d %s", test.cmd, code, line, test.code, test.wants)
+		}
+	}
+
+	conn.Cmd("select 1")
+	conn.ReadCodeLine(ServerOperationOk)
+	conn.Cmd("client list")
+	if _, line, err := conn.ReadCodeLine(ServerOperationOk); err != nil || !strings.Contains(line, " db=1 ") {
+		t.Errorf("client list replied '%s' (%v)", line, err)
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maximp/stash/db"
+)
+
+// maxSlowArg limits length of command arguments kept in slow log entry
+const maxSlowArg = 128
+
+// A SlowEntry represents single command recorded in slow log
+type SlowEntry struct {
+	ID       uint64
+	Time     time.Time // command start
+	Duration time.Duration
+	Addr     string // client address
+	Command  string
+	Arg      string // truncated to maxSlowArg bytes
+}
+
+// A SlowLog records commands executed longer than threshold in bounded ring
+// buffer, the oldest entries are dropped when buffer is full
+type SlowLog struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	entries   []SlowEntry
+	next      int // position of the next entry
+	n         int // number of entries
+	id        uint64
+}
+
+// NewSlowLog creates slow log keeping up to size commands executed longer than
+// threshold, negative threshold disables logging
+func NewSlowLog(threshold time.Duration, size int) *SlowLog {
+	if size < 1 {
+		size = 1
+	}
+	return &SlowLog{threshold: threshold, entries: make([]SlowEntry, size)}
+}
+
+// SetThreshold changes slow log threshold, negative threshold disables logging
+func (l *SlowLog) SetThreshold(threshold time.Duration) {
+	l.mu.Lock()
+	l.threshold = threshold
+	l.mu.Unlock()
+}
+
+// Threshold returns current slow log threshold
+func (l *SlowLog) Threshold() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.threshold
+}
+
+// Add records command if its duration exceeds threshold
+func (l *SlowLog) Add(start time.Time, duration time.Duration, addr string, cmd, arg []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.threshold < 0 || duration < l.threshold {
+		return
+	}
+
+	a := string(arg)
+	if len(a) > maxSlowArg {
+		a = a[:maxSlowArg] + "..."
+	}
+
+	l.id++
+	l.entries[l.next] = SlowEntry{l.id, start, duration, addr, string(cmd), a}
+	l.next = (l.next + 1) % len(l.entries)
+	if l.n < len(l.entries) {
+		l.n++
+	}
+}
+
+// Get returns up to n the most recent entries, newest first, n < 0 means all
+func (l *SlowLog) Get(n int) []SlowEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n < 0 || n > l.n {
+		n = l.n
+	}
+
+	r := make([]SlowEntry, n)
+	for i := range r {
+		r[i] = l.entries[(l.next-1-i+len(l.entries))%len(l.entries)]
+	}
+	return r
+}
+
+// Len returns number of entries in slow log
+func (l *SlowLog) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n
+}
+
+// Reset removes all entries from slow log
+func (l *SlowLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := range l.entries {
+		l.entries[i] = SlowEntry{}
+	}
+	l.next, l.n = 0, 0
+}
+
+// Handler wraps handler to serve slow log commands:
+//
+//	slowlog get [n] - n the most recent entries, 10 by default, one per line:
+//	                  'id unix-time duration-us addr command arg'
+//	slowlog len     - number of entries
+//	slowlog reset   - remove all entries
+func (l *SlowLog) Handler(next Handler) Handler {
+	return func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		if string(cmd) != "slowlog" {
+			return next(ctx, cmd, arg)
+		}
+
+		fields := strings.Fields(string(arg))
+		if len(fields) == 0 {
+			return db.Reply{}, ErrInvalidArgument
+		}
+
+		switch fields[0] {
+		case "get":
+			n := 10
+			if len(fields) > 2 {
+				return db.Reply{}, ErrInvalidArgument
+			}
+			if len(fields) == 2 {
+				var err error
+				if n, err = strconv.Atoi(fields[1]); err != nil {
+					return db.Reply{}, ErrInvalidArgument
+				}
+			}
+
+			var items []db.Reply
+			for _, e := range l.Get(n) {
+				b := strconv.AppendUint(nil, e.ID, 10)
+				b = strconv.AppendInt(append(b, ' '), e.Time.Unix(), 10)
+				b = strconv.AppendInt(append(b, ' '), int64(e.Duration/time.Microsecond), 10)
+				b = append(append(append(append(b, ' '), e.Addr...), ' '), e.Command...)
+				if e.Arg != "" {
+					b = append(append(b, ' '), e.Arg...)
+				}
+				items = append(items, db.StringReply(b))
+			}
+			return db.ArrayReply(items...), nil
+
+		case "len":
+			if len(fields) != 1 {
+				return db.Reply{}, ErrInvalidArgument
+			}
+			return db.IntegerReply(int64(l.Len())), nil
+
+		case "reset":
+			if len(fields) != 1 {
+				return db.Reply{}, ErrInvalidArgument
+			}
+			l.Reset()
+			return db.StringReply([]byte("Ok")), nil
+
+		default:
+			return db.Reply{}, ErrInvalidArgument
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maximp/stash/db"
+)
+
+func TestSlowLog(t *testing.T) {
+	l := NewSlowLog(time.Millisecond, 3)
+
+	now := time.Now()
+	l.Add(now, time.Microsecond, "addr", []byte("get"), []byte("fast"))
+	for i := 1; i <= 4; i++ {
+		l.Add(now, time.Duration(i)*time.Millisecond, "addr", []byte("set"), []byte("name"+strconv.Itoa(i)))
+	}
+
+	if n := l.Len(); n != 3 {
+		t.Errorf("slow log length %d, expected 3", n)
+	}
+
+	entries := l.Get(-1)
+	if len(entries) != 3 {
+		t.Fatalf("slow log returned %d entries, expected 3", len(entries))
+	}
+	for i, e := range entries {
+		if e.ID != uint64(4-i) || e.Arg != "name"+strconv.Itoa(4-i) {
+			t.Errorf("entry %d is %+v", i, e)
+		}
+	}
+
+	if entries := l.Get(1); len(entries) != 1 || entries[0].ID != 4 {
+		t.Errorf("get 1 returned %+v", entries)
+	}
+
+	l.Add(now, time.Second, "addr", []byte("set"), []byte(strings.Repeat("a", 200)))
+	if e := l.Get(1)[0]; e.Arg != strings.Repeat("a", maxSlowArg)+"..." {
+		t.Errorf("argument is not truncated: %s", e.Arg)
+	}
+
+	l.SetThreshold(-1)
+	l.Add(now, time.Second, "addr", []byte("set"), []byte("disabled"))
+	if e := l.Get(1)[0]; e.Arg == "disabled" {
+		t.Error("command logged with disabled slow log")
+	}
+
+	l.Reset()
+	if n := l.Len(); n != 0 {
+		t.Errorf("slow log length %d after reset", n)
+	}
+}
+
+func TestSlowLogHandler(t *testing.T) {
+	l := NewSlowLog(0, 10)
+	handler := l.Handler(func(ctx context.Context, cmd []byte, arg []byte) (db.Reply, error) {
+		return db.StringReply([]byte("next")), nil
+	})
+
+	l.Add(time.Unix(100, 0), 1500*time.Microsecond, "127.0.0.1:1000", []byte("set"), []byte("name,value"))
+	l.Add(time.Unix(101, 0), 2*time.Millisecond, "127.0.0.1:1000", []byte("keys"), nil)
+
+	var slowlogTests = []struct {
+		arg   string
+		wants string
+		err   error
+	}{
+		{"len", ":2", nil},
+		{"get", "*2,$2 101 2000 127.0.0.1:1000 keys,$1 100 1500 127.0.0.1:1000 set name\\,value", nil},
+		{"get 1", "*1,$2 101 2000 127.0.0.1:1000 keys", nil},
+		{"get x", "", ErrInvalidArgument},
+		{"", "", ErrInvalidArgument},
+		{"unknown", "", ErrInvalidArgument},
+		{"reset", "$Ok", nil},
+		{"len", ":0", nil},
+	}
+
+	for _, test := range slowlogTests {
+		r, err := handler(context.Background(), []byte("slowlog"), []byte(test.arg))
+		if err != test.err || (err == nil && string(r.Typed()) != test.wants) {
+			t.Errorf("slowlog %s failed with '%s' (%v), expected: '%s' (%v)", test.arg, r.Typed(), err, test.wants, test.err)
+		}
+	}
+
+	if r, err := handler(context.Background(), []byte("get"), []byte("name")); err != nil || string(r.Text()) != "next" {
+		t.Errorf("get failed with '%s' (%v)", r.Text(), err)
+	}
+}